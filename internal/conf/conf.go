@@ -3,8 +3,11 @@ package conf
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -12,18 +15,64 @@ import (
 
 type DisBuilder func([]byte) (interface{}, error)
 
+const (
+	// WriteModeRename renames service_name/discovery_type to _service_name/_discovery_type in the written value
+	WriteModeRename = "rename"
+	// WriteModeAnnotation keeps the operator's fields and records the ownership in the `_seed` annotation
+	WriteModeAnnotation = "annotation"
+
+	// StorageEtcd reads and writes APISIX resources in etcd directly
+	StorageEtcd = "etcd"
+	// StorageAdminAPI reads and writes APISIX resources through the APISIX Admin API
+	StorageAdminAPI = "admin_api"
+	// StorageStandalone reads resources from a file and renders them into an APISIX standalone-mode apisix.yaml
+	StorageStandalone = "standalone"
+
+	// APISIXVersionAuto tolerates the layouts of both APISIX 2.x and 3.x, so that mixed versions can share etcd
+	APISIXVersionAuto = "auto"
+	APISIXVersion2    = "2"
+	APISIXVersion3    = "3"
+)
+
 var (
-	WorkDir     = "."
-	ETCDConfig  *Etcd
-	LogConfig   *Log
-	DisConfigs  = make(map[string]interface{})
-	DisBuilders = make(map[string]DisBuilder)
+	WorkDir          = "."
+	ConfigFile       string
+	ETCDConfig       *Etcd
+	LogConfig        *Log
+	ProtectionConfig *Protection
+	SnapshotConfig   *Snapshot
+	WriteMode        = WriteModeRename
+	ResourceConfigs  []*Resource
+	Storage          = StorageEtcd
+	AdminAPIConfig   *AdminAPI
+	StandaloneConfig *Standalone
+	APISIXVersion    = APISIXVersionAuto
+	TargetConfigs    []*Target
+	ServerConfig     *Server
+	ReconcileConfig  *Reconcile
+	ShutdownConfig   *Shutdown
+	NodesConfig      *Nodes
+	DisConfigs       = make(map[string]interface{})
+	DisBuilders      = make(map[string]DisBuilder)
+	// DisSchemas are the JSON schemas of the discovery configurations by name, see DisBuilders.
+	// They describe the decoded configuration, e.g. Host for the key host in the file.
+	DisSchemas = make(map[string]string)
 )
 
 type TLS struct {
 	CertFile string `yaml:"cert"`
 	KeyFile  string `yaml:"key"`
-	Verify   bool
+	// CAFile verifies the etcd server certificate instead of the system roots
+	CAFile string `yaml:"ca_file"`
+	// SNI is the server name sent to and verified against etcd, defaults to the host of the endpoint
+	SNI string `yaml:"sni"`
+	// Verify the etcd server certificate, defaults to true
+	Verify *bool
+}
+
+// SkipVerify reports whether the etcd server certificate is accepted without verification
+func (t *TLS) SkipVerify() bool {
+	return t.Verify != nil && !*t.Verify
 }
 
 type Etcd struct {
@@ -35,6 +84,45 @@ type Etcd struct {
 	TLS      *TLS
 }
 
+// Target is the etcd of an APISIX cluster served by apisix-seed,
+// all targets share the subscriptions of discoverers
+type Target struct {
+	// Name identifies the target, e.g. the business unit owning the APISIX cluster
+	Name string
+	Etcd `yaml:",inline"`
+}
+
+type AdminAPI struct {
+	Host   string
+	Key    string
+	Prefix string
+	// Timeout of each request in seconds
+	Timeout int
+	// WatchInterval is the interval in seconds to list resources and find out the changes
+	WatchInterval int `yaml:"watch_interval"`
+}
+
+type Standalone struct {
+	// Source is the operator-authored file in the apisix.yaml format
+	Source string
+	// Output is the apisix.yaml read by APISIX in standalone mode
+	Output string
+	// WatchInterval is the interval in seconds to check the changes of the source file
+	WatchInterval int `yaml:"watch_interval"`
+}
+
+// APISIX describes the APISIX instances sharing the storage
+type APISIX struct {
+	// Version pins the layout of resources: auto, 2 or 3
+	Version string
+}
+
+// Server exposes the health and readiness endpoints of apisix-seed
+type Server struct {
+	// Address to listen on, e.g. 0.0.0.0:9190, the server is disabled when it is empty
+	Address string
+}
+
 type Log struct {
 	Level        string
 	Path         string
@@ -43,52 +131,317 @@ type Log struct {
 	RotationTime time.Duration `yaml:"rotation_time"`
 }
 
+// Protection guards the upstream nodes against suspicious updates from registries,
+// e.g. an empty service caused by a registry outage.
+type Protection struct {
+	// Empty refuses to write an empty node set
+	Empty bool
+	// MaxDropPercent refuses to write a node set which shrinks by more than this percentage,
+	// zero means no limit
+	MaxDropPercent int `yaml:"max_drop_percent"`
+}
+
+// Snapshot persists the last known good nodes of each service,
+// they are served when a registry is unreachable during startup
+type Snapshot struct {
+	Path string
+}
+
+// Reconcile periodically compares the nodes in etcd with the ones cached from registries and fixes the drift,
+// e.g. caused by missed watch events or manual edits
+type Reconcile struct {
+	// Interval in seconds between two reconciliations, zero disables it
+	Interval int
+}
+
+// Shutdown stops apisix-seed in order: the watch events are no longer accepted, the pending node updates are written,
+// the services are unsubscribed from registries and the storage is closed
+type Shutdown struct {
+	// GracePeriod in seconds to write the pending node updates, apisix-seed exits without waiting any longer
+	GracePeriod int `yaml:"grace_period"`
+}
+
+// policies to merge the weights of the nodes sharing the same host and port, see Nodes
+const (
+	NodesMergeMax   = "max"
+	NodesMergeSum   = "sum"
+	NodesMergeFirst = "first"
+)
+
+// formats of the nodes written to APISIX, see Nodes
+const (
+	// NodesFormatArray writes the nodes as an array of objects with host, port, weight and metadata
+	NodesFormatArray = "array"
+	// NodesFormatHash writes the nodes as a hash of "host:port" to weight, the metadata is dropped
+	NodesFormatHash = "hash"
+)
+
+// Nodes decides how the node sets from registries are normalized before they are written,
+// they are ordered by host and port so that the same set always produces the same value
+type Nodes struct {
+	// Merge is the policy to merge the weights of the nodes sharing the same host and port: max, sum or first
+	Merge string
+	// Format of the nodes written to APISIX: array or hash, overridden by `discovery_args.nodes_format`
+	Format string
+}
+
+// Resource is an APISIX resource directory under the etcd prefix watched by apisix-seed
+type Resource struct {
+	// Name is the directory under the etcd prefix, e.g. routes
+	Name string
+	// Type is the A6 type of the resource: routes, services, upstreams or stream_routes, defaults to Name
+	Type string
+	// Include and Exclude are regular expressions matched against the resource id,
+	// a resource is watched when it matches any include pattern (or there is none) and no exclude pattern
+	Include []string
+	Exclude []string
+}
+
+var (
+	resourceTypes    = []string{"routes", "services", "upstreams", "stream_routes"}
+	resourceNameExpr = regexp.MustCompile(`^[a-zA-Z0-9-_.]+$`)
+)
+
 type Config struct {
-	Etcd      Etcd
-	Log       Log
-	Discovery map[string]interface{}
+	Storage    string
+	Etcd       Etcd
+	Targets    []Target
+	AdminAPI   AdminAPI `yaml:"admin_api"`
+	Standalone Standalone
+	Log        Log
+	Server     Server
+	Protection Protection
+	Snapshot   Snapshot
+	Reconcile  Reconcile
+	Shutdown   Shutdown
+	Nodes      Nodes
+	WriteMode  string `yaml:"write_mode"`
+	APISIX     APISIX `yaml:"apisix"`
+	Resources  []Resource
+	Discovery  map[string]interface{}
 }
 
-func InitConf() {
-	if workDir := os.Getenv("APISIX_SEED_WORKDIR"); workDir != "" {
+// Path returns the path of the configuration file, set by the -c flag or under the work directory
+func Path() string {
+	if ConfigFile != "" {
+		return ConfigFile
+	}
+	if workDir := os.Getenv(envWorkDir); workDir != "" {
 		WorkDir = workDir
 	}
+	return WorkDir + "/conf/conf.yaml"
+}
 
-	filePath := WorkDir + "/conf/conf.yaml"
-	if configurationContent, err := ioutil.ReadFile(filePath); err != nil {
+func InitConf() {
+	s := loadFile()
+	s.restore()
+	settings.Store(s)
+}
+
+// loadFile reads the configuration file into new Settings, the loaded configuration is left untouched.
+// It panics when the file is invalid.
+func loadFile() *Settings {
+	filePath := Path()
+	configurationContent, err := ioutil.ReadFile(filePath)
+	if err != nil {
 		panic(fmt.Sprintf("fail to read configuration: %s", filePath))
-	} else {
-		config := Config{}
-		err := yaml.Unmarshal(configurationContent, &config)
-		if err != nil {
-			log.Printf("conf: %s, error: %v", configurationContent, err)
+	}
+	root, problems, ignored := parse(configurationContent)
+	if len(problems) > 0 {
+		msgs := make([]string, 0, len(problems))
+		for _, problem := range problems {
+			msgs = append(msgs, problem.String())
 		}
+		panic(fmt.Sprintf("invalid configuration %s:\n%s", filePath, strings.Join(msgs, "\n")))
+	}
 
-		for name, rawConfig := range config.Discovery {
-			builder, ok := DisBuilders[name]
-			if !ok {
-				panic(fmt.Sprintf("unkown discovery configuration: %s", name))
-			}
+	config := Config{}
+	if err = root.Decode(&config); err != nil {
+		panic(fmt.Sprintf("fail to load configuration %s: %s", filePath, err))
+	}
 
-			rawStr, _ := yaml.Marshal(rawConfig)
-			disConfig, err := builder(rawStr)
-			if err != nil {
-				panic(fmt.Sprintf("fail to load discovery configuration: %s", err))
-			}
+	s := &Settings{
+		WriteMode:     WriteModeRename,
+		Storage:       StorageEtcd,
+		APISIXVersion: APISIXVersionAuto,
+		Discovery:     make(map[string]interface{}),
+		IgnoredEnv:    ignored,
+	}
+	for name, rawConfig := range config.Discovery {
+		builder, ok := DisBuilders[name]
+		if !ok {
+			panic(fmt.Sprintf("unkown discovery configuration: %s", name))
+		}
 
-			DisConfigs[name] = disConfig
+		rawStr, _ := yaml.Marshal(rawConfig)
+		disConfig, err := builder(rawStr)
+		if err != nil {
+			panic(fmt.Sprintf("fail to load discovery configuration: %s", err))
 		}
 
-		initLogConfig(config.Log)
+		s.Discovery[name] = disConfig
+	}
+
+	s.Log = newLogConfig(config.Log)
+	s.Server = &Server{
+		Address: config.Server.Address,
+	}
+	s.Resources = newResourceConfigs(config.Resources)
+	s.Protection = newProtectionConfig(config.Protection)
+	s.Snapshot = &Snapshot{
+		Path: config.Snapshot.Path,
+	}
+	if config.Reconcile.Interval < 0 {
+		panic(fmt.Sprintf("invalid reconcile interval: %d", config.Reconcile.Interval))
+	}
+	s.Reconcile = &Reconcile{
+		Interval: config.Reconcile.Interval,
+	}
+	s.Shutdown = newShutdownConfig(config.Shutdown)
+	s.Nodes = newNodesConfig(config.Nodes)
+
+	switch config.WriteMode {
+	case "":
+	case WriteModeRename, WriteModeAnnotation:
+		s.WriteMode = config.WriteMode
+	default:
+		panic(fmt.Sprintf("unknown write_mode: %s", config.WriteMode))
+	}
+
+	switch config.APISIX.Version {
+	case "":
+	case APISIXVersionAuto, APISIXVersion2, APISIXVersion3:
+		s.APISIXVersion = config.APISIX.Version
+	default:
+		panic(fmt.Sprintf("unknown apisix.version: %s", config.APISIX.Version))
+	}
+
+	switch config.Storage {
+	case "", StorageEtcd:
+	case StorageAdminAPI:
+		s.Storage = config.Storage
+		s.AdminAPI = newAdminAPIConfig(config.AdminAPI)
+	case StorageStandalone:
+		s.Storage = config.Storage
+		s.Standalone = newStandaloneConfig(config.Standalone)
+	default:
+		panic(fmt.Sprintf("unknown storage: %s", config.Storage))
+	}
+
+	// the etcd prefix is still required to locate resources in other storages
+	if len(config.Etcd.Host) > 0 || s.Storage != StorageEtcd {
+		s.ETCD = newEtcdConfig(config.Etcd)
+	}
+	s.Targets = newTargetConfigs(config.Targets, s.Storage)
+	return s
+}
+
+// Settings is a copy of the loaded configuration, see Reload
+type Settings struct {
+	ETCD          *Etcd
+	Log           *Log
+	Protection    *Protection
+	Snapshot      *Snapshot
+	WriteMode     string
+	Resources     []*Resource
+	Storage       string
+	AdminAPI      *AdminAPI
+	Standalone    *Standalone
+	APISIXVersion string
+	Targets       []*Target
+	Server        *Server
+	Reconcile     *Reconcile
+	Shutdown      *Shutdown
+	Nodes         *Nodes
+	Discovery     map[string]interface{}
+	// IgnoredEnv are the APISIX_SEED_* environment variables matching no field, see applyEnv
+	IgnoredEnv []string
+}
+
+// settings is the loaded configuration, it is replaced as a whole, see Current
+var settings atomic.Value
+
+// Current returns the loaded configuration. Unlike the package variables, it is safe to call from any goroutine
+// while the configuration is reloaded.
+func Current() *Settings {
+	if s, ok := settings.Load().(*Settings); ok {
+		return s
+	}
+	return &Settings{
+		WriteMode:     WriteMode,
+		Storage:       Storage,
+		APISIXVersion: APISIXVersion,
+		Discovery:     DisConfigs,
+	}
+}
+
+// restore sets the package variables on startup
+func (s *Settings) restore() {
+	ETCDConfig = s.ETCD
+	LogConfig = s.Log
+	ProtectionConfig = s.Protection
+	SnapshotConfig = s.Snapshot
+	WriteMode = s.WriteMode
+	ResourceConfigs = s.Resources
+	Storage = s.Storage
+	AdminAPIConfig = s.AdminAPI
+	StandaloneConfig = s.Standalone
+	APISIXVersion = s.APISIXVersion
+	TargetConfigs = s.Targets
+	ServerConfig = s.Server
+	ReconcileConfig = s.Reconcile
+	ShutdownConfig = s.Shutdown
+	NodesConfig = s.Nodes
+	DisConfigs = s.Discovery
+}
 
-		if len(config.Etcd.Host) > 0 {
-			initEtcdConfig(config.Etcd)
+// Reload reads the configuration file again and applies the sections which can be changed at runtime:
+// log, protection, shutdown, nodes, resources and discovery. The other sections are kept and the changed ones are returned,
+// they take effect after a restart. The previous configuration is returned to find out the changes,
+// and it is kept as a whole when the file can not be loaded.
+//
+// The file is loaded into new Settings published at once, only the package variables of the reloadable sections
+// are set, so Reload must be called from the goroutine reading them, see Current for the others.
+func Reload() (old *Settings, ignored []string, err error) {
+	old = Current()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	cur := loadFile()
+	for _, section := range []struct {
+		name     string
+		old, cur interface{}
+	}{
+		{"storage", old.Storage, cur.Storage},
+		{"etcd", old.ETCD, cur.ETCD},
+		{"targets", old.Targets, cur.Targets},
+		{"admin_api", old.AdminAPI, cur.AdminAPI},
+		{"standalone", old.Standalone, cur.Standalone},
+		{"server", old.Server, cur.Server},
+		{"snapshot", old.Snapshot, cur.Snapshot},
+		{"reconcile", old.Reconcile, cur.Reconcile},
+		{"write_mode", old.WriteMode, cur.WriteMode},
+		{"apisix", old.APISIXVersion, cur.APISIXVersion},
+	} {
+		if !reflect.DeepEqual(section.old, section.cur) {
+			ignored = append(ignored, section.name)
 		}
 	}
+	// only the reloadable sections are taken from the file
+	kept := *old
+	kept.Log, kept.Protection, kept.Shutdown, kept.Nodes = cur.Log, cur.Protection, cur.Shutdown, cur.Nodes
+	kept.Resources, kept.Discovery, kept.IgnoredEnv = cur.Resources, cur.Discovery, cur.IgnoredEnv
+	settings.Store(&kept)
+
+	LogConfig, ProtectionConfig, ShutdownConfig, NodesConfig = kept.Log, kept.Protection, kept.Shutdown, kept.Nodes
+	ResourceConfigs, DisConfigs = kept.Resources, kept.Discovery
+	return old, ignored, nil
 }
 
-// initialize etcd config
-func initEtcdConfig(conf Etcd) {
+func newEtcdConfig(conf Etcd) *Etcd {
 	var host = []string{"127.0.0.1:2379"}
 	if len(conf.Host) > 0 {
 		host = conf.Host
@@ -99,25 +452,113 @@ func initEtcdConfig(conf Etcd) {
 		prefix = conf.Prefix
 	}
 
-	ETCDConfig = &Etcd{
+	tls := conf.TLS
+	if tls == nil {
+		// https endpoints are verified against the system roots without the tls section
+		for _, h := range host {
+			if strings.HasPrefix(h, "https://") {
+				tls = &TLS{}
+				break
+			}
+		}
+	}
+
+	return &Etcd{
 		Host:     host,
+		Timeout:  conf.Timeout,
 		User:     conf.User,
 		Password: conf.Password,
-		TLS:      conf.TLS,
+		TLS:      tls,
 		Prefix:   prefix,
 	}
 }
 
-func initLogConfig(conf Log) {
+func newTargetConfigs(targets []Target, storage string) []*Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	if storage != StorageEtcd {
+		panic("targets are only supported when storage is etcd")
+	}
+
+	configs := make([]*Target, 0, len(targets))
+	names := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		if !resourceNameExpr.MatchString(target.Name) {
+			panic(fmt.Sprintf("invalid target name: %q", target.Name))
+		}
+		if _, ok := names[target.Name]; ok {
+			panic(fmt.Sprintf("duplicate target: %s", target.Name))
+		}
+		names[target.Name] = struct{}{}
+		if len(target.Host) == 0 {
+			panic(fmt.Sprintf("targets[%s].host is required", target.Name))
+		}
+
+		configs = append(configs, &Target{
+			Name: target.Name,
+			Etcd: *newEtcdConfig(target.Etcd),
+		})
+	}
+	return configs
+}
+
+func newAdminAPIConfig(conf AdminAPI) *AdminAPI {
+	if conf.Host == "" {
+		panic("admin_api.host is required when storage is admin_api")
+	}
+
+	prefix := "/apisix/admin"
+	if len(conf.Prefix) > 0 {
+		prefix = conf.Prefix
+	}
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = 10
+	}
+	watchInterval := conf.WatchInterval
+	if watchInterval == 0 {
+		watchInterval = 5
+	}
+
+	return &AdminAPI{
+		Host:          strings.TrimSuffix(conf.Host, "/"),
+		Key:           conf.Key,
+		Prefix:        prefix,
+		Timeout:       timeout,
+		WatchInterval: watchInterval,
+	}
+}
+
+func newStandaloneConfig(conf Standalone) *Standalone {
+	if conf.Source == "" || conf.Output == "" {
+		panic("standalone.source and standalone.output are required when storage is standalone")
+	}
+	if conf.Source == conf.Output {
+		panic("standalone.source and standalone.output can not be the same file")
+	}
+
+	watchInterval := conf.WatchInterval
+	if watchInterval == 0 {
+		watchInterval = 1
+	}
+
+	return &Standalone{
+		Source:        conf.Source,
+		Output:        conf.Output,
+		WatchInterval: watchInterval,
+	}
+}
+
+func newLogConfig(conf Log) *Log {
 	level := conf.Level
 	if level == "" {
 		level = "warn"
 	}
 	if conf.Path == "" {
-		LogConfig = &Log{
+		return &Log{
 			Level: level,
 		}
-		return
 	}
 	maxAge := conf.MaxAge
 	if maxAge == 0 {
@@ -131,7 +572,7 @@ func initLogConfig(conf Log) {
 	if rotationTime == 0 {
 		rotationTime = time.Hour
 	}
-	LogConfig = &Log{
+	return &Log{
 		Level:        level,
 		Path:         conf.Path,
 		MaxAge:       maxAge,
@@ -139,3 +580,97 @@ func initLogConfig(conf Log) {
 		RotationTime: rotationTime,
 	}
 }
+
+func newShutdownConfig(conf Shutdown) *Shutdown {
+	if conf.GracePeriod < 0 {
+		panic(fmt.Sprintf("invalid shutdown grace_period: %d", conf.GracePeriod))
+	}
+	gracePeriod := conf.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = 10
+	}
+	return &Shutdown{
+		GracePeriod: gracePeriod,
+	}
+}
+
+func newNodesConfig(conf Nodes) *Nodes {
+	merge := conf.Merge
+	switch merge {
+	case "":
+		merge = NodesMergeMax
+	case NodesMergeMax, NodesMergeSum, NodesMergeFirst:
+	default:
+		panic(fmt.Sprintf("unknown nodes merge: %s", merge))
+	}
+	format := conf.Format
+	switch format {
+	case "":
+		format = NodesFormatArray
+	case NodesFormatArray, NodesFormatHash:
+	default:
+		panic(fmt.Sprintf("unknown nodes format: %s", format))
+	}
+	return &Nodes{
+		Merge:  merge,
+		Format: format,
+	}
+}
+
+func newProtectionConfig(conf Protection) *Protection {
+	if conf.MaxDropPercent < 0 || conf.MaxDropPercent > 100 {
+		panic(fmt.Sprintf("invalid protection max_drop_percent: %d", conf.MaxDropPercent))
+	}
+	return &Protection{
+		Empty:          conf.Empty,
+		MaxDropPercent: conf.MaxDropPercent,
+	}
+}
+
+func newResourceConfigs(resources []Resource) []*Resource {
+	if len(resources) == 0 {
+		for _, typ := range resourceTypes {
+			resources = append(resources, Resource{Name: typ})
+		}
+	}
+
+	configs := make([]*Resource, 0, len(resources))
+	names := make(map[string]struct{})
+	for _, res := range resources {
+		if !resourceNameExpr.MatchString(res.Name) {
+			panic(fmt.Sprintf("invalid resource name: %s", res.Name))
+		}
+		if _, ok := names[res.Name]; ok {
+			panic(fmt.Sprintf("duplicate resource: %s", res.Name))
+		}
+		names[res.Name] = struct{}{}
+
+		typ := res.Type
+		if typ == "" {
+			typ = res.Name
+		}
+		valid := false
+		for _, t := range resourceTypes {
+			valid = valid || typ == t
+		}
+		if !valid {
+			panic(fmt.Sprintf("unknown type %s of resource %s", typ, res.Name))
+		}
+
+		for _, patterns := range [][]string{res.Include, res.Exclude} {
+			for _, pattern := range patterns {
+				if _, err := regexp.Compile(pattern); err != nil {
+					panic(fmt.Sprintf("invalid pattern %s of resource %s: %s", pattern, res.Name, err))
+				}
+			}
+		}
+
+		configs = append(configs, &Resource{
+			Name:    res.Name,
+			Type:    typ,
+			Include: res.Include,
+			Exclude: res.Exclude,
+		})
+	}
+	return configs
+}
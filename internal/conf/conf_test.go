@@ -0,0 +1,110 @@
+package conf
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	ConfigFile = filepath.Join(t.TempDir(), "conf.yaml")
+	defer func() {
+		ConfigFile = ""
+	}()
+	write := func(content string) {
+		assert.Nil(t, ioutil.WriteFile(ConfigFile, []byte(content), 0644))
+	}
+
+	write(`etcd:
+  host:
+    - "http://127.0.0.1:2379"
+log:
+  level: warn
+resources:
+  - name: routes
+discovery:
+  zookeeper:
+    hosts:
+      - "127.0.0.1:2181"
+`)
+	InitConf()
+	zkConfig := DisConfigs["zookeeper"]
+
+	caseDesc := "reloadable sections"
+	write(`etcd:
+  host:
+    - "http://127.0.0.1:2379"
+log:
+  level: debug
+protection:
+  empty: true
+nodes:
+  merge: sum
+  format: hash
+resources:
+  - name: routes
+  - name: upstreams
+discovery:
+  zookeeper:
+    hosts:
+      - "127.0.0.1:2181"
+  nacos:
+    host:
+      - "http://127.0.0.1:8848"
+`)
+	old, ignored, err := Reload()
+	assert.Nil(t, err, caseDesc)
+	assert.Empty(t, ignored, caseDesc)
+	assert.Equal(t, "warn", old.Log.Level, caseDesc)
+	assert.Equal(t, "debug", LogConfig.Level, caseDesc)
+	assert.True(t, ProtectionConfig.Empty, caseDesc)
+	assert.Equal(t, NodesMergeMax, old.Nodes.Merge, caseDesc)
+	assert.Equal(t, NodesMergeSum, NodesConfig.Merge, caseDesc)
+	assert.Equal(t, NodesFormatArray, old.Nodes.Format, caseDesc)
+	assert.Equal(t, NodesFormatHash, NodesConfig.Format, caseDesc)
+	assert.Equal(t, NodesConfig, Current().Nodes, caseDesc)
+	assert.Len(t, old.Resources, 1, caseDesc)
+	assert.Len(t, ResourceConfigs, 2, caseDesc)
+	assert.Len(t, old.Discovery, 1, caseDesc)
+	assert.Len(t, DisConfigs, 2, caseDesc)
+	assert.Equal(t, zkConfig, DisConfigs["zookeeper"], caseDesc)
+
+	caseDesc = "sections requiring a restart"
+	write(`etcd:
+  host:
+    - "http://127.0.0.2:2379"
+write_mode: annotation
+log:
+  level: debug
+`)
+	_, ignored, err = Reload()
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, []string{"etcd", "write_mode"}, ignored, caseDesc)
+	assert.Equal(t, []string{"http://127.0.0.1:2379"}, ETCDConfig.Host, caseDesc)
+	assert.Equal(t, WriteModeRename, WriteMode, caseDesc)
+	assert.Equal(t, WriteModeRename, Current().WriteMode, caseDesc)
+	assert.Empty(t, DisConfigs, caseDesc)
+
+	caseDesc = "invalid file"
+	write("log:\n  level: loud\n")
+	_, _, err = Reload()
+	assert.NotNil(t, err, caseDesc)
+	assert.Equal(t, "debug", LogConfig.Level, caseDesc)
+	assert.Equal(t, "debug", Current().Log.Level, caseDesc)
+	assert.Equal(t, []string{"http://127.0.0.1:2379"}, ETCDConfig.Host, caseDesc)
+
+	caseDesc = "read while reloading"
+	write("etcd:\n  host:\n    - \"http://127.0.0.1:2379\"\nwrite_mode: annotation\n")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, WriteModeRename, Current().WriteMode, caseDesc)
+		}
+	}()
+	_, _, err = Reload()
+	assert.Nil(t, err, caseDesc)
+	<-done
+}
@@ -0,0 +1,305 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is the prefix of the environment variables overriding the fields of the configuration,
+	// e.g. APISIX_SEED_ETCD_PASSWORD overrides etcd.password
+	EnvPrefix = "APISIX_SEED_"
+
+	envWorkDir = EnvPrefix + "WORKDIR"
+)
+
+// envExpr matches ${NAME} and ${NAME:-default}, $${ escapes the interpolation
+var envExpr = regexp.MustCompile(`\$\$\{|\$\{([a-zA-Z_][a-zA-Z0-9_]*)(:-([^}]*))?\}`)
+
+// fieldSchema is the part of the configuration schema used to locate and type the overridden fields
+type fieldSchema struct {
+	typ        string
+	properties map[string]*fieldSchema
+	items      *fieldSchema
+}
+
+func configFields() *fieldSchema {
+	raw := fullSchema()
+	definitions, _ := raw["definitions"].(map[string]interface{})
+	return newFieldSchema(raw, definitions)
+}
+
+func newFieldSchema(raw map[string]interface{}, definitions map[string]interface{}) *fieldSchema {
+	field := &fieldSchema{}
+	field.merge(raw, definitions)
+	return field
+}
+
+func (f *fieldSchema) merge(raw map[string]interface{}, definitions map[string]interface{}) {
+	if ref, ok := raw["$ref"].(string); ok {
+		def, _ := definitions[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+		f.merge(def, definitions)
+	}
+	if all, ok := raw["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if obj, ok := sub.(map[string]interface{}); ok {
+				f.merge(obj, definitions)
+			}
+		}
+	}
+
+	if typ, ok := raw["type"].(string); ok {
+		f.typ = typ
+	}
+	if enum, ok := raw["enum"].([]interface{}); ok && f.typ == "" {
+		f.typ = "string"
+		for _, v := range enum {
+			if _, ok := v.(string); !ok {
+				f.typ = ""
+			}
+		}
+	}
+	if properties, ok := raw["properties"].(map[string]interface{}); ok {
+		if f.properties == nil {
+			f.properties = make(map[string]*fieldSchema, len(properties))
+		}
+		for key, value := range properties {
+			obj, _ := value.(map[string]interface{})
+			if prop, ok := f.properties[key]; ok {
+				prop.merge(obj, definitions)
+				continue
+			}
+			f.properties[key] = newFieldSchema(obj, definitions)
+		}
+	}
+	if items, ok := raw["items"].(map[string]interface{}); ok {
+		if f.items == nil {
+			f.items = &fieldSchema{}
+		}
+		f.items.merge(items, definitions)
+	}
+}
+
+// lookup finds the field path of the underscore-separated words of an environment variable,
+// the longest matching key wins, e.g. admin_api_key is admin_api.key
+func (f *fieldSchema) lookup(words []string) ([]string, *fieldSchema) {
+	if len(words) == 0 {
+		return nil, f
+	}
+	if f.items != nil {
+		if _, err := strconv.Atoi(words[0]); err != nil {
+			return nil, nil
+		}
+		path, leaf := f.items.lookup(words[1:])
+		if leaf == nil {
+			return nil, nil
+		}
+		return append([]string{words[0]}, path...), leaf
+	}
+	for i := len(words); i > 0; i-- {
+		prop, ok := f.properties[strings.Join(words[:i], "_")]
+		if !ok {
+			continue
+		}
+		if path, leaf := prop.lookup(words[i:]); leaf != nil {
+			return append([]string{strings.Join(words[:i], "_")}, path...), leaf
+		}
+	}
+	return nil, nil
+}
+
+// expandEnv replaces ${NAME} and ${NAME:-default} in the scalar values with the environment variables,
+// field is the schema of the node, nil when it is unknown
+func expandEnv(node *yaml.Node, field *fieldSchema, lookup func(string) (string, bool)) []*Problem {
+	problems := make([]*Problem, 0)
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return problems
+		}
+		node.Value = envExpr.ReplaceAllStringFunc(node.Value, func(s string) string {
+			if s == "$${" {
+				return "${"
+			}
+			match := envExpr.FindStringSubmatch(s)
+			value, ok := lookup(match[1])
+			if !ok && match[2] == "" {
+				problems = append(problems, &Problem{
+					Line:    node.Line,
+					Message: fmt.Sprintf("environment variable %s is not set", match[1]),
+				})
+			}
+			if (!ok || value == "") && match[2] != "" {
+				value = match[3]
+			}
+			return value
+		})
+		if node.Style == 0 {
+			node.Tag = "!!str"
+			if field != nil {
+				switch field.typ {
+				case "integer", "number", "boolean":
+					// resolve the type of a plain value again, e.g. timeout: ${ETCD_TIMEOUT} is an integer,
+					// the others are kept as strings, e.g. a numeric password
+					node.Tag = ""
+				}
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			var child *fieldSchema
+			if field != nil {
+				child = field.properties[node.Content[i].Value]
+			}
+			problems = append(problems, expandEnv(node.Content[i+1], child, lookup)...)
+		}
+	case yaml.SequenceNode:
+		var child *fieldSchema
+		if field != nil {
+			child = field.items
+		}
+		for _, item := range node.Content {
+			problems = append(problems, expandEnv(item, child, lookup)...)
+		}
+	default:
+		for _, child := range node.Content {
+			problems = append(problems, expandEnv(child, field, lookup)...)
+		}
+	}
+	return problems
+}
+
+// applyEnv overrides the fields of the configuration with the APISIX_SEED_* environment variables
+// in the form of NAME=VALUE. Lists are separated by commas or written in the flow style, e.g. [a, b].
+// The variables matching no field are returned as ignored, e.g. the ones added by Kubernetes service links
+// for a Service named apisix-seed.
+func applyEnv(root *yaml.Node, fields *fieldSchema, environ []string) ([]*Problem, []string) {
+	problems := make([]*Problem, 0)
+	ignored := make([]string, 0)
+	env := make([]string, 0)
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, EnvPrefix) && !strings.HasPrefix(kv, envWorkDir+"=") {
+			env = append(env, kv)
+		}
+	}
+	// a field is overridden before its following items, e.g. targets_0 before targets_1
+	sort.Strings(env)
+
+	for _, kv := range env {
+		name, value := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		words := strings.Split(strings.ToLower(strings.TrimPrefix(name, EnvPrefix)), "_")
+		path, field := fields.lookup(words)
+		if field == nil {
+			ignored = append(ignored, name)
+			continue
+		}
+		node, err := envValue(field, value)
+		if err == nil {
+			err = setNode(root, path, node)
+		}
+		if err != nil {
+			problems = append(problems, &Problem{Field: name, Message: err.Error()})
+		}
+	}
+	return problems, ignored
+}
+
+func envValue(field *fieldSchema, value string) (*yaml.Node, error) {
+	switch field.typ {
+	case "string":
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}, nil
+	case "array":
+		if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			for _, item := range strings.Split(value, ",") {
+				itemNode, err := envValue(field.items, strings.TrimSpace(item))
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, itemNode)
+			}
+			return node, nil
+		}
+	case "object":
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: value}, nil
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(value), doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}, nil
+	}
+	return doc.Content[0], nil
+}
+
+// setNode replaces the value at the path, the missing sections are created
+func setNode(root *yaml.Node, path []string, value *yaml.Node) error {
+	if root.Kind == 0 {
+		root.Kind = yaml.DocumentNode
+	}
+	if len(root.Content) == 0 || root.Content[0].Tag == "!!null" {
+		root.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+
+	node := root.Content[0]
+	for i, key := range path {
+		last := i == len(path)-1
+		switch node.Kind {
+		case yaml.MappingNode:
+			var next *yaml.Node
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == key {
+					if last || node.Content[j+1].Tag == "!!null" {
+						node.Content[j+1] = newContainer(path, i, value)
+					}
+					next = node.Content[j+1]
+					break
+				}
+			}
+			if next == nil {
+				next = newContainer(path, i, value)
+				node.Content = append(node.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, next)
+			}
+			node = next
+		case yaml.SequenceNode:
+			index, _ := strconv.Atoi(key)
+			switch {
+			case index < len(node.Content):
+				if last {
+					node.Content[index] = value
+				}
+			case index == len(node.Content):
+				node.Content = append(node.Content, newContainer(path, i, value))
+			default:
+				return fmt.Errorf("index %d is out of range of %s", index, strings.Join(path[:i], "."))
+			}
+			node = node.Content[index]
+		default:
+			return fmt.Errorf("%s is not a section", strings.Join(path[:i], "."))
+		}
+	}
+	return nil
+}
+
+// newContainer returns the value for the last key of the path, otherwise the section holding the next key
+func newContainer(path []string, i int, value *yaml.Node) *yaml.Node {
+	if i == len(path)-1 {
+		return value
+	}
+	if _, err := strconv.Atoi(path[i+1]); err == nil {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
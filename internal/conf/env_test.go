@@ -0,0 +1,170 @@
+package conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadEnv(t *testing.T) {
+	vars := map[string]string{
+		"ETCD_TIMEOUT":  "30",
+		"NACOS_ADDRESS": "http://nacos:8848",
+		"EMPTY":         "",
+		"PASSWORD":      "123456",
+		"TRUE":          "true",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		caseDesc string
+		content  string
+		environ  []string
+		want     string
+		problems []string
+		ignored  []string
+	}{
+		{
+			caseDesc: "interpolation",
+			content: `etcd:
+  timeout: ${ETCD_TIMEOUT}
+  user: "${ETCD_TIMEOUT}"
+  password: p$${ETCD_TIMEOUT}
+  prefix: ${EMPTY:-/apisix}
+discovery:
+  nacos:
+    host:
+      - ${NACOS_ADDRESS}
+      - ${NACOS_BACKUP:-http://backup:8848}
+`,
+			want: `etcd:
+    timeout: 30
+    user: "30"
+    password: p${ETCD_TIMEOUT}
+    prefix: /apisix
+discovery:
+    nacos:
+        host:
+            - http://nacos:8848
+            - http://backup:8848
+`,
+		},
+		{
+			caseDesc: "string fields are kept as strings",
+			content: `etcd:
+  user: ${TRUE}
+  password: ${PASSWORD}
+  tls:
+    verify: ${TRUE}
+`,
+			want: `etcd:
+    user: "true"
+    password: "123456"
+    tls:
+        verify: true
+`,
+		},
+		{
+			caseDesc: "unset variable",
+			content:  "etcd:\n  password: ${ETCD_PASSWORD}\n",
+			want:     "etcd:\n    password: \"\"\n",
+			problems: []string{"line 2: environment variable ETCD_PASSWORD is not set"},
+		},
+		{
+			caseDesc: "overrides",
+			content:  "etcd:\n  host:\n    - http://127.0.0.1:2379\n  password: secret\n",
+			environ: []string{
+				"PATH=/usr/bin",
+				"APISIX_SEED_WORKDIR=/usr/local/apisix-seed",
+				"APISIX_SEED_ETCD_PASSWORD=123456",
+				"APISIX_SEED_ETCD_HOST=http://etcd-0:2379, http://etcd-1:2379",
+				"APISIX_SEED_ADMIN_API_KEY=edd1c9f034335f136f87ad84b625c8f1",
+				"APISIX_SEED_PROTECTION_MAX_DROP_PERCENT=50",
+				"APISIX_SEED_DISCOVERY_NACOS_HOST=[http://nacos:8848]",
+				"APISIX_SEED_APISIX_VERSION=3",
+			},
+			want: `etcd:
+    host:
+        - http://etcd-0:2379
+        - http://etcd-1:2379
+    password: "123456"
+admin_api:
+    key: edd1c9f034335f136f87ad84b625c8f1
+apisix:
+    version: "3"
+discovery:
+    nacos:
+        host: ['http://nacos:8848']
+protection:
+    max_drop_percent: 50
+`,
+		},
+		{
+			caseDesc: "override items",
+			content:  "targets:\n  - name: bu-a\n    host:\n      - http://etcd-a:2379\n",
+			environ: []string{
+				"APISIX_SEED_TARGETS_0_PASSWORD=a",
+				"APISIX_SEED_TARGETS_1_NAME=bu-b",
+				"APISIX_SEED_TARGETS_1_HOST=http://etcd-b:2379",
+				"APISIX_SEED_TARGETS_3_NAME=bu-d",
+			},
+			want: `targets:
+    - name: bu-a
+      host:
+        - http://etcd-a:2379
+      password: a
+    - host:
+        - http://etcd-b:2379
+      name: bu-b
+`,
+			problems: []string{"APISIX_SEED_TARGETS_3_NAME: index 3 is out of range of targets"},
+		},
+		{
+			caseDesc: "empty file",
+			content:  "",
+			environ:  []string{"APISIX_SEED_SERVER_ADDRESS=0.0.0.0:9190"},
+			want:     "server:\n    address: 0.0.0.0:9190\n",
+		},
+		{
+			caseDesc: "unknown variables",
+			content:  "",
+			environ: []string{
+				"APISIX_SEED_SERVICE_HOST=10.96.0.10",
+				"APISIX_SEED_PORT=tcp://10.96.0.10:9190",
+				"APISIX_SEED_PORT_9190_TCP_ADDR=10.96.0.10",
+				"APISIX_SEED_ETCD_PASSWORD_FILE=/secret",
+			},
+			want: "null\n",
+			ignored: []string{
+				"APISIX_SEED_ETCD_PASSWORD_FILE",
+				"APISIX_SEED_PORT",
+				"APISIX_SEED_PORT_9190_TCP_ADDR",
+				"APISIX_SEED_SERVICE_HOST",
+			},
+		},
+	}
+	for _, tc := range tests {
+		root, problems, ignored := load([]byte(tc.content), lookup, tc.environ)
+		got := make([]string, 0, len(problems))
+		for _, problem := range problems {
+			got = append(got, problem.String())
+		}
+		if tc.problems == nil {
+			tc.problems = []string{}
+		}
+		assert.Equal(t, tc.problems, got, tc.caseDesc)
+		if tc.ignored == nil {
+			tc.ignored = []string{}
+		}
+		assert.Equal(t, tc.ignored, ignored, tc.caseDesc)
+
+		out, err := yaml.Marshal(root)
+		assert.Nil(t, err, tc.caseDesc)
+		assert.Equal(t, tc.want, string(out), tc.caseDesc)
+		assert.Empty(t, validate(root), tc.caseDesc)
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 func init() {
 	DisBuilders["nacos"] = nacosBuilder
+	DisSchemas["nacos"] = schema
 }
 
 const schema = `
@@ -0,0 +1,465 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// configSchema describes the whole configuration file, unknown keys are refused.
+// The discovery sections are added from the schemas of the registered discoverers, see fullSchema.
+const configSchema = `
+{
+  "definitions": {
+    "etcd": {
+      "type": "object",
+      "properties": {
+        "host": {
+          "type": "array",
+          "minItems": 1,
+          "items": {"type": "string", "minLength": 1}
+        },
+        "prefix": {"type": "string", "pattern": "^/[\\/a-zA-Z0-9-_.]*$"},
+        "timeout": {"type": "integer", "minimum": 0},
+        "user": {"type": "string"},
+        "password": {"type": "string"},
+        "tls": {
+          "type": "object",
+          "properties": {
+            "cert": {"type": "string"},
+            "key": {"type": "string"},
+            "ca_file": {"type": "string"},
+            "sni": {"type": "string"},
+            "verify": {"type": "boolean"}
+          },
+          "additionalProperties": false
+        }
+      }
+    },
+    "duration": {
+      "anyOf": [
+        {"type": "integer", "minimum": 0},
+        {"type": "string", "pattern": "^([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$"}
+      ]
+    },
+    "patterns": {
+      "type": "array",
+      "items": {"type": "string"}
+    }
+  },
+  "type": "object",
+  "properties": {
+    "storage": {"enum": ["etcd", "admin_api", "standalone"]},
+    "etcd": {
+      "allOf": [{"$ref": "#/definitions/etcd"}],
+      "properties": {
+        "host": {}, "prefix": {}, "timeout": {}, "user": {}, "password": {}, "tls": {}
+      },
+      "additionalProperties": false
+    },
+    "targets": {
+      "type": "array",
+      "items": {
+        "allOf": [{"$ref": "#/definitions/etcd"}],
+        "properties": {
+          "name": {"type": "string", "pattern": "^[a-zA-Z0-9-_.]+$"},
+          "host": {}, "prefix": {}, "timeout": {}, "user": {}, "password": {}, "tls": {}
+        },
+        "required": ["name", "host"],
+        "additionalProperties": false
+      }
+    },
+    "admin_api": {
+      "type": "object",
+      "properties": {
+        "host": {"type": "string", "pattern": "^https?://"},
+        "key": {"type": "string"},
+        "prefix": {"type": "string", "pattern": "^/[\\/a-zA-Z0-9-_.]*$"},
+        "timeout": {"type": "integer", "minimum": 0},
+        "watch_interval": {"type": "integer", "minimum": 0}
+      },
+      "additionalProperties": false
+    },
+    "standalone": {
+      "type": "object",
+      "properties": {
+        "source": {"type": "string", "minLength": 1},
+        "output": {"type": "string", "minLength": 1},
+        "watch_interval": {"type": "integer", "minimum": 0}
+      },
+      "additionalProperties": false
+    },
+    "log": {
+      "type": "object",
+      "properties": {
+        "level": {"type": "string", "pattern": "^(?i)(debug|info|warn|error|dpanic|panic|fatal)$"},
+        "path": {"type": "string"},
+        "maxage": {"$ref": "#/definitions/duration"},
+        "maxsize": {"type": "integer", "minimum": 0},
+        "rotation_time": {"$ref": "#/definitions/duration"}
+      },
+      "additionalProperties": false
+    },
+    "server": {
+      "type": "object",
+      "properties": {
+        "address": {"type": "string"}
+      },
+      "additionalProperties": false
+    },
+    "protection": {
+      "type": "object",
+      "properties": {
+        "empty": {"type": "boolean"},
+        "max_drop_percent": {"type": "integer", "minimum": 0, "maximum": 100}
+      },
+      "additionalProperties": false
+    },
+    "snapshot": {
+      "type": "object",
+      "properties": {
+        "path": {"type": "string"}
+      },
+      "additionalProperties": false
+    },
+    "reconcile": {
+      "type": "object",
+      "properties": {
+        "interval": {"type": "integer", "minimum": 0}
+      },
+      "additionalProperties": false
+    },
+    "shutdown": {
+      "type": "object",
+      "properties": {
+        "grace_period": {"type": "integer", "minimum": 0}
+      },
+      "additionalProperties": false
+    },
+    "nodes": {
+      "type": "object",
+      "properties": {
+        "merge": {"enum": ["max", "sum", "first"]},
+        "format": {"enum": ["array", "hash"]}
+      },
+      "additionalProperties": false
+    },
+    "write_mode": {"enum": ["rename", "annotation"]},
+    "apisix": {
+      "type": "object",
+      "properties": {
+        "version": {"enum": ["auto", "2", "3"]}
+      },
+      "additionalProperties": false
+    },
+    "resources": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "pattern": "^[a-zA-Z0-9-_.]+$"},
+          "type": {"enum": ["routes", "services", "upstreams", "stream_routes"]},
+          "include": {"$ref": "#/definitions/patterns"},
+          "exclude": {"$ref": "#/definitions/patterns"}
+        },
+        "required": ["name"],
+        "additionalProperties": false
+      }
+    },
+    "discovery": {
+      "type": "object",
+      "additionalProperties": false
+    }
+  },
+  "additionalProperties": false,
+  "allOf": [
+    {
+      "if": {"properties": {"storage": {"const": "admin_api"}}, "required": ["storage"]},
+      "then": {"required": ["admin_api"], "properties": {"admin_api": {"required": ["host"]}}}
+    },
+    {
+      "if": {"properties": {"storage": {"const": "standalone"}}, "required": ["storage"]},
+      "then": {"required": ["standalone"], "properties": {"standalone": {"required": ["source", "output"]}}}
+    },
+    {
+      "if": {"required": ["targets"], "properties": {"targets": {"minItems": 1}}},
+      "then": {"properties": {"storage": {"const": "etcd"}}}
+    }
+  ]
+}
+`
+
+// fullSchema returns the schema of the whole configuration file. The discovery sections are described by
+// the schemas of the discoverers registered in DisBuilders, see DisSchemas, so that they are never out of sync.
+func fullSchema() map[string]interface{} {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(configSchema), &raw); err != nil {
+		panic(fmt.Sprintf("parse schema failed: %s", err))
+	}
+
+	discoveries := make(map[string]interface{}, len(DisBuilders))
+	for name := range DisBuilders {
+		var disSchema map[string]interface{}
+		if err := json.Unmarshal([]byte(DisSchemas[name]), &disSchema); err != nil {
+			// the configuration is checked by the builder only
+			disSchema = map[string]interface{}{}
+		}
+		discoveries[name] = lowerProperties(disSchema)
+	}
+	properties := raw["properties"].(map[string]interface{})
+	properties["discovery"].(map[string]interface{})["properties"] = discoveries
+	return raw
+}
+
+// lowerProperties renames the properties of a schema describing a decoded configuration to the keys in the file,
+// as yaml lowercases the field names, e.g. Host is host
+func lowerProperties(schema map[string]interface{}) map[string]interface{} {
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		lowered := make(map[string]interface{}, len(properties))
+		for key, value := range properties {
+			if obj, ok := value.(map[string]interface{}); ok {
+				value = lowerProperties(obj)
+			}
+			lowered[strings.ToLower(key)] = value
+		}
+		schema["properties"] = lowered
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		schema["items"] = lowerProperties(items)
+	}
+	if required, ok := schema["required"].([]interface{}); ok {
+		for i, key := range required {
+			if s, ok := key.(string); ok {
+				required[i] = strings.ToLower(s)
+			}
+		}
+	}
+	return schema
+}
+
+func configJSONSchema() *gojsonschema.Schema {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(fullSchema()))
+	if err != nil {
+		panic(fmt.Sprintf("new schema failed: %s", err))
+	}
+	return schema
+}
+
+// Problem is an error found in the configuration file
+type Problem struct {
+	// Line of the value in the file, zero when it is unknown
+	Line int
+	// Field is the path of the value, e.g. etcd.host.0
+	Field   string
+	Message string
+}
+
+func (p *Problem) String() string {
+	s := p.Message
+	if p.Field != "" {
+		s = p.Field + ": " + s
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	return s
+}
+
+// Validate checks the content of a configuration file against the schema of all sections,
+// and returns all problems ordered by line. The environment variables are applied like on startup.
+func Validate(content []byte) []*Problem {
+	_, problems, _ := parse(content)
+	return problems
+}
+
+// parse loads and validates the content of a configuration file, the ignored environment variables are returned,
+// see applyEnv
+func parse(content []byte) (*yaml.Node, []*Problem, []string) {
+	root, problems, ignored := load(content, os.LookupEnv, os.Environ())
+	if root == nil {
+		return nil, problems, ignored
+	}
+	problems = append(problems, validate(root)...)
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	return root, problems, ignored
+}
+
+// load parses the content of a configuration file, interpolates ${NAME} in the values
+// and applies the APISIX_SEED_* overrides
+func load(content []byte, lookup func(string) (string, bool), environ []string) (*yaml.Node, []*Problem, []string) {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(content, root); err != nil {
+		return nil, []*Problem{{Message: err.Error()}}, nil
+	}
+	fields := configFields()
+	problems := expandEnv(root, fields, lookup)
+	envProblems, ignored := applyEnv(root, fields, environ)
+	return root, append(problems, envProblems...), ignored
+}
+
+// validate checks the parsed configuration
+func validate(root *yaml.Node) []*Problem {
+	var doc interface{}
+	if err := root.Decode(&doc); err != nil {
+		return []*Problem{{Message: err.Error()}}
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	doc = dropNulls(doc)
+
+	ret, err := configJSONSchema().Validate(gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return []*Problem{{Message: fmt.Sprintf("validate failed: %s", err)}}
+	}
+
+	problems := make([]*Problem, 0)
+	for _, vErr := range ret.Errors() {
+		switch vErr.Type() {
+		case "condition_then", "condition_else", "number_all_of", "number_any_of":
+			// the failed subschemas are reported by their own errors
+			continue
+		}
+
+		field := vErr.Field()
+		if field == gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+			field = ""
+		}
+		if property, ok := vErr.Details()["property"].(string); ok && vErr.Type() == "additional_property_not_allowed" {
+			field = joinField(field, property)
+		}
+		problems = append(problems, &Problem{
+			Line:    findLine(root, field),
+			Field:   field,
+			Message: vErr.Description(),
+		})
+	}
+	return append(problems, validateSemantics(root, doc)...)
+}
+
+// validateSemantics checks the rules which can not be described by the schema
+func validateSemantics(root *yaml.Node, doc interface{}) []*Problem {
+	problems := make([]*Problem, 0)
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, &Problem{
+			Line:    findLine(root, field),
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	top, _ := doc.(map[string]interface{})
+	for _, section := range []string{"resources", "targets"} {
+		items, _ := top[section].([]interface{})
+		names := make(map[string]struct{}, len(items))
+		for i, item := range items {
+			obj, _ := item.(map[string]interface{})
+			name, ok := obj["name"].(string)
+			if !ok {
+				continue
+			}
+			if _, ok := names[name]; ok {
+				add(fmt.Sprintf("%s.%d.name", section, i), "duplicate name: %s", name)
+			}
+			names[name] = struct{}{}
+
+			for _, key := range []string{"include", "exclude"} {
+				patterns, _ := obj[key].([]interface{})
+				for j, pattern := range patterns {
+					s, ok := pattern.(string)
+					if !ok {
+						continue
+					}
+					if _, err := regexp.Compile(s); err != nil {
+						add(fmt.Sprintf("%s.%d.%s.%d", section, i, key, j), "invalid pattern: %s", err)
+					}
+				}
+			}
+		}
+	}
+
+	if top["write_mode"] == WriteModeAnnotation && top["storage"] == StorageAdminAPI {
+		// the upstream schema of APISIX requires either nodes or service_name with discovery_type
+		add("write_mode", "annotation can not be used with the admin_api storage, "+
+			"as the Admin API rejects an upstream with both nodes and service_name")
+	}
+
+	standalone, _ := top["standalone"].(map[string]interface{})
+	if source, ok := standalone["source"].(string); ok && source != "" && source == standalone["output"] {
+		add("standalone.output", "source and output can not be the same file")
+	}
+	return problems
+}
+
+// dropNulls removes the keys whose values are null, which means unset like in the Go structs
+func dropNulls(v interface{}) interface{} {
+	switch obj := v.(type) {
+	case map[string]interface{}:
+		for key, value := range obj {
+			if value == nil {
+				delete(obj, key)
+				continue
+			}
+			obj[key] = dropNulls(value)
+		}
+	case []interface{}:
+		for i := range obj {
+			obj[i] = dropNulls(obj[i])
+		}
+	}
+	return v
+}
+
+func joinField(field, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
+
+// findLine returns the line of the value at the field path, or of its closest existing parent
+func findLine(root *yaml.Node, field string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	if field == "" {
+		return line
+	}
+
+	for _, key := range strings.Split(field, ".") {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					// point at the key, the value of a nested section starts on the next line
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
@@ -0,0 +1,145 @@
+package conf
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		caseDesc string
+		content  string
+		want     []string
+	}{
+		{
+			caseDesc: "empty file",
+			content:  "",
+		},
+		{
+			caseDesc: "null values are unset",
+			content:  "etcd:\n  prefix: ~\n",
+		},
+		{
+			caseDesc: "unknown keys",
+			content:  "etcd:\n  hosts:\n    - http://127.0.0.1:2379\nlogs:\n  level: warn\n",
+			want: []string{
+				"line 2: etcd.hosts: Additional property hosts is not allowed",
+				"line 4: logs: Additional property logs is not allowed",
+			},
+		},
+		{
+			caseDesc: "invalid values",
+			content: `etcd:
+  host: http://127.0.0.1:2379
+  timeout: 30s
+log:
+  level: loud
+  maxage: 7d
+protection:
+  max_drop_percent: 120
+nodes:
+  merge: min
+discovery:
+  nacos:
+    host:
+      - "127.0.0.1:8848"
+`,
+			want: []string{
+				"line 2: etcd.host: Invalid type. Expected: array, given: string",
+				"line 3: etcd.timeout: Invalid type. Expected: integer, given: string",
+				"line 5: log.level: Does not match pattern '^(?i)(debug|info|warn|error|dpanic|panic|fatal)$'",
+				"line 6: log.maxage: Does not match pattern '^([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$'",
+				"line 8: protection.max_drop_percent: Must be less than or equal to 100",
+				"line 10: nodes.merge: nodes.merge must be one of the following: \"max\", \"sum\", \"first\"",
+				"line 14: discovery.nacos.host.0: Does not match pattern '^http(s)?:\\/\\/[a-zA-Z0-9-_.:]+$'",
+			},
+		},
+		{
+			caseDesc: "sections required by the storage",
+			content:  "storage: admin_api\nadmin_api:\n  key: edd1c9f034335f136f87ad84b625c8f1\n",
+			want:     []string{"line 2: admin_api: host is required"},
+		},
+		{
+			caseDesc: "semantic rules",
+			content: `storage: standalone
+standalone:
+  source: apisix.yaml
+  output: apisix.yaml
+resources:
+  - name: routes
+    include:
+      - "("
+  - name: routes
+`,
+			want: []string{
+				"line 4: standalone.output: source and output can not be the same file",
+				"line 8: resources.0.include.0: invalid pattern: error parsing regexp: missing closing ): `(`",
+				"line 9: resources.1.name: duplicate name: routes",
+			},
+		},
+		{
+			caseDesc: "annotation through the Admin API",
+			content:  "write_mode: annotation\nstorage: admin_api\nadmin_api:\n  host: http://127.0.0.1:9180\n",
+			want: []string{
+				"line 1: write_mode: annotation can not be used with the admin_api storage, " +
+					"as the Admin API rejects an upstream with both nodes and service_name",
+			},
+		},
+		{
+			caseDesc: "syntax error",
+			content:  "etcd:\n  host: [\n",
+			want:     []string{"yaml: line 2: did not find expected node content"},
+		},
+	}
+	for _, tc := range tests {
+		problems := Validate([]byte(tc.content))
+		got := make([]string, 0, len(problems))
+		for _, problem := range problems {
+			got = append(got, problem.String())
+		}
+		if tc.want == nil {
+			tc.want = []string{}
+		}
+		assert.Equal(t, tc.want, got, tc.caseDesc)
+	}
+}
+
+func TestValidateDiscovery(t *testing.T) {
+	DisBuilders["consul"] = func([]byte) (interface{}, error) { return nil, nil }
+	DisSchemas["consul"] = `{"type": "object", "properties": {"Address": {"type": "string"}}, "required": ["Address"]}`
+	defer func() {
+		delete(DisBuilders, "consul")
+		delete(DisSchemas, "consul")
+	}()
+
+	caseDesc := "registered discoverer"
+	assert.Empty(t, Validate([]byte("discovery:\n  consul:\n    address: 127.0.0.1:8500\n")), caseDesc)
+
+	caseDesc = "schema of the registered discoverer"
+	problems := Validate([]byte("discovery:\n  consul:\n    address: 8500\n"))
+	assert.Len(t, problems, 1, caseDesc)
+	assert.Equal(t, "line 3: discovery.consul.address: Invalid type. Expected: string, given: integer",
+		problems[0].String(), caseDesc)
+
+	caseDesc = "unknown discoverer"
+	problems = Validate([]byte("discovery:\n  eureka:\n    host: 127.0.0.1\n"))
+	assert.Len(t, problems, 1, caseDesc)
+	assert.Equal(t, "line 2: discovery.eureka: Additional property eureka is not allowed", problems[0].String(), caseDesc)
+}
+
+func TestValidateDefaultConf(t *testing.T) {
+	for _, path := range []string{"../../conf/conf.yaml", "../../ci/apisix-seed/conf.yaml"} {
+		content, err := ioutil.ReadFile(path)
+		assert.Nil(t, err, path)
+		assert.Empty(t, Validate(content), path)
+	}
+}
+
+func TestNewEtcdConfig(t *testing.T) {
+	etcd := newEtcdConfig(Etcd{Timeout: 30})
+	assert.Equal(t, 30, etcd.Timeout)
+	assert.Equal(t, []string{"127.0.0.1:2379"}, etcd.Host)
+	assert.Equal(t, "/apisix", etcd.Prefix)
+}
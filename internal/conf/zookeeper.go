@@ -7,6 +7,7 @@ import (
 
 func init() {
 	DisBuilders["zookeeper"] = zkBuilder
+	DisSchemas["zookeeper"] = zkConfSchema
 }
 
 const zkConfSchema = `
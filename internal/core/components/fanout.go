@@ -0,0 +1,99 @@
+package components
+
+import (
+	"context"
+	"sync"
+
+	"github.com/api7/gopkg/pkg/log"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/discoverer"
+)
+
+// Fanout shares the subscriptions of discoverers between the Rewriters of several targets,
+// each message is delivered to the Rewriter of the target its entity belongs to
+type Fanout struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	chs map[string]chan *message.Message
+
+	mutex sync.Mutex
+	// watches cancels the watch of each discoverer, see Attach
+	watches map[discoverer.Discoverer]context.CancelFunc
+}
+
+func NewFanout(targets []string) *Fanout {
+	f := &Fanout{
+		chs: make(map[string]chan *message.Message, len(targets)),
+	}
+	for _, target := range targets {
+		f.chs[target] = make(chan *message.Message, 1)
+	}
+	return f
+}
+
+// Source returns the messages of a target, it is used as the Source of the target's Rewriter
+func (f *Fanout) Source(target string) <-chan *message.Message {
+	return f.chs[target]
+}
+
+func (f *Fanout) Init() {
+	f.ctx, f.cancel = context.WithCancel(context.TODO())
+
+	// Watch for service updates from Discoverer
+	f.watches = make(map[discoverer.Discoverer]context.CancelFunc)
+	for _, dis := range discoverer.GetDiscoverers() {
+		f.Attach(dis)
+	}
+}
+
+// Attach watches a discoverer created after Init, e.g. when the configuration is reloaded
+func (f *Fanout) Attach(dis discoverer.Discoverer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(f.ctx)
+	f.watches[dis] = cancel
+	go f.watch(ctx, dis.Watch())
+}
+
+// Detach stops watching a discoverer before it is stopped
+func (f *Fanout) Detach(dis discoverer.Discoverer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if cancel, ok := f.watches[dis]; ok {
+		cancel()
+		delete(f.watches, dis)
+	}
+}
+
+func (f *Fanout) Close() {
+	log.Info("Fanout close")
+	f.cancel()
+
+	for _, dis := range discoverer.GetDiscoverers() {
+		dis.Stop()
+	}
+}
+
+func (f *Fanout) watch(ctx context.Context, ch chan *message.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-ch:
+			targetCh, ok := f.chs[msg.Target]
+			if !ok {
+				log.Errorf("unknown target %q of key: %s", msg.Target, msg.Key)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case targetCh <- msg:
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package components
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/discoverer"
+)
+
+func TestFanout(t *testing.T) {
+	discoverer.Discoveries = map[string]discoverer.NewDiscoverFunc{
+		"mock_fanout": discoverer.NewDiscovererMock,
+	}
+	_ = discoverer.InitDiscoverer("mock_fanout", nil)
+
+	watchCh := make(chan *message.Message, 1)
+	mDiscover := discoverer.GetDiscoverer("mock_fanout").(*discoverer.MockInterface)
+	mDiscover.On("Watch").Return(watchCh)
+
+	a6Str := `{"uri":"/hh","upstream":{"discovery_type":"mock_fanout","service_name":"APISIX-NACOS"}}`
+	newMsg := func(target string) *message.Message {
+		msg, err := message.NewMessage("/apisix/routes/1", []byte(a6Str), 1, message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		msg.Target = target
+		return msg
+	}
+
+	f := NewFanout([]string{"bu1", "bu2"})
+	f.Init()
+	defer f.cancel()
+
+	for _, target := range []string{"bu2", "bu1"} {
+		caseDesc := "deliver to " + target
+		watchCh <- newMsg(target)
+		select {
+		case msg := <-f.Source(target):
+			assert.Equal(t, target, msg.Target, caseDesc)
+		case <-time.After(time.Second):
+			assert.Fail(t, "timeout", caseDesc)
+		}
+	}
+
+	caseDesc := "drop the unknown target"
+	watchCh <- newMsg("bu3")
+	watchCh <- newMsg("bu1")
+	select {
+	case msg := <-f.Source("bu1"):
+		assert.Equal(t, "bu1", msg.Target, caseDesc)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timeout", caseDesc)
+	}
+	assert.Len(t, f.Source("bu2"), 0, caseDesc)
+
+	mDiscover.AssertCalled(t, "Watch")
+}
@@ -0,0 +1,162 @@
+package components
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/metrics"
+)
+
+// task is an entity to write, or a barrier passed when the tasks submitted before it are done
+type task struct {
+	msg     *message.Message
+	barrier *sync.WaitGroup
+	queued  time.Time
+}
+
+// queue is the unbounded queue of a worker
+type queue struct {
+	mutex sync.Mutex
+	tasks []*task
+	// tasks of the entities waiting by ID
+	pending map[string]*task
+	notify  chan struct{}
+}
+
+// pool writes different entities in parallel, while the updates of an entity are always written in order
+// by the same worker. An update replaces the one of the entity already waiting, as only the latest one
+// is to be written, so submitting never blocks the discoverers.
+type pool struct {
+	target string
+	handle func(*message.Message)
+	queues []*queue
+	wg     sync.WaitGroup
+}
+
+func newPool(target string, workers int, handle func(*message.Message)) *pool {
+	p := &pool{
+		target: target,
+		handle: handle,
+		queues: make([]*queue, workers),
+	}
+	for i := range p.queues {
+		p.queues[i] = &queue{
+			pending: make(map[string]*task),
+			notify:  make(chan struct{}, 1),
+		}
+	}
+	return p
+}
+
+// start runs the workers until ctx is done, the tasks left are dropped
+func (p *pool) start(ctx context.Context) {
+	p.wg.Add(len(p.queues))
+	for _, q := range p.queues {
+		go func(q *queue) {
+			defer p.wg.Done()
+			p.work(ctx, q)
+		}(q)
+	}
+}
+
+// wait waits until the workers are stopped
+func (p *pool) wait() {
+	p.wg.Wait()
+}
+
+// queueOf returns the queue of an entity, which is always the same
+func (p *pool) queueOf(id string) *queue {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+func (p *pool) submit(msg *message.Message) {
+	q := p.queueOf(msg.ID())
+
+	q.mutex.Lock()
+	if t, ok := q.pending[msg.ID()]; ok {
+		t.msg = msg
+		q.mutex.Unlock()
+		metrics.RewriterCoalesced.WithLabelValues(p.target).Inc()
+		return
+	}
+	t := &task{msg: msg, queued: time.Now()}
+	q.pending[msg.ID()] = t
+	q.tasks = append(q.tasks, t)
+	q.mutex.Unlock()
+
+	metrics.RewriterQueueDepth.WithLabelValues(p.target).Inc()
+	q.wake()
+}
+
+// barrier returns a channel closed when all tasks submitted before are done
+func (p *pool) barrier() <-chan struct{} {
+	wg := &sync.WaitGroup{}
+	wg.Add(len(p.queues))
+	for _, q := range p.queues {
+		q.mutex.Lock()
+		q.tasks = append(q.tasks, &task{barrier: wg})
+		q.mutex.Unlock()
+		q.wake()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func (p *pool) work(ctx context.Context, q *queue) {
+	for {
+		t := q.pop()
+		if t == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+				continue
+			}
+		}
+		if t.barrier != nil {
+			t.barrier.Done()
+			continue
+		}
+
+		metrics.RewriterQueueDepth.WithLabelValues(p.target).Dec()
+		metrics.RewriterQueueWait.WithLabelValues(p.target).Observe(time.Since(t.queued).Seconds())
+		if ctx.Err() != nil {
+			return
+		}
+		p.handle(t.msg)
+	}
+}
+
+// pop takes the first task, the entity is no longer pending so that its next update is queued behind
+func (q *queue) pop() *task {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.tasks) == 0 {
+		return nil
+	}
+	t := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	if t.msg != nil {
+		delete(q.pending, t.msg.ID())
+	}
+	return t
+}
+
+func (q *queue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,74 @@
+package components
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+)
+
+func TestPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	handled := make(map[string][]int64)
+	// the first entity blocks its worker until released
+	release := make(chan struct{})
+	p := newPool("", 2, func(msg *message.Message) {
+		if msg.Key == "/apisix/routes/slow" {
+			<-release
+		}
+		mutex.Lock()
+		handled[msg.Key] = append(handled[msg.Key], msg.Version)
+		mutex.Unlock()
+	})
+	p.start(ctx)
+
+	caseDesc := "write other entities while one is slow"
+	p.submit(&message.Message{Key: "/apisix/routes/slow", Version: 1})
+	var other string
+	for i := 0; other == ""; i++ {
+		key := "/apisix/routes/" + string(rune('a'+i))
+		// find an entity handled by the other worker
+		if p.queueOf(key) != p.queueOf("/apisix/routes/slow") {
+			other = key
+		}
+	}
+	p.submit(&message.Message{Key: other, Version: 1})
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(handled[other]) == 1
+	}, time.Second, 10*time.Millisecond, caseDesc)
+
+	caseDesc = "coalesce the waiting updates of an entity into the latest one"
+	// the slow entity is being written, so the next update waits behind it
+	time.Sleep(10 * time.Millisecond)
+	p.submit(&message.Message{Key: "/apisix/routes/slow", Version: 2})
+	p.submit(&message.Message{Key: "/apisix/routes/slow", Version: 3})
+	barrier := p.barrier()
+	select {
+	case <-barrier:
+		assert.Fail(t, "barrier passed before the slow entity is written", caseDesc)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	caseDesc = "pass the barrier when the entities submitted before are written"
+	select {
+	case <-barrier:
+	case <-time.After(time.Second):
+		assert.Fail(t, "timeout", caseDesc)
+	}
+	mutex.Lock()
+	assert.Equal(t, []int64{1, 3}, handled["/apisix/routes/slow"], caseDesc)
+	mutex.Unlock()
+
+	cancel()
+	p.wait()
+}
@@ -0,0 +1,170 @@
+package components
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/api7/gopkg/pkg/log"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/metrics"
+)
+
+// SuppressedUpdate records a node update refused by the Protector
+type SuppressedUpdate struct {
+	// Key is the ID of the entity, see message.ID
+	Key       string    `json:"key"`
+	Service   string    `json:"service"`
+	Reason    string    `json:"reason"`
+	Nodes     int       `json:"nodes"`
+	LastNodes int       `json:"last_nodes"`
+	Time      time.Time `json:"time"`
+}
+
+type lastNodes struct {
+	service string
+	nodes   interface{}
+}
+
+// Protector refuses to write an empty or drastically shrunk node set,
+// so that the last known good nodes are kept in etcd
+type Protector struct {
+	empty          bool
+	maxDropPercent int
+
+	mutex      sync.Mutex
+	last       map[string]*lastNodes
+	suppressed map[string]*SuppressedUpdate
+}
+
+func NewProtector(protection *conf.Protection) *Protector {
+	p := &Protector{
+		last:       make(map[string]*lastNodes),
+		suppressed: make(map[string]*SuppressedUpdate),
+	}
+	if protection != nil {
+		p.empty = protection.Empty
+		p.maxDropPercent = protection.MaxDropPercent
+	}
+	return p
+}
+
+// SetPolicy replaces the global policy, e.g. when the configuration is reloaded
+func (p *Protector) SetPolicy(protection *conf.Protection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.empty, p.maxDropPercent = false, 0
+	if protection != nil {
+		p.empty = protection.Empty
+		p.maxDropPercent = protection.MaxDropPercent
+	}
+}
+
+// policy merges the global policy with the one declared in the upstream
+func (p *Protector) policy(msg *message.Message) (bool, int) {
+	empty, maxDropPercent := p.empty, p.maxDropPercent
+	if override := msg.Protection(); override != nil {
+		if override.Empty != nil {
+			empty = *override.Empty
+		}
+		if override.MaxDropPercent != nil {
+			if percent := *override.MaxDropPercent; percent >= 0 && percent <= 100 {
+				maxDropPercent = percent
+			} else {
+				log.Warnf("ignore the invalid max_drop_percent %d of key[%s], it must be within [0, 100]", percent, msg.ID())
+			}
+		}
+	}
+	return empty, maxDropPercent
+}
+
+// Allow reports whether the nodes of msg can be written.
+// stored is the entity as it is stored, optional. When no nodes of the entity are known yet, e.g. after a restart,
+// the nodes written in stored are taken as the last ones, so that max_drop_percent still applies.
+// When the update is refused, the last known good nodes are injected back into msg.
+func (p *Protector) Allow(msg *message.Message, stored *message.Message) bool {
+	service := msg.DiscoveryType() + "/" + msg.ServiceName()
+	nodes := msg.Nodes()
+	count := message.NodesLen(nodes)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	last, ok := p.last[msg.ID()]
+	if ok && last.service != service {
+		// the entity has switched to another service, the old nodes are meaningless
+		ok = false
+	}
+	if !ok && stored != nil && stored.Written() && message.NodesLen(stored.Nodes()) > 0 {
+		last, ok = &lastNodes{
+			service: service,
+			nodes:   stored.Nodes(),
+		}, true
+	}
+	lastCount := 0
+	if ok {
+		lastCount = message.NodesLen(last.nodes)
+	}
+
+	reason := ""
+	empty, maxDropPercent := p.policy(msg)
+	if empty && count == 0 {
+		reason = "empty node set"
+	} else if maxDropPercent > 0 && lastCount > 0 && (lastCount-count)*100 > maxDropPercent*lastCount {
+		reason = "node set shrinks too much"
+	}
+
+	if reason == "" {
+		p.last[msg.ID()] = &lastNodes{
+			service: service,
+			nodes:   nodes,
+		}
+		delete(p.suppressed, msg.ID())
+		metrics.SuppressedUpdates.Set(float64(len(p.suppressed)))
+		return true
+	}
+
+	log.Warnf("suppress the nodes update of key[%s], service: %s, reason: %s, nodes: %d, last nodes: %d",
+		msg.ID(), service, reason, count, lastCount)
+	p.suppressed[msg.ID()] = &SuppressedUpdate{
+		Key:       msg.ID(),
+		Service:   service,
+		Reason:    reason,
+		Nodes:     count,
+		LastNodes: lastCount,
+		Time:      time.Now(),
+	}
+	metrics.SuppressedUpdates.Set(float64(len(p.suppressed)))
+	if ok {
+		msg.InjectNodes(last.nodes)
+	}
+	return false
+}
+
+// Forget drops the state of an entity which no longer uses service discovery
+func (p *Protector) Forget(id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.last, id)
+	delete(p.suppressed, id)
+	metrics.SuppressedUpdates.Set(float64(len(p.suppressed)))
+}
+
+// Suppressed returns the updates which are currently suppressed ordered by key
+func (p *Protector) Suppressed() []SuppressedUpdate {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	updates := make([]SuppressedUpdate, 0, len(p.suppressed))
+	for _, update := range p.suppressed {
+		updates = append(updates, *update)
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Key < updates[j].Key
+	})
+	return updates
+}
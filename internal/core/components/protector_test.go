@@ -0,0 +1,97 @@
+package components
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/metrics"
+)
+
+func newProtectorMsg(t *testing.T, a6Str string, nodes []*message.Node) *message.Message {
+	msg, err := message.NewMessage("/apisix/routes/1", []byte(a6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	msg.InjectNodes(nodes)
+	return msg
+}
+
+func TestProtector(t *testing.T) {
+	a6Str := `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS"}}`
+	overrideA6Str := `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS",
+"discovery_args":{"protection":{"empty":false,"max_drop_percent":100}}}}`
+	nodes := []*message.Node{
+		{Host: "1.1.1.1", Port: 80, Weight: 1},
+		{Host: "1.1.1.2", Port: 80, Weight: 1},
+		{Host: "1.1.1.3", Port: 80, Weight: 1},
+		{Host: "1.1.1.4", Port: 80, Weight: 1},
+	}
+
+	p := NewProtector(&conf.Protection{Empty: true, MaxDropPercent: 50})
+
+	caseDesc := "first nodes"
+	assert.True(t, p.Allow(newProtectorMsg(t, a6Str, nodes), nil), caseDesc)
+
+	caseDesc = "drop within the limit"
+	assert.True(t, p.Allow(newProtectorMsg(t, a6Str, nodes[:2]), nil), caseDesc)
+
+	caseDesc = "empty nodes"
+	msg := newProtectorMsg(t, a6Str, nodes[:0])
+	assert.False(t, p.Allow(msg, nil), caseDesc)
+	assert.Equal(t, 2, message.NodesLen(msg.Nodes()), caseDesc)
+	suppressed := p.Suppressed()
+	assert.Len(t, suppressed, 1, caseDesc)
+	assert.Equal(t, "empty node set", suppressed[0].Reason, caseDesc)
+
+	caseDesc = "shrink too much"
+	assert.True(t, p.Allow(newProtectorMsg(t, a6Str, nodes), nil), caseDesc)
+	assert.Len(t, p.Suppressed(), 0, caseDesc)
+	msg = newProtectorMsg(t, a6Str, nodes[:1])
+	assert.False(t, p.Allow(msg, nil), caseDesc)
+	assert.Equal(t, 4, message.NodesLen(msg.Nodes()), caseDesc)
+
+	caseDesc = "upstream overrides the global policy"
+	assert.True(t, p.Allow(newProtectorMsg(t, overrideA6Str, nodes[:1]), nil), caseDesc)
+	assert.True(t, p.Allow(newProtectorMsg(t, overrideA6Str, nodes[:0]), nil), caseDesc)
+
+	caseDesc = "forget the entity"
+	p.Forget("/apisix/routes/1")
+	assert.False(t, p.Allow(newProtectorMsg(t, a6Str, nodes[:0]), nil), caseDesc)
+	assert.Len(t, p.Suppressed(), 1, caseDesc)
+
+	caseDesc = "seed the last nodes from the stored entity"
+	p = NewProtector(&conf.Protection{MaxDropPercent: 50})
+	rendered, err := newProtectorMsg(t, a6Str, nil).WithNodes(nodes)
+	assert.Nil(t, err, caseDesc)
+	value, err := rendered.Marshal()
+	assert.Nil(t, err, caseDesc)
+	stored, err := message.NewMessage("/apisix/routes/1", value, 2, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err, caseDesc)
+	assert.True(t, stored.Written(), caseDesc)
+	msg = newProtectorMsg(t, a6Str, nodes[:1])
+	assert.False(t, p.Allow(msg, stored), caseDesc)
+	assert.Equal(t, 4, message.NodesLen(msg.Nodes()), caseDesc)
+
+	caseDesc = "nothing to seed from an entity not written yet"
+	p = NewProtector(&conf.Protection{MaxDropPercent: 50})
+	assert.True(t, p.Allow(newProtectorMsg(t, a6Str, nodes[:1]), newProtectorMsg(t, a6Str, nodes)), caseDesc)
+
+	caseDesc = "ignore the invalid override"
+	invalidA6Str := `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS",
+"discovery_args":{"protection":{"max_drop_percent":120}}}}`
+	p = NewProtector(&conf.Protection{MaxDropPercent: 50})
+	assert.True(t, p.Allow(newProtectorMsg(t, invalidA6Str, nodes), nil), caseDesc)
+	assert.False(t, p.Allow(newProtectorMsg(t, invalidA6Str, nodes[:1]), nil), caseDesc)
+
+	caseDesc = "expose the suppressed updates"
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.SuppressedUpdates), caseDesc)
+	dump, err := json.Marshal(p.Suppressed())
+	assert.Nil(t, err, caseDesc)
+	assert.Contains(t, string(dump), `"key":"/apisix/routes/1","service":"nacos/APISIX-NACOS",`+
+		`"reason":"node set shrinks too much","nodes":1,"last_nodes":4`, caseDesc)
+	p.Forget("/apisix/routes/1")
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.SuppressedUpdates), caseDesc)
+}
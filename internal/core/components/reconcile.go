@@ -0,0 +1,180 @@
+package components
+
+import (
+	"time"
+
+	"github.com/api7/gopkg/pkg/log"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/core/storer"
+	"github.com/api7/apisix-seed/internal/discoverer"
+	"github.com/api7/apisix-seed/internal/metrics"
+)
+
+// kinds of the fixes made by the reconciliation
+const (
+	fixMissedAdd    = "missed_add"
+	fixMissedUpdate = "missed_update"
+	fixMissedDelete = "missed_delete"
+	fixDrift        = "drift"
+)
+
+func (w *Watcher) reconcileLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		log.Info("Watcher starts reconciliation")
+		w.Reconcile()
+	}
+}
+
+// Reconcile re-lists the entities of all stores and fixes what the watch events have missed:
+// entities added, updated or deleted without an event, and nodes in the storage which drift
+// from the ones cached by discoverers, e.g. after a manual edit or a lost compare-and-swap.
+func (w *Watcher) Reconcile() {
+	for _, s := range storer.GetStores() {
+		if err := w.reconcile(s); err != nil {
+			log.Errorf("reconcile %s failed: %s", s.Name(), err)
+		}
+	}
+	w.retryDegraded()
+}
+
+func (w *Watcher) reconcile(s *storer.GenericStore) error {
+	// the entities cached before listing, the ones changed by the watch afterwards are left to it
+	cached := make(map[string]*message.Message)
+	s.Range(func(key, obj interface{}) bool {
+		cached[key.(string)] = obj.(*message.Message)
+		return true
+	})
+	w.mutex.Lock()
+	references := make(map[string]*reference, len(w.references))
+	for id, ref := range w.references {
+		if ref.s == s {
+			references[id] = ref
+		}
+	}
+	w.mutex.Unlock()
+	// list before dumping the discoverers, so that the nodes changed in between are not reverted
+	msgs, err := s.Fetch(nil)
+	if err != nil {
+		return err
+	}
+	nodes := cachedNodes()
+
+	listed := make(map[string]struct{}, len(msgs))
+	for _, msg := range msgs {
+		listed[msg.Key] = struct{}{}
+		w.resolve(msg)
+
+		before, wasCached := cached[msg.Key]
+		obj, ok := s.Load(msg.Key)
+		if !ok {
+			if !wasCached && message.ServiceFilter(msg) {
+				log.Warnf("reconciliation finds the entity %s missed by the watch", msg.Key)
+				w.fix(msg, s, fixMissedAdd)
+			}
+			continue
+		}
+		if obj.(*message.Message) != before {
+			// changed by the watch since the listing
+			continue
+		}
+		if msg.Version != before.Version {
+			if msg.Version > before.Version {
+				log.Warnf("reconciliation finds the update of entity %s missed by the watch, version: %d",
+					msg.Key, msg.Version)
+				w.fix(msg, s, fixMissedUpdate)
+			}
+			continue
+		}
+		if !message.ServiceFilter(msg) {
+			continue
+		}
+
+		expected, ok := nodes[msg.ID()]
+		if !ok {
+			continue
+		}
+		// compared like the Rewriter does, so that the nodes stored in another order are not a drift
+		expected = message.NormalizeNodes(expected)
+		if msg.NodesWritten(expected, message.HashNodes(expected)) {
+			continue
+		}
+		rewriter := w.rewriterOf(msg.Target)
+		if rewriter == nil {
+			log.Warnf("no rewriter of target %q to fix the drifted nodes of entity %s", msg.Target, msg.Key)
+			continue
+		}
+		log.Warnf("reconciliation rewrites the drifted nodes of entity %s", msg.Key)
+		metrics.ReconcileFixes.WithLabelValues(fixDrift).Inc()
+		// written by the worker of the entity, in order with the updates of discoverers
+		msg.InjectNodes(expected)
+		rewriter.Submit(msg)
+	}
+
+	s.Range(func(key, obj interface{}) bool {
+		if _, ok := listed[key.(string)]; ok {
+			return true
+		}
+		msg := obj.(*message.Message)
+		if cached[msg.Key] != msg {
+			// added or changed by the watch since the listing
+			return true
+		}
+		log.Warnf("reconciliation finds the deletion of entity %s missed by the watch", msg.Key)
+		metrics.ReconcileFixes.WithLabelValues(fixMissedDelete).Inc()
+		w.unrefer(msg.ID())
+		w.follow(msg, s, func() { w.delete(msg, s) })
+		return true
+	})
+
+	// the stream routes left without service discovery are not cached
+	w.mutex.Lock()
+	for id, ref := range references {
+		if _, ok := listed[ref.msg.Key]; !ok && w.references[id] == ref {
+			delete(w.references, id)
+		}
+	}
+	w.mutex.Unlock()
+	return nil
+}
+
+// rewriterOf returns the Rewriter of an etcd target, nil if there is none
+func (w *Watcher) rewriterOf(target string) *Rewriter {
+	for _, r := range w.Rewriters {
+		if r.Target == target {
+			return r
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) fix(msg *message.Message, s *storer.GenericStore, kind string) {
+	metrics.ReconcileFixes.WithLabelValues(kind).Inc()
+	w.follow(msg, s, func() { w.update(msg, s) })
+}
+
+// cachedNodes returns the nodes cached by discoverers by entity ID,
+// the services whose nodes are stale or unknown are skipped
+func cachedNodes() map[string][]*message.Node {
+	nodes := make(map[string][]*message.Node)
+	for _, services := range discoverer.Dump() {
+		for _, service := range services {
+			if service.Status != discoverer.ServiceOK || service.Nodes == nil {
+				continue
+			}
+			for _, id := range service.Entities {
+				nodes[id] = service.Nodes
+			}
+		}
+	}
+	return nodes
+}
@@ -2,62 +2,240 @@ package components
 
 import (
 	"context"
+	"fmt"
 	"runtime"
+	"sync"
+	"sync/atomic"
 
 	"github.com/api7/gopkg/pkg/log"
 
 	"github.com/api7/apisix-seed/internal/core/message"
-
+	"github.com/api7/apisix-seed/internal/core/registry"
 	"github.com/api7/apisix-seed/internal/core/storer"
 	"github.com/api7/apisix-seed/internal/discoverer"
+	"github.com/api7/apisix-seed/internal/metrics"
 )
 
 type Rewriter struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	// Limit the number of simultaneously update
-	sem chan struct{}
+	// pool writes the entities, see pool
+	pool *pool
 
 	Prefix string
+	// Target is the etcd target whose stores are updated, empty for the default one
+	Target string
+	// Source delivers the messages of the target when the discoverers are shared through a Fanout,
+	// the Rewriter watches all discoverers by itself when it is nil
+	Source <-chan *message.Message
+	// Protector guards etcd against suspicious node sets, optional
+	Protector *Protector
+	// Workers is the number of entities written simultaneously, GOMAXPROCS+10 by default
+	Workers int
+
+	// markers are sent behind the pending messages by Flush, see Flush
+	markers sync.Map
+
+	mutex sync.Mutex
+	// watches cancels the watch of each discoverer, see Attach
+	watches map[discoverer.Discoverer]context.CancelFunc
+	// number of failed updates since the last Flush
+	failures int64
 }
 
 func (r *Rewriter) Init() {
 	r.ctx, r.cancel = context.WithCancel(context.TODO())
-	// the number of semaphore is referenced to https://github.com/golang/go/blob/go1.17.1/src/cmd/compile/internal/noder/noder.go#L38
-	r.sem = make(chan struct{}, runtime.GOMAXPROCS(0)+10)
+	if r.Workers <= 0 {
+		// the number of workers is referenced to https://github.com/golang/go/blob/go1.17.1/src/cmd/compile/internal/noder/noder.go#L38
+		r.Workers = runtime.GOMAXPROCS(0) + 10
+	}
+	if r.Protector == nil {
+		r.Protector = NewProtector(nil)
+	}
+	r.pool = newPool(r.Target, r.Workers, r.rewrite)
+	r.pool.start(r.ctx)
+
+	if r.Source != nil {
+		go r.watch(r.ctx, r.Source)
+		return
+	}
 
 	// Watch for service updates from Discoverer
+	r.watches = make(map[discoverer.Discoverer]context.CancelFunc)
 	for _, dis := range discoverer.GetDiscoverers() {
-		msgCh := dis.Watch()
-		go r.watch(msgCh)
+		r.Attach(dis)
+	}
+}
+
+// Attach watches a discoverer created after Init, e.g. when the configuration is reloaded.
+// It does nothing when the messages are delivered through Source.
+func (r *Rewriter) Attach(dis discoverer.Discoverer) {
+	if r.Source != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.watches[dis] = cancel
+	go r.watch(ctx, dis.Watch())
+}
+
+// Detach stops watching a discoverer before it is stopped
+func (r *Rewriter) Detach(dis discoverer.Discoverer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if cancel, ok := r.watches[dis]; ok {
+		cancel()
+		delete(r.watches, dis)
 	}
 }
 
 func (r *Rewriter) Close() {
 	log.Info("Rewriter close")
 	r.cancel()
+	// the entities being written give up as the context is cancelled
+	r.pool.wait()
 
+	// the shared discoverers are stopped by the Fanout
+	if r.Source != nil {
+		return
+	}
 	for _, dis := range discoverer.GetDiscoverers() {
 		dis.Stop()
 	}
 }
 
-func (r *Rewriter) watch(ch chan *message.Message) {
-	for {
+// Flush waits until the messages already sent by discoverers are written,
+// and reports the updates failed since the last Flush.
+// A marker is sent behind the pending messages of each discoverer, and acknowledged when the entities
+// submitted to the workers before it are written, as the messages of a discoverer are received in order.
+// It gives up when ctx is done, e.g. when the grace period of the shutdown is over.
+func (r *Rewriter) Flush(ctx context.Context) error {
+	for _, dis := range discoverer.GetDiscoverers() {
+		marker := &message.Message{Target: r.Target}
+		done := make(chan struct{})
+		r.markers.Store(marker, done)
+
 		select {
 		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-ctx.Done():
+			r.markers.Delete(marker)
+			return ctx.Err()
+		case dis.Watch() <- marker:
+		}
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+		}
+	}
+
+	if failures := atomic.SwapInt64(&r.failures, 0); failures > 0 {
+		return fmt.Errorf("%d updates failed", failures)
+	}
+	return nil
+}
+
+// Submit queues an entity to write with the nodes of its service, e.g. when its nodes drift in etcd
+func (r *Rewriter) Submit(msg *message.Message) {
+	r.pool.submit(msg)
+}
+
+// watch submits the entities notified by discoverers to the workers, it never blocks on writing
+func (r *Rewriter) watch(ctx context.Context, ch <-chan *message.Message) {
+	for {
+		select {
+		case <-ctx.Done():
 			return
 		case msg := <-ch:
-			// hand watcher notify message
-			_, entity, _ := storer.FromatKey(msg.Key, r.Prefix)
-			if entity == "" {
-				log.Errorf("key format Invaild: %s", msg.Key)
-				return
-			}
-			if err := storer.GetStore(entity).UpdateNodes(r.ctx, msg); err != nil {
-				log.Errorf("update nodes failed: %s", err)
+			if done, ok := r.markers.LoadAndDelete(msg); ok {
+				barrier := r.pool.barrier()
+				go func() {
+					select {
+					case <-r.ctx.Done():
+					case <-barrier:
+						close(done.(chan struct{}))
+					}
+				}()
+				continue
 			}
+			r.pool.submit(msg)
+		}
+	}
+}
+
+// resolve returns the latest form of the entity with the nodes of its service. The entities are rendered from
+// the registry, as the message is shared, except the ones of the discoverers not publishing to it,
+// which are written with the nodes injected into the message, see discoverer.RegistryPublisher.
+func (r *Rewriter) resolve(msg *message.Message) (*message.Message, *registry.Snapshot, bool) {
+	if !discoverer.InjectsNodes(msg.DiscoveryType()) {
+		latest, snapshot, ok := registry.Entity(msg.ID())
+		if !ok {
+			log.Infof("entity %s is no longer bound to a service", msg.ID())
 		}
+		return latest, snapshot, ok
+	}
+
+	nodes, err := message.ParseNodes(msg.Nodes())
+	if err != nil || nodes == nil {
+		log.Warnf("entity %s is sent by discoverer %s without nodes", msg.ID(), msg.DiscoveryType())
+		return nil, nil, false
+	}
+	latest, err := msg.Clone()
+	if err != nil {
+		atomic.AddInt64(&r.failures, 1)
+		log.Errorf("render %s failed: %s", msg.Key, err)
+		return nil, nil, false
+	}
+	nodes = message.NormalizeNodes(nodes)
+	return latest, &registry.Snapshot{
+		Service: discoverer.ServiceID(msg),
+		Nodes:   nodes,
+		Hash:    message.HashNodes(nodes),
+	}, true
+}
+
+// rewrite writes the latest form of the entity with the nodes of its service
+func (r *Rewriter) rewrite(msg *message.Message) {
+	// hand watcher notify message
+	_, entity, _ := storer.FromatKey(msg.Key, r.Prefix)
+	if entity == "" {
+		log.Errorf("key format Invaild: %s", msg.Key)
+		return
+	}
+	latest, snapshot, ok := r.resolve(msg)
+	if !ok {
+		return
+	}
+	if latest.Written() && latest.NodesWritten(snapshot.Nodes, snapshot.Hash) {
+		// the same nodes are already written, e.g. the registry pushes the nodes in another order
+		metrics.Rewrites.WithLabelValues(metrics.ResultSkipped).Inc()
+		return
+	}
+	msg, err := latest.WithNodes(snapshot.Nodes)
+	if err != nil {
+		atomic.AddInt64(&r.failures, 1)
+		log.Errorf("render %s failed: %s", latest.Key, err)
+		return
+	}
+	// latest still holds the nodes stored in etcd
+	if !r.Protector.Allow(msg, latest) {
+		return
+	}
+	s, ok := storer.LookupTargetStore(r.Target, entity)
+	if !ok {
+		// the resource is no longer watched since the configuration is reloaded
+		log.Warnf("no store of key: %s", msg.Key)
+		return
+	}
+	if err = s.UpdateNodes(r.ctx, msg); err != nil {
+		atomic.AddInt64(&r.failures, 1)
+		log.Errorf("update nodes failed: %s", err)
 	}
 }
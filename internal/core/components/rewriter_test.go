@@ -1,11 +1,13 @@
 package components
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/api7/apisix-seed/internal/core/message"
-
+	"github.com/api7/apisix-seed/internal/core/registry"
 	"github.com/api7/apisix-seed/internal/core/storer"
 	"github.com/api7/apisix-seed/internal/discoverer"
 	"github.com/stretchr/testify/assert"
@@ -37,21 +39,21 @@ func TestRewriter(t *testing.T) {
 		}
 	}
 }`
-	givenNodes := &message.Node{
+	givenNodes := []*message.Node{{
 		Host:   "1.1.1.1",
 		Port:   8080,
 		Weight: 1,
-	}
+	}}
 
 	expectKey := "/prefix/mocks/1"
 	expectA6Str := `{
     "uri": "/nacosWithNamespaceId/*",
     "upstream": {
-        "nodes": {
+        "nodes": [{
             "host":"1.1.1.1",
             "port": 8080,
             "weight": 1
-        },
+        }],
         "_service_name": "APISIX-NACOS",
         "type": "roundrobin",
         "_discovery_type": "nacos",
@@ -64,7 +66,9 @@ func TestRewriter(t *testing.T) {
 	msg, err := message.NewMessage("/prefix/mocks/1", []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
 	assert.Nil(t, err, caseDesc)
 
-	msg.InjectNodes(givenNodes)
+	defer registry.Clear()
+	registry.Publish("nacos/@DEFAULT_GROUP@APISIX-NACOS", givenNodes)
+	registry.Bind("nacos/@DEFAULT_GROUP@APISIX-NACOS", msg)
 	watchCh <- msg
 
 	// mock rewrite
@@ -84,6 +88,127 @@ func TestRewriter(t *testing.T) {
 		Prefix: "/prefix",
 	}
 	rewriter.Init()
+	defer rewriter.cancel()
 
 	time.Sleep(time.Second)
 }
+
+// startRewriter starts a Rewriter writing the mocks store backed by mStg, and returns the channel of
+// a mock discoverer of type typ watched by it. The discoverers left by other tests send nothing.
+func startRewriter(t *testing.T, typ string, mStg *storer.MockInterface) (*Rewriter, chan *message.Message) {
+	discoverer.Discoveries = map[string]discoverer.NewDiscoverFunc{
+		typ: discoverer.NewDiscovererMock,
+	}
+	_ = discoverer.InitDiscoverer(typ, nil)
+	watchCh := make(chan *message.Message, 10)
+	discoverer.GetDiscoverer(typ).(*discoverer.MockInterface).On("Watch").Return(watchCh)
+	for _, d := range discoverer.GetDiscoverers() {
+		d.(*discoverer.MockInterface).On("Watch").Return(make(chan *message.Message, 1))
+	}
+
+	storer.ClrearStores()
+	assert.Nil(t, storer.InitStore("mocks", storer.GenericStoreOption{
+		BasePath: "/prefix/mocks",
+		Prefix:   "/prefix",
+	}, mStg))
+
+	rewriter := &Rewriter{
+		Prefix: "/prefix",
+	}
+	rewriter.Init()
+	return rewriter, watchCh
+}
+
+func TestRewriterFlush(t *testing.T) {
+	mStg := &storer.MockInterface{}
+	mStg.On("Update", "/prefix/mocks/1", mock.Anything, mock.Anything).Return(nil)
+	mStg.On("Update", "/prefix/mocks/2", mock.Anything, mock.Anything).Return(errors.New("etcd is unreachable"))
+	rewriter, watchCh := startRewriter(t, "mock_flush", mStg)
+	defer rewriter.cancel()
+
+	givenA6Str := `{"uri":"/hh","upstream":{"service_name":"APISIX-NACOS","discovery_type":"nacos"}}`
+	defer registry.Clear()
+	registry.Publish("nacos/@@APISIX-NACOS", []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}})
+	for _, key := range []string{"/prefix/mocks/1", "/prefix/mocks/2"} {
+		msg, err := message.NewMessage(key, []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		registry.Bind("nacos/@@APISIX-NACOS", msg)
+		watchCh <- msg
+	}
+
+	caseDesc := "pending messages are written"
+	assert.EqualError(t, rewriter.Flush(context.Background()), "1 updates failed", caseDesc)
+	mStg.AssertNumberOfCalls(t, "Update", 2)
+
+	caseDesc = "failures are reset"
+	assert.Nil(t, rewriter.Flush(context.Background()), caseDesc)
+
+	caseDesc = "give up when the grace period is over"
+	rewriter.Detach(discoverer.GetDiscoverer("mock_flush"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, rewriter.Flush(ctx), caseDesc)
+}
+
+func TestRewriterSkip(t *testing.T) {
+	mStg := &storer.MockInterface{}
+	mStg.On("Update", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	rewriter, watchCh := startRewriter(t, "mock_skip", mStg)
+	defer discoverer.RemoveDiscoverer("mock_skip")
+	defer rewriter.cancel()
+
+	// the entity is already written with the nodes in another order
+	givenA6Str := `{"uri":"/hh","upstream":{"_service_name":"APISIX-NACOS","_discovery_type":"nacos",
+"nodes":[{"host":"1.1.1.2","port":80,"weight":1},{"host":"1.1.1.1","port":80,"weight":1}]}}`
+	msg, err := message.NewMessage("/prefix/mocks/1", []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	defer registry.Clear()
+	registry.Bind("nacos/@@APISIX-NACOS", msg)
+
+	caseDesc := "skip the same nodes"
+	registry.Publish("nacos/@@APISIX-NACOS", []*message.Node{
+		{Host: "1.1.1.1", Port: 80, Weight: 1},
+		{Host: "1.1.1.2", Port: 80, Weight: 1},
+		{Host: "1.1.1.1", Port: 80, Weight: 1},
+	})
+	watchCh <- msg
+	assert.Nil(t, rewriter.Flush(context.Background()), caseDesc)
+	mStg.AssertNumberOfCalls(t, "Update", 0)
+
+	caseDesc = "write the changed nodes"
+	registry.Publish("nacos/@@APISIX-NACOS", []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}})
+	watchCh <- msg
+	assert.Nil(t, rewriter.Flush(context.Background()), caseDesc)
+	mStg.AssertNumberOfCalls(t, "Update", 1)
+}
+
+func TestRewriterInjectedNodes(t *testing.T) {
+	var written string
+	mStg := &storer.MockInterface{}
+	mStg.On("Update", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		written = args.Get(1).(string)
+	}).Return(nil)
+	rewriter, watchCh := startRewriter(t, "mock_inject", mStg)
+	defer discoverer.RemoveDiscoverer("mock_inject")
+	defer rewriter.cancel()
+
+	// the discoverer does not publish to the registry, the nodes are injected into the message it sends
+	givenA6Str := `{"uri":"/hh","upstream":{"service_name":"APISIX-MOCK","discovery_type":"mock_inject"}}`
+	msg, err := message.NewMessage("/prefix/mocks/1", []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	msg.InjectNodes([]*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}})
+
+	caseDesc := "write the injected nodes"
+	watchCh <- msg
+	assert.Nil(t, rewriter.Flush(context.Background()), caseDesc)
+	mStg.AssertNumberOfCalls(t, "Update", 1)
+	assert.JSONEq(t, `{"uri":"/hh","upstream":{"_service_name":"APISIX-MOCK","_discovery_type":"mock_inject",
+"nodes":[{"host":"1.1.1.1","port":80,"weight":1}]}}`, written, caseDesc)
+
+	caseDesc = "skip the message without nodes"
+	msg, err = message.NewMessage("/prefix/mocks/1", []byte(givenA6Str), 2, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	watchCh <- msg
+	assert.Nil(t, rewriter.Flush(context.Background()), caseDesc)
+	mStg.AssertNumberOfCalls(t, "Update", 1)
+}
@@ -3,8 +3,13 @@ package components
 import (
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/api7/gopkg/pkg/log"
 
@@ -12,6 +17,7 @@ import (
 
 	"github.com/api7/apisix-seed/internal/core/storer"
 	"github.com/api7/apisix-seed/internal/discoverer"
+	"github.com/api7/apisix-seed/internal/metrics"
 )
 
 type Watcher struct {
@@ -20,8 +26,46 @@ type Watcher struct {
 
 	// Limit the number of simultaneously query
 	sem chan struct{}
+
+	// Protector shared with the Rewriter, optional
+	Protector *Protector
+	// ReconcileInterval is the interval of the reconciliation, zero disables it
+	ReconcileInterval time.Duration
+	// Rewriters write the drifted nodes found by the reconciliation, one for each etcd target
+	Rewriters []*Rewriter
+
+	// wg waits for the goroutines handling the watch events, see Close
+	wg sync.WaitGroup
+
+	mutex       sync.Mutex
+	initialized bool
+	closed      bool
+	// names of the stores whose watch is broken
+	broken map[string]struct{}
+	// watches cancels the watch of each store, see AddStore
+	watches map[*storer.GenericStore]context.CancelFunc
+	// degraded entities by ID, see discover
+	degraded map[string]*DegradedEntity
+	// IDs of the services the entities are bound to by entity ID, see bound
+	services map[string]string
+	// stream routes referencing an upstream by upstream_id by entity ID, see refer
+	references map[string]*reference
 }
 
+// reference is a stream route referencing an upstream by upstream_id
+type reference struct {
+	// upstream is the referenced upstream, see upstreamRef
+	upstream string
+	msg      *message.Message
+	s        *storer.GenericStore
+}
+
+// retries of the temporary errors of discoverers, see discover
+var (
+	discoverAttempts = 3
+	discoverBackoff  = time.Second
+)
+
 // Init: load apisix config from etcd, query service from discovery
 func (w *Watcher) Init() error {
 	// the number of semaphore is referenced to https://github.com/golang/go/blob/go1.17.1/src/cmd/compile/internal/noder/noder.go#L38
@@ -30,28 +74,69 @@ func (w *Watcher) Init() error {
 	loadSuccess := true
 	// List the initial information
 	for _, s := range storer.GetStores() {
-		//eg: query from etcd by prefix /apisix/routes/
-		msgs, err := s.List(message.ServiceFilter)
-		if err != nil {
+		if err := w.load(s); err != nil {
 			log.Errorf("storer list error: %v", err)
 			loadSuccess = false
 			break
 		}
+	}
 
-		if len(msgs) == 0 {
-			continue
-		}
-		wg := sync.WaitGroup{}
-		wg.Add(len(msgs))
+	if !loadSuccess {
+		return errors.New("failed to load all etcd resources")
+	}
+
+	w.mutex.Lock()
+	w.initialized = true
+	w.mutex.Unlock()
+	return nil
+}
+
+// load lists the entities of a store and queries their services from discovery
+func (w *Watcher) load(s *storer.GenericStore) error {
+	//eg: query from etcd by prefix /apisix/routes/
+	msgs, err := s.List(func(msg *message.Message) bool {
+		w.refer(msg, s)
+		return message.ServiceFilter(msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(msgs))
+	for _, msg := range msgs {
+		w.sem <- struct{}{}
+		go w.handleQuery(msg, &wg)
+	}
+	wg.Wait()
+
+	if isUpstreams(s) {
+		// the stream routes loaded before may reference the upstreams
 		for _, msg := range msgs {
-			w.sem <- struct{}{}
-			go w.handleQuery(msg, &wg)
+			w.rebindReferences(msg, s)
 		}
-		wg.Wait()
 	}
+	return nil
+}
 
-	if !loadSuccess {
-		return errors.New("failed to load all etcd resources")
+// Check reports whether the initial resources are loaded and all watches are alive
+func (w *Watcher) Check(_ context.Context) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return errors.New("watcher is closed")
+	}
+	if !w.initialized {
+		return errors.New("initial resources are not loaded")
+	}
+	if len(w.broken) > 0 {
+		paths := make([]string, 0, len(w.broken))
+		for path := range w.broken {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return fmt.Errorf("watch of %s is broken", strings.Join(paths, ", "))
 	}
 	return nil
 }
@@ -61,17 +146,108 @@ func (w *Watcher) Watch() {
 	w.ctx, w.cancel = context.WithCancel(context.TODO())
 
 	// Watch for entity updates from Storer
+	w.watches = make(map[*storer.GenericStore]context.CancelFunc)
 	for _, s := range storer.GetStores() {
-		go w.handleWatch(s)
+		w.watch(s)
+	}
+
+	if w.ReconcileInterval > 0 {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.reconcileLoop(w.ReconcileInterval)
+		}()
 	}
 }
 
+// Close stops accepting watch events, and waits until the events being handled are passed to discoverers
 func (w *Watcher) Close() {
+	w.mutex.Lock()
+	w.closed = true
+	w.mutex.Unlock()
+	if w.cancel == nil {
+		// not watching
+		return
+	}
 	w.cancel()
 
 	for _, s := range storer.GetStores() {
 		s.Unwatch()
 	}
+	w.wg.Wait()
+}
+
+func (w *Watcher) watch(s *storer.GenericStore) {
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.mutex.Lock()
+	w.watches[s] = cancel
+	w.mutex.Unlock()
+
+	// start the watch before returning, so that it can be stopped by RemoveStore
+	ch := s.Watch()
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.handleWatch(ctx, s, ch)
+	}()
+}
+
+// AddStore watches a store created after Init, e.g. when the configuration is reloaded,
+// and queries the services of its entities
+func (w *Watcher) AddStore(s *storer.GenericStore) error {
+	w.watch(s)
+	return w.load(s)
+}
+
+// RemoveStore stops watching a store and unsubscribes the services of its entities,
+// the nodes already written are left as they are
+func (w *Watcher) RemoveStore(s *storer.GenericStore) {
+	w.mutex.Lock()
+	if cancel, ok := w.watches[s]; ok {
+		cancel()
+		delete(w.watches, s)
+	}
+	delete(w.broken, s.Name())
+	w.mutex.Unlock()
+	s.Unwatch()
+
+	s.Range(func(key, value interface{}) bool {
+		s.Delete(key.(string))
+		msg := value.(*message.Message)
+		w.forget(msg.ID())
+		_ = w.unbind(msg)
+		if isUpstreams(s) {
+			w.rebindReferences(msg, s)
+		}
+		return true
+	})
+
+	w.mutex.Lock()
+	for id, ref := range w.references {
+		if ref.s == s {
+			delete(w.references, id)
+		}
+	}
+	w.mutex.Unlock()
+}
+
+// Requery queries the services of all entities using a discoverer,
+// e.g. when it is created again with a new configuration
+func (w *Watcher) Requery(typ string) {
+	wg := sync.WaitGroup{}
+	for _, s := range storer.GetStores() {
+		s.Range(func(_, value interface{}) bool {
+			msg := value.(*message.Message)
+			if msg.DiscoveryType() != typ {
+				return true
+			}
+			wg.Add(1)
+			w.sem <- struct{}{}
+			go w.handleQuery(msg, &wg)
+			return true
+		})
+	}
+	wg.Wait()
 }
 
 // handleQuery: init and query the service from discovery by apisix's conf
@@ -81,17 +257,29 @@ func (w *Watcher) handleQuery(msg *message.Message, wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	_ = discoverer.GetDiscoverer(msg.DiscoveryType()).Query(msg)
+	_ = w.bind(msg)
 }
 
-func (w *Watcher) handleWatch(s *storer.GenericStore) {
-	ch := s.Watch()
-
+func (w *Watcher) handleWatch(ctx context.Context, s *storer.GenericStore, ch <-chan []*message.Message) {
 	for {
 		select {
-		case <-w.ctx.Done():
+		case <-ctx.Done():
 			return
-		case msgs := <-ch:
+		case msgs, ok := <-ch:
+			if ctx.Err() != nil {
+				// the store is removed
+				return
+			}
+			if !ok {
+				log.Errorf("watch of %s is closed", s.Name())
+				w.mutex.Lock()
+				if w.broken == nil {
+					w.broken = make(map[string]struct{})
+				}
+				w.broken[s.Name()] = struct{}{}
+				w.mutex.Unlock()
+				return
+			}
 			wg := sync.WaitGroup{}
 			wg.Add(len(msgs))
 			for _, msg := range msgs {
@@ -112,18 +300,27 @@ func (w *Watcher) handleValue(msg *message.Message, wg *sync.WaitGroup, s *store
 	log.Infof("Watcher handle %d event: key=%s", msg.Action, msg.Key)
 	switch msg.Action {
 	case message.EventAdd:
-		w.update(msg, s)
+		metrics.WatchEvents.WithLabelValues(msg.Target, s.Typ, "add").Inc()
+		w.follow(msg, s, func() { w.update(msg, s) })
 	case message.EventDelete:
-		w.delete(msg, s)
+		metrics.WatchEvents.WithLabelValues(msg.Target, s.Typ, "delete").Inc()
+		w.unrefer(msg.ID())
+		w.follow(msg, s, func() { w.delete(msg, s) })
 	}
 }
 
 func (w *Watcher) update(msg *message.Message, s *storer.GenericStore) {
+	w.refer(msg, s)
 	if !message.ServiceFilter(msg) {
-		if !msg.HasNodesAttr() {
-			return
+		oldMsg := w.delete(msg, s)
+		if oldMsg != nil && msg.SeedOwned() {
+			// The entity leaves service discovery but still carries the fields written by apisix-seed,
+			// the nodes are only removed if they are the ones injected by apisix-seed
+			log.Infof("Watcher restores the entity %s which leaves service discovery", msg.Key)
+			if err := s.Restore(w.ctx, msg, false, message.SameNodes(oldMsg.Nodes(), msg.Nodes())); err != nil {
+				log.Errorf("restore entity %s failed: %s", msg.Key, err)
+			}
 		}
-		w.delete(msg, s)
 		return
 	}
 
@@ -131,7 +328,7 @@ func (w *Watcher) update(msg *message.Message, s *storer.GenericStore) {
 	if !ok {
 		// Obtains a new entity with service information
 		log.Infof("Watcher obtains a new entity %s with service information", msg.Key)
-		_ = discoverer.GetDiscoverer(msg.DiscoveryType()).Query(msg)
+		_ = w.bind(msg)
 		return
 	}
 
@@ -139,7 +336,7 @@ func (w *Watcher) update(msg *message.Message, s *storer.GenericStore) {
 	if message.ServiceUpdate(oldMsg, msg) {
 		// Updates the service information of existing entity
 		log.Infof("Watcher updates the service information of existing entity %s", msg.Key)
-		_ = discoverer.GetDiscoverer(msg.DiscoveryType()).Update(oldMsg, msg)
+		_ = w.rebind(oldMsg, msg)
 		return
 	}
 
@@ -147,23 +344,332 @@ func (w *Watcher) update(msg *message.Message, s *storer.GenericStore) {
 		// Replaces the service information of existing entity
 		log.Infof("Watcher replaces the service information of existing entity %s", msg.Key)
 
-		_ = discoverer.GetDiscoverer(oldMsg.DiscoveryType()).Delete(oldMsg)
-		_ = discoverer.GetDiscoverer(msg.DiscoveryType()).Query(msg)
+		_ = w.unbind(oldMsg)
+		_ = w.bind(msg)
 
 		return
 	}
 
 	log.Infof("Watcher update version only, key: %s, version: %d", msg.Key, msg.Version)
-	_ = discoverer.GetDiscoverer(msg.DiscoveryType()).Update(oldMsg, msg)
+	_ = w.rebind(oldMsg, msg)
 }
 
-func (w *Watcher) delete(msg *message.Message, s *storer.GenericStore) {
+// delete unbinds the entity from discovery and returns the deleted one
+func (w *Watcher) delete(msg *message.Message, s *storer.GenericStore) *message.Message {
 	obj, ok := s.Delete(msg.Key)
 	if !ok {
-		return
+		return nil
 	}
 	// Deletes an existing entity
 	delMsg := obj.(*message.Message)
 	log.Infof("Watcher deletes an existing entity %s", delMsg.Key)
-	_ = discoverer.GetDiscoverer(delMsg.DiscoveryType()).Delete(delMsg)
+	w.forget(delMsg.ID())
+	_ = w.unbind(delMsg)
+	return delMsg
+}
+
+// resolve binds a stream route referencing an upstream by upstream_id to the service of the upstream,
+// see message.ResolveUpstream. The upstream is looked up in the cache of the same target.
+func (w *Watcher) resolve(msg *message.Message) {
+	id := msg.UpstreamID()
+	if id == "" {
+		return
+	}
+	ups, _ := storer.LookupUpstream(msg.Target, id)
+	msg.ResolveUpstream(ups)
+}
+
+// refer resolves a stream route referencing an upstream and records the reference,
+// so that the stream route is bound again when the service of the upstream changes, see follow
+func (w *Watcher) refer(msg *message.Message, s *storer.GenericStore) {
+	id := msg.UpstreamID()
+	w.mutex.Lock()
+	if id == "" {
+		delete(w.references, msg.ID())
+	} else {
+		if w.references == nil {
+			w.references = make(map[string]*reference)
+		}
+		w.references[msg.ID()] = &reference{upstream: upstreamRef(msg.Target, id), msg: msg, s: s}
+	}
+	w.mutex.Unlock()
+
+	w.resolve(msg)
+}
+
+// unrefer drops the reference of a deleted stream route
+func (w *Watcher) unrefer(id string) {
+	w.mutex.Lock()
+	delete(w.references, id)
+	w.mutex.Unlock()
+}
+
+// follow runs fn, which updates or deletes an entity of the store. When the entity is an upstream
+// whose service changes, the stream routes referencing it are bound again.
+func (w *Watcher) follow(msg *message.Message, s *storer.GenericStore, fn func()) {
+	if !isUpstreams(s) {
+		fn()
+		return
+	}
+	before, _ := s.Load(msg.Key)
+	fn()
+	after, _ := s.Load(msg.Key)
+	if upstreamChanged(before, after) {
+		w.rebindReferences(msg, s)
+	}
+}
+
+// rebindReferences binds the stream routes referencing an upstream again
+func (w *Watcher) rebindReferences(ups *message.Message, s *storer.GenericStore) {
+	ref := upstreamRef(ups.Target, strings.TrimPrefix(ups.Key, s.BasePath()+"/"))
+	w.mutex.Lock()
+	refs := make([]*reference, 0)
+	for _, r := range w.references {
+		if r.upstream == ref {
+			refs = append(refs, r)
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, r := range refs {
+		log.Infof("Watcher binds the stream route %s again as the upstream %s changes", r.msg.Key, ups.Key)
+		msg, err := r.msg.Clone()
+		if err != nil {
+			log.Errorf("clone stream route %s failed: %s", r.msg.Key, err)
+			continue
+		}
+		w.update(msg, r.s)
+	}
+}
+
+// upstreamRef identifies an upstream referenced by upstream_id across all targets
+func upstreamRef(target, id string) string {
+	return target + ":" + id
+}
+
+// isUpstreams reports whether the store holds upstreams
+func isUpstreams(s *storer.GenericStore) bool {
+	return message.ToA6Type(s.BasePath()) == message.A6UpstreamsConf
+}
+
+// upstreamChanged reports whether the service of a cached upstream changes, nil when it is not cached
+func upstreamChanged(before, after interface{}) bool {
+	oldMsg, _ := before.(*message.Message)
+	msg, _ := after.(*message.Message)
+	if oldMsg == nil || msg == nil {
+		return oldMsg != msg
+	}
+	return message.ServiceReplace(oldMsg, msg) || message.ServiceUpdate(oldMsg, msg) ||
+		!reflect.DeepEqual(oldMsg.Protection(), msg.Protection()) || oldMsg.NodesFormat() != msg.NodesFormat()
+}
+
+// bind queries the service of the entity from its discoverer
+func (w *Watcher) bind(msg *message.Message) error {
+	return w.discover(msg, "query", func(ctx context.Context, d discoverer.DiscovererV2) error {
+		sn, err := d.QueryContext(ctx, msg)
+		if err == nil {
+			w.bound(msg, sn)
+		}
+		return err
+	})
+}
+
+// rebind updates the service information of the entity in its discoverer
+func (w *Watcher) rebind(oldMsg, msg *message.Message) error {
+	return w.discover(msg, "update", func(ctx context.Context, d discoverer.DiscovererV2) error {
+		sn, err := d.UpdateContext(ctx, oldMsg, msg)
+		if err == nil {
+			w.bound(msg, sn)
+		}
+		return err
+	})
+}
+
+// unbind removes the entity from its discoverer
+func (w *Watcher) unbind(msg *message.Message) error {
+	return w.discover(msg, "delete", func(ctx context.Context, d discoverer.DiscovererV2) error {
+		return d.DeleteContext(ctx, msg)
+	})
+}
+
+// bound records the service the entity is bound to. When it is another service than before, the nodes
+// last written are forgotten by the Protector, as a node set of the new service is not comparable to them.
+func (w *Watcher) bound(msg *message.Message, sn *discoverer.ServiceNodes) {
+	if sn == nil {
+		// the entity is not bound yet, e.g. an update before its query succeeds
+		return
+	}
+	if len(sn.Nodes) == 0 {
+		log.Warnf("entity %s is bound to service %s without nodes", msg.Key, sn.ID)
+	}
+
+	w.mutex.Lock()
+	if w.services == nil {
+		w.services = make(map[string]string)
+	}
+	last, ok := w.services[msg.ID()]
+	w.services[msg.ID()] = sn.ID
+	w.mutex.Unlock()
+
+	if ok && last != sn.ID && w.Protector != nil {
+		log.Infof("entity %s moves from service %s to %s", msg.Key, last, sn.ID)
+		w.Protector.Forget(msg.ID())
+	}
+}
+
+// forget drops what is known about a deleted entity
+func (w *Watcher) forget(id string) {
+	w.mutex.Lock()
+	delete(w.services, id)
+	w.mutex.Unlock()
+
+	if w.Protector != nil {
+		w.Protector.Forget(id)
+	}
+}
+
+// discover runs an operation on the discoverer of the entity and counts it.
+// The temporary errors are retried, and the entity is marked degraded when the operation still fails,
+// it is retried again by the reconciliation.
+func (w *Watcher) discover(msg *message.Message, operation string, fn func(context.Context, discoverer.DiscovererV2) error) error {
+	typ := msg.DiscoveryType()
+	ctx := w.context()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		metrics.DiscovererOperations.WithLabelValues(typ, operation).Inc()
+		if d, ok := discoverer.LookupDiscoverer(typ); ok {
+			err = fn(ctx, discoverer.V2(d))
+		} else {
+			err = &discoverer.Error{
+				Kind:    discoverer.ErrorInvalid,
+				Service: discoverer.ServiceID(msg),
+				Err:     fmt.Errorf("no discoverer: %s", typ),
+			}
+		}
+		if err == nil {
+			w.recover(msg)
+			return nil
+		}
+		metrics.DiscovererErrors.WithLabelValues(typ, operation).Inc()
+
+		if attempt >= discoverAttempts || !discoverer.IsTemporary(err) {
+			break
+		}
+		log.Warnf("%s the service of entity %s failed, retry later: %s", operation, msg.Key, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(attempt) * discoverBackoff):
+			continue
+		}
+		break
+	}
+
+	log.Errorf("%s the service of entity %s failed: %s", operation, msg.Key, err)
+	w.degrade(msg, operation, err)
+	return err
+}
+
+func (w *Watcher) context() context.Context {
+	if w.ctx == nil {
+		// only loading without watching, e.g. sync --once
+		return context.Background()
+	}
+	return w.ctx
+}
+
+// DegradedEntity is an entity whose service can not be discovered
+type DegradedEntity struct {
+	Key       string    `json:"key"`
+	Target    string    `json:"target,omitempty"`
+	Service   string    `json:"service"`
+	Operation string    `json:"operation"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+
+	msg *message.Message
+}
+
+func (w *Watcher) degrade(msg *message.Message, operation string, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.degraded == nil {
+		w.degraded = make(map[string]*DegradedEntity)
+	}
+	w.degraded[msg.ID()] = &DegradedEntity{
+		Key:       msg.Key,
+		Target:    msg.Target,
+		Service:   discoverer.ServiceID(msg),
+		Operation: operation,
+		Error:     err.Error(),
+		Time:      time.Now(),
+		msg:       msg,
+	}
+	metrics.DegradedEntities.Set(float64(len(w.degraded)))
+}
+
+func (w *Watcher) recover(msg *message.Message) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.degraded[msg.ID()]; ok {
+		delete(w.degraded, msg.ID())
+		metrics.DegradedEntities.Set(float64(len(w.degraded)))
+	}
+}
+
+// Degraded returns the entities whose services can not be discovered ordered by key
+func (w *Watcher) Degraded() []*DegradedEntity {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	entities := make([]*DegradedEntity, 0, len(w.degraded))
+	for _, entity := range w.degraded {
+		entities = append(entities, entity)
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Target != entities[j].Target {
+			return entities[i].Target < entities[j].Target
+		}
+		return entities[i].Key < entities[j].Key
+	})
+	return entities
+}
+
+// retryDegraded runs the failed operations of the degraded entities again,
+// a failed query or update is retried as a query
+func (w *Watcher) retryDegraded() {
+	for _, entity := range w.Degraded() {
+		log.Infof("Watcher retries the degraded entity %s", entity.Key)
+		if entity.Operation == "delete" {
+			_ = w.unbind(entity.msg)
+			continue
+		}
+		_ = w.bind(entity.msg)
+	}
+}
+
+// Restore rewrites all entities written by apisix-seed back to their operator-authored form,
+// it is used when apisix-seed is decommissioned and the data plane takes over service discovery
+func (w *Watcher) Restore() error {
+	ctx := context.TODO()
+	for _, s := range storer.GetStores() {
+		msgs, err := s.List(func(msg *message.Message) bool {
+			return msg.SeedOwned()
+		})
+		if err != nil {
+			log.Errorf("storer list error: %v", err)
+			return err
+		}
+
+		for _, msg := range msgs {
+			log.Infof("Watcher restores the entity %s", msg.Key)
+			if err = s.Restore(ctx, msg, true, true); err != nil {
+				log.Errorf("restore entity %s failed: %s", msg.Key, err)
+				return err
+			}
+		}
+	}
+	return nil
 }
@@ -1,7 +1,10 @@
 package components
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -204,3 +207,432 @@ func TestWatcherWatch(t *testing.T) {
 
 	time.Sleep(3 * time.Second)
 }
+
+func TestWatcherLeaveDiscovery(t *testing.T) {
+	caseDesc := "Test entity leaves discovery"
+	givenKey := "/prefix/mocks/1"
+	givenNodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	givenA6Str := `{"uri":"/hh","upstream":{"service_name":"APISIX-NACOS","discovery_type":"mock_nacos"}}`
+	leftA6Str := `{"uri":"/hh","upstream":{"_service_name":"APISIX-NACOS","nodes":[{"host":"1.1.1.1","port":80,"weight":1}]}}`
+	expectA6Str := `{"uri":"/hh","upstream":{}}`
+
+	mStg := &storer.MockInterface{}
+	mStg.On("Update", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		assert.Equal(t, givenKey, args[0], caseDesc)
+		assert.JSONEq(t, expectA6Str, args[1].(string), caseDesc)
+		assert.Equal(t, int64(2), args[2], caseDesc)
+	}).Return(nil)
+
+	storer.ClrearStores()
+	err := storer.InitStore("mocks", storer.GenericStoreOption{
+		BasePath: "/prefix/mocks",
+		Prefix:   "/prefix",
+	}, mStg)
+	assert.Nil(t, err, caseDesc)
+	s := storer.GetStore("mocks")
+
+	discoverer.Discoveries = map[string]discoverer.NewDiscoverFunc{
+		"mock_nacos": discoverer.NewDiscovererMock,
+	}
+	_ = discoverer.InitDiscoverer("mock_nacos", nil)
+	mDiscover := discoverer.GetDiscoverer("mock_nacos").(*discoverer.MockInterface)
+	mDiscover.On("Delete", mock.Anything).Return(nil)
+
+	oldMsg, err := message.NewMessage(givenKey, []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err, caseDesc)
+	oldMsg.InjectNodes(givenNodes)
+	s.Store(givenKey, oldMsg)
+
+	leftMsg, err := message.NewMessage(givenKey, []byte(leftA6Str), 2, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err, caseDesc)
+
+	watcher := Watcher{}
+	watcher.update(leftMsg, s)
+	mDiscover.AssertCalled(t, "Delete", oldMsg)
+	mStg.AssertNumberOfCalls(t, "Update", 1)
+}
+
+func TestWatcherCheck(t *testing.T) {
+	watchCh := make(chan []*message.Message)
+	mStg := &storer.MockInterface{}
+	mStg.On("Watch", mock.Anything, mock.Anything).Return(watchCh)
+	mStg.On("List", mock.Anything, mock.Anything).Return([]*message.Message{}, nil)
+
+	storer.ClrearStores()
+	err := storer.InitStore("mocks", storer.GenericStoreOption{
+		BasePath: "/prefix/mocks",
+		Prefix:   "/prefix",
+	}, mStg)
+	assert.Nil(t, err)
+
+	watcher := Watcher{}
+	watcher.Watch()
+
+	caseDesc := "not initialized"
+	assert.EqualError(t, watcher.Check(context.Background()), "initial resources are not loaded", caseDesc)
+
+	caseDesc = "initialized"
+	assert.Nil(t, watcher.Init(), caseDesc)
+	assert.Nil(t, watcher.Check(context.Background()), caseDesc)
+
+	caseDesc = "watch closed"
+	close(watchCh)
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualError(t, watcher.Check(context.Background()), "watch of /prefix/mocks is broken", caseDesc)
+}
+
+func TestWatcherReconcile(t *testing.T) {
+	givenNodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	givenA6Str := `{"uri":"/hh","upstream":{"service_name":"APISIX-NACOS","discovery_type":"mock_nacos"}}`
+	newMsg := func(key string, version int64) *message.Message {
+		msg, err := message.NewMessage(key, []byte(givenA6Str), version, message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		return msg
+	}
+
+	// the nodes of the synced entity are the same in the storage and the discoverer
+	listedSynced := newMsg("/prefix/mocks/synced", 1)
+	listedSynced.InjectNodes(givenNodes)
+	// the nodes of the reordered entity are stored in another order than the discoverer returns them
+	reorderedNodes := []*message.Node{{Host: "2.2.2.2", Port: 80, Weight: 1}, {Host: "1.1.1.1", Port: 80, Weight: 1}}
+	listedReordered := newMsg("/prefix/mocks/reordered", 1)
+	listedReordered.InjectNodes(reorderedNodes)
+
+	mStg := &storer.MockInterface{}
+	mStg.On("List", mock.Anything, mock.Anything).Return([]*message.Message{
+		newMsg("/prefix/mocks/drift", 1),
+		newMsg("/prefix/mocks/added", 1),
+		newMsg("/prefix/mocks/updated", 2),
+		newMsg("/prefix/mocks/stale", 1),
+		listedSynced,
+		listedReordered,
+	}, nil)
+	var updates int32
+	mStg.On("Update", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		atomic.AddInt32(&updates, 1)
+		assert.Equal(t, "/prefix/mocks/drift", args[0])
+		assert.Equal(t, int64(1), args[2])
+		msg, err := message.NewMessage("/prefix/mocks/drift", []byte(args[1].(string)), 1, message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		assert.True(t, message.SameNodes(givenNodes, msg.Nodes()))
+	}).Return(nil)
+
+	storer.ClrearStores()
+	err := storer.InitStore("mocks", storer.GenericStoreOption{
+		BasePath: "/prefix/mocks",
+		Prefix:   "/prefix",
+	}, mStg)
+	assert.Nil(t, err)
+	s := storer.GetStore("mocks")
+	for _, key := range []string{"/prefix/mocks/drift", "/prefix/mocks/updated", "/prefix/mocks/deleted"} {
+		s.Store(key, newMsg(key, 1))
+	}
+	// the listing is older than the update already received by the watch
+	s.Store("/prefix/mocks/stale", newMsg("/prefix/mocks/stale", 2))
+	synced := newMsg("/prefix/mocks/synced", 1)
+	synced.InjectNodes(givenNodes)
+	s.Store(synced.Key, synced)
+	reordered := newMsg("/prefix/mocks/reordered", 1)
+	reordered.InjectNodes(reorderedNodes)
+	s.Store(reordered.Key, reordered)
+
+	discoverer.Discoveries = map[string]discoverer.NewDiscoverFunc{
+		"mock_nacos": discoverer.NewDiscovererMock,
+	}
+	_ = discoverer.InitDiscoverer("mock_nacos", nil)
+	mDiscover := discoverer.GetDiscoverer("mock_nacos").(*discoverer.MockInterface)
+	mDiscover.On("Dump").Return([]*discoverer.ServiceDump{
+		{
+			Status:   discoverer.ServiceOK,
+			Nodes:    givenNodes,
+			Entities: []string{"/prefix/mocks/drift", "/prefix/mocks/synced"},
+		},
+		{
+			Status:   discoverer.ServiceOK,
+			Nodes:    []*message.Node{reorderedNodes[1], reorderedNodes[0]},
+			Entities: []string{"/prefix/mocks/reordered"},
+		},
+	})
+	// the discoverers left by other tests cache nothing
+	for _, d := range discoverer.GetDiscoverers() {
+		d.(*discoverer.MockInterface).On("Dump").Return([]*discoverer.ServiceDump{})
+	}
+	mDiscover.On("Query", mock.Anything).Return(nil)
+	mDiscover.On("Update", mock.Anything, mock.Anything).Return(nil)
+	mDiscover.On("Delete", mock.Anything).Return(nil)
+
+	rewriter := &Rewriter{
+		Prefix: "/prefix",
+		Source: make(chan *message.Message),
+	}
+	rewriter.Init()
+	defer rewriter.Close()
+
+	watcher := Watcher{Rewriters: []*Rewriter{rewriter}}
+	watcher.ctx = context.Background()
+	watcher.Reconcile()
+
+	// only the drift is rewritten, by the Rewriter
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&updates) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	caseDesc := "missed add"
+	mDiscover.AssertNumberOfCalls(t, "Query", 1)
+	_, ok := s.Load("/prefix/mocks/added")
+	assert.True(t, ok, caseDesc)
+
+	caseDesc = "missed update"
+	mDiscover.AssertNumberOfCalls(t, "Update", 1)
+	obj, _ := s.Load("/prefix/mocks/updated")
+	assert.Equal(t, int64(2), obj.(*message.Message).Version, caseDesc)
+
+	caseDesc = "stale listing"
+	obj, _ = s.Load("/prefix/mocks/stale")
+	assert.Equal(t, int64(2), obj.(*message.Message).Version, caseDesc)
+
+	caseDesc = "missed delete"
+	mDiscover.AssertNumberOfCalls(t, "Delete", 1)
+	_, ok = s.Load("/prefix/mocks/deleted")
+	assert.False(t, ok, caseDesc)
+}
+
+func TestWatcherReload(t *testing.T) {
+	givenKey := "/prefix/mocks/1"
+	givenA6Str := `{
+    "uri": "/reload/*",
+    "upstream": {
+        "service_name": "APISIX-RELOAD",
+        "type": "roundrobin",
+        "discovery_type": "mock_reload"
+    }
+}`
+	msg, err := message.NewMessage(givenKey, []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+
+	mStg := &storer.MockInterface{}
+	mStg.On("List", mock.Anything, mock.Anything).Return([]*message.Message{msg}, nil)
+	mStg.On("Watch", mock.Anything, mock.Anything).Return(make(chan []*message.Message))
+
+	storer.ClrearStores()
+	assert.Nil(t, storer.InitStore("mocks", storer.GenericStoreOption{
+		BasePath: "/prefix/mocks",
+		Prefix:   "/prefix",
+	}, mStg))
+
+	discoverer.Discoveries = map[string]discoverer.NewDiscoverFunc{
+		"mock_reload": discoverer.NewDiscovererMock,
+	}
+	_ = discoverer.InitDiscoverer("mock_reload", nil)
+	defer discoverer.RemoveDiscoverer("mock_reload")
+	oldDis := discoverer.GetDiscoverer("mock_reload").(*discoverer.MockInterface)
+	oldDis.On("Query", mock.Anything).Return(nil)
+
+	watcher := Watcher{}
+	watcher.Watch()
+	assert.Nil(t, watcher.Init())
+	oldDis.AssertNumberOfCalls(t, "Query", 1)
+
+	caseDesc := "requery with the new discoverer"
+	prev, err := discoverer.ReplaceDiscoverer("mock_reload", nil)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, oldDis, prev, caseDesc)
+	newDis := discoverer.GetDiscoverer("mock_reload").(*discoverer.MockInterface)
+	newDis.On("Query", mock.Anything).Run(func(args mock.Arguments) {
+		assert.Equal(t, givenKey, args[0].(*message.Message).Key, caseDesc)
+	}).Return(nil)
+	watcher.Requery("mock_reload")
+	newDis.AssertNumberOfCalls(t, "Query", 1)
+	oldDis.AssertNumberOfCalls(t, "Query", 1)
+
+	caseDesc = "remove the store"
+	newDis.On("Delete", mock.Anything).Return(nil)
+	s := storer.RemoveTargetStore("", "mocks")
+	assert.NotNil(t, s, caseDesc)
+	watcher.RemoveStore(s)
+	newDis.AssertNumberOfCalls(t, "Delete", 1)
+	_, ok := s.Load(givenKey)
+	assert.False(t, ok, caseDesc)
+	assert.Empty(t, storer.GetStores(), caseDesc)
+	assert.Nil(t, watcher.Check(context.Background()), caseDesc)
+
+	caseDesc = "no discoverer"
+	discoverer.RemoveDiscoverer("mock_reload")
+	assert.EqualError(t, watcher.bind(msg), "service mock_reload/APISIX-RELOAD: no discoverer: mock_reload", caseDesc)
+	degraded := watcher.Degraded()
+	assert.Len(t, degraded, 1, caseDesc)
+	assert.Equal(t, givenKey, degraded[0].Key, caseDesc)
+	assert.Equal(t, "query", degraded[0].Operation, caseDesc)
+
+	caseDesc = "closed"
+	watcher.Close()
+	assert.EqualError(t, watcher.Check(context.Background()), "watcher is closed", caseDesc)
+}
+
+func TestWatcherDegraded(t *testing.T) {
+	discoverBackoff = time.Millisecond
+	defer func() { discoverBackoff = time.Second }()
+
+	givenA6Str := `{"uri":"/hh","upstream":{"service_name":"APISIX-DEGRADED","discovery_type":"mock_degraded"}}`
+	msg, err := message.NewMessage("/prefix/mocks/1", []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+
+	discoverer.Discoveries = map[string]discoverer.NewDiscoverFunc{
+		"mock_degraded": discoverer.NewDiscovererMock,
+	}
+	_ = discoverer.InitDiscoverer("mock_degraded", nil)
+	defer discoverer.RemoveDiscoverer("mock_degraded")
+	mDiscover := discoverer.GetDiscoverer("mock_degraded").(*discoverer.MockInterface)
+
+	watcher := Watcher{}
+	watcher.ctx = context.Background()
+
+	caseDesc := "retry the temporary error"
+	mDiscover.On("Query", mock.Anything).Return(errors.New("unreachable")).Once()
+	mDiscover.On("Query", mock.Anything).Return(nil).Once()
+	assert.Nil(t, watcher.bind(msg), caseDesc)
+	mDiscover.AssertNumberOfCalls(t, "Query", 2)
+	assert.Empty(t, watcher.Degraded(), caseDesc)
+
+	caseDesc = "mark degraded after the attempts"
+	mDiscover.On("Query", mock.Anything).Return(errors.New("unreachable")).Times(discoverAttempts)
+	assert.EqualError(t, watcher.bind(msg), "service mock_degraded/APISIX-DEGRADED: unreachable", caseDesc)
+	mDiscover.AssertNumberOfCalls(t, "Query", 2+discoverAttempts)
+	degraded := watcher.Degraded()
+	assert.Len(t, degraded, 1, caseDesc)
+	assert.Equal(t, "mock_degraded/APISIX-DEGRADED", degraded[0].Service, caseDesc)
+	assert.Equal(t, "query", degraded[0].Operation, caseDesc)
+
+	caseDesc = "recover on reconciliation"
+	mDiscover.On("Query", mock.Anything).Return(nil).Once()
+	watcher.retryDegraded()
+	mDiscover.AssertNumberOfCalls(t, "Query", 3+discoverAttempts)
+	assert.Empty(t, watcher.Degraded(), caseDesc)
+
+	caseDesc = "no retry of the invalid error"
+	mDiscover.On("Delete", mock.Anything).Return(&discoverer.Error{
+		Kind:    discoverer.ErrorInvalid,
+		Service: discoverer.ServiceID(msg),
+		Err:     errors.New("invalid service"),
+	}).Once()
+	assert.NotNil(t, watcher.unbind(msg), caseDesc)
+	mDiscover.AssertNumberOfCalls(t, "Delete", 1)
+	degraded = watcher.Degraded()
+	assert.Len(t, degraded, 1, caseDesc)
+	assert.Equal(t, "delete", degraded[0].Operation, caseDesc)
+
+	caseDesc = "give up when the context is done"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	watcher.ctx = ctx
+	assert.ErrorIs(t, watcher.bind(msg), context.Canceled, caseDesc)
+	mDiscover.AssertNumberOfCalls(t, "Query", 3+discoverAttempts)
+}
+
+func TestWatcherBound(t *testing.T) {
+	givenNodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	givenA6Str := `{"uri":"/hh","upstream":{"service_name":"APISIX-NACOS","discovery_type":"nacos"}}`
+	msg, err := message.NewMessage("/prefix/mocks/1", []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	msg.InjectNodes(givenNodes)
+
+	watcher := Watcher{Protector: NewProtector(nil)}
+	assert.True(t, watcher.Protector.Allow(msg, nil))
+
+	caseDesc := "the same service"
+	watcher.bound(msg, &discoverer.ServiceNodes{ID: "nacos/@@APISIX-NACOS", Nodes: givenNodes})
+	watcher.bound(msg, &discoverer.ServiceNodes{ID: "nacos/@@APISIX-NACOS", Nodes: givenNodes})
+	assert.Contains(t, watcher.Protector.last, msg.ID(), caseDesc)
+
+	caseDesc = "not bound yet"
+	watcher.bound(msg, nil)
+	assert.Contains(t, watcher.Protector.last, msg.ID(), caseDesc)
+
+	caseDesc = "another service"
+	watcher.bound(msg, &discoverer.ServiceNodes{ID: "nacos/public@@APISIX-NACOS", Nodes: givenNodes})
+	assert.NotContains(t, watcher.Protector.last, msg.ID(), caseDesc)
+	assert.Equal(t, "nacos/public@@APISIX-NACOS", watcher.services[msg.ID()], caseDesc)
+
+	caseDesc = "forget the deleted entity"
+	watcher.forget(msg.ID())
+	assert.NotContains(t, watcher.services, msg.ID(), caseDesc)
+}
+
+func TestWatcherStreamRouteReference(t *testing.T) {
+	upsKey := "/prefix/upstreams/1"
+	routeKey := "/prefix/stream_routes/1"
+	upsA6Str := `{"service_name":"APISIX-NACOS","discovery_type":"mock_nacos","discovery_args":{"group_name":"DEFAULT_GROUP"}}`
+	leftA6Str := `{"nodes":[{"host":"1.1.1.1","port":80,"weight":1}]}`
+	routeA6Str := `{"server_port":9100,"upstream_id":1}`
+
+	storer.ClrearStores()
+	for _, name := range []string{"upstreams", "stream_routes"} {
+		assert.Nil(t, storer.InitStore(name, storer.GenericStoreOption{
+			BasePath: "/prefix/" + name,
+			Prefix:   "/prefix",
+		}, &storer.MockInterface{}))
+	}
+	upsStore := storer.GetStore("upstreams")
+	routeStore := storer.GetStore("stream_routes")
+
+	discoverer.Discoveries = map[string]discoverer.NewDiscoverFunc{
+		"mock_nacos": discoverer.NewDiscovererMock,
+	}
+	_ = discoverer.InitDiscoverer("mock_nacos", nil)
+	mDiscover := discoverer.GetDiscoverer("mock_nacos").(*discoverer.MockInterface)
+	mDiscover.On("Query", mock.Anything).Return(nil)
+	mDiscover.On("Update", mock.Anything, mock.Anything).Return(nil)
+	mDiscover.On("Delete", mock.Anything).Return(nil)
+
+	watcher := Watcher{sem: make(chan struct{}, 1)}
+	handle := func(key, value string, s *storer.GenericStore) {
+		action := message.EventAdd
+		if value == "" {
+			action = message.EventDelete
+		}
+		msg, err := message.NewMessage(key, []byte(value), 1, action, message.ToA6Type(s.BasePath()))
+		assert.Nil(t, err)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		watcher.sem <- struct{}{}
+		watcher.handleValue(msg, &wg, s)
+	}
+	queried := func(key string) []*message.Message {
+		msgs := make([]*message.Message, 0)
+		for _, call := range mDiscover.Calls {
+			if msg := call.Arguments[0].(*message.Message); call.Method == "Query" && msg.Key == key {
+				msgs = append(msgs, msg)
+			}
+		}
+		return msgs
+	}
+
+	caseDesc := "the upstream is unknown"
+	handle(routeKey, routeA6Str, routeStore)
+	assert.Empty(t, queried(routeKey), caseDesc)
+	assert.Contains(t, watcher.references, routeKey, caseDesc)
+
+	caseDesc = "bound to the service of the upstream"
+	handle(upsKey, upsA6Str, upsStore)
+	assert.Len(t, queried(upsKey), 1, caseDesc)
+	if msgs := queried(routeKey); assert.Len(t, msgs, 1, caseDesc) {
+		assert.Equal(t, "APISIX-NACOS", msgs[0].ServiceName(), caseDesc)
+		assert.Equal(t, "DEFAULT_GROUP", msgs[0].DiscoveryArgs()["group_name"], caseDesc)
+	}
+	_, ok := routeStore.Load(routeKey)
+	assert.True(t, ok, caseDesc)
+
+	caseDesc = "the nodes written to the upstream leave the stream route as it is"
+	handle(upsKey, upsA6Str, upsStore)
+	assert.Len(t, queried(routeKey), 1, caseDesc)
+
+	caseDesc = "the upstream leaves service discovery"
+	handle(upsKey, leftA6Str, upsStore)
+	_, ok = routeStore.Load(routeKey)
+	assert.False(t, ok, caseDesc)
+	mDiscover.AssertNumberOfCalls(t, "Delete", 2)
+
+	caseDesc = "forget the deleted stream route"
+	handle(routeKey, "", routeStore)
+	assert.NotContains(t, watcher.references, routeKey, caseDesc)
+}
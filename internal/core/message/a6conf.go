@@ -2,32 +2,111 @@ package message
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Protection overrides the global node protection policy for an upstream
+type Protection struct {
+	Empty          *bool `json:"empty,omitempty"`
+	MaxDropPercent *int  `json:"max_drop_percent,omitempty"`
+}
+
 type UpstreamArg struct {
 	NamespaceID string                 `json:"namespace_id,omitempty"`
 	GroupName   string                 `json:"group_name,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Protection  *Protection            `json:"protection,omitempty"`
+	// NodesFormat overrides the global format of the nodes written, see Options
+	NodesFormat string `json:"nodes_format,omitempty"`
+}
+
+// SeedAnnotation records the ownership of the nodes written in the annotation write mode
+type SeedAnnotation struct {
+	ServiceID  string `json:"service_id,omitempty"`
+	Discoverer string `json:"discoverer,omitempty"`
+	UpdateTime int64  `json:"update_time,omitempty"`
 }
 
 type Upstream struct {
-	Nodes            interface{}  `json:"nodes,omitempty"`
-	DiscoveryType    string       `json:"discovery_type,omitempty"`
-	DupDiscoveryType string       `json:"_discovery_type,omitempty"`
-	DiscoveryArgs    *UpstreamArg `json:"discovery_args,omitempty"`
-	DupServiceName   string       `json:"_service_name,omitempty"`
-	ServiceName      string       `json:"service_name,omitempty"`
+	Nodes            interface{}     `json:"nodes,omitempty"`
+	DiscoveryType    string          `json:"discovery_type,omitempty"`
+	DupDiscoveryType string          `json:"_discovery_type,omitempty"`
+	DiscoveryArgs    *UpstreamArg    `json:"discovery_args,omitempty"`
+	DupServiceName   string          `json:"_service_name,omitempty"`
+	ServiceName      string          `json:"service_name,omitempty"`
+	Seed             *SeedAnnotation `json:"_seed,omitempty"`
+}
+
+// nodesFormat returns the format of the nodes written to the upstream
+func (up *Upstream) nodesFormat() string {
+	if up.DiscoveryArgs != nil && up.DiscoveryArgs.NodesFormat != "" {
+		return up.DiscoveryArgs.NodesFormat
+	}
+	return CurrentOptions().NodesFormat
+}
+
+func (up *Upstream) inject(nodes interface{}) {
+	if list, ok := nodes.([]*Node); ok {
+		nodes = FormatNodes(list, up.nodesFormat())
+	}
+	up.Nodes = nodes
+	if CurrentOptions().WriteMode != WriteModeAnnotation {
+		return
+	}
+
+	serviceName, discoveryType := up.ServiceName, up.DiscoveryType
+	if serviceName == "" {
+		serviceName = up.DupServiceName
+	}
+	if discoveryType == "" {
+		discoveryType = up.DupDiscoveryType
+	}
+	namespace, group := "", ""
+	if up.DiscoveryArgs != nil {
+		namespace, group = up.DiscoveryArgs.NamespaceID, up.DiscoveryArgs.GroupName
+	}
+	up.Seed = &SeedAnnotation{
+		ServiceID:  fmt.Sprintf("%s@%s@%s", namespace, group, serviceName),
+		Discoverer: discoveryType,
+		UpdateTime: time.Now().Unix(),
+	}
 }
 
 const (
-	A6RoutesConf    = 0
-	A6UpstreamsConf = 1
-	A6ServicesConf  = 2
+	A6RoutesConf       = 0
+	A6UpstreamsConf    = 1
+	A6ServicesConf     = 2
+	A6StreamRoutesConf = 3
 )
 
+// A6TypeNames maps the type names used in the configuration to A6 types
+var A6TypeNames = map[string]int{
+	"routes":        A6RoutesConf,
+	"upstreams":     A6UpstreamsConf,
+	"services":      A6ServicesConf,
+	"stream_routes": A6StreamRoutesConf,
+}
+
+// a6Types holds the A6 types of the prefixes registered by RegisterA6Type
+var a6Types sync.Map
+
+// RegisterA6Type binds a prefix to an A6 type, it takes precedence over the suffix based detection
+func RegisterA6Type(prefix string, a6Type int) {
+	a6Types.Store(strings.TrimSuffix(prefix, "/"), a6Type)
+}
+
 func ToA6Type(prefix string) int {
+	if a6Type, ok := a6Types.Load(strings.TrimSuffix(prefix, "/")); ok {
+		return a6Type.(int)
+	}
+	// stream_routes must be checked before routes, as they share the same suffix
+	if strings.HasSuffix(prefix, "stream_routes") {
+		return A6StreamRoutesConf
+	}
 	if strings.HasSuffix(prefix, "routes") {
 		return A6RoutesConf
 	}
@@ -56,6 +135,8 @@ func NewA6Conf(value []byte, a6Type int) (A6Conf, error) {
 		return NewUpstreams(value)
 	case A6ServicesConf:
 		return NewServices(value)
+	case A6StreamRoutesConf:
+		return NewStreamRoutes(value)
 	default:
 		return NewRoutes(value)
 	}
@@ -75,12 +156,24 @@ func unmarshal(data []byte, v A6Conf) error {
 	return nil
 }
 
+// touch refreshes update_time like the Admin API of APISIX 3.x does on every write.
+// A value of APISIX 2.x has no update_time unless the version is pinned to 2, so it is refreshed when present.
+func touch(all map[string]interface{}) {
+	if CurrentOptions().APISIXVersion == APISIXVersion2 {
+		return
+	}
+	if _, ok := all["update_time"]; ok {
+		all["update_time"] = time.Now().Unix()
+	}
+}
+
 // Embed the latest value into `all` map
 func embedElm(v reflect.Value, all map[string]interface{}) {
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
 
+	annotation := CurrentOptions().WriteMode == WriteModeAnnotation
 	typ := v.Type()
 	fieldNum := typ.NumField()
 	for i := 0; i < fieldNum; i++ {
@@ -92,7 +185,8 @@ func embedElm(v reflect.Value, all map[string]interface{}) {
 			continue
 		}
 
-		if fieldName == "hasNodesAttr" {
+		if fieldName == "hasNodesAttr" || field.PkgPath != "" {
+			// unexported fields are not part of the value
 			continue
 		}
 
@@ -102,10 +196,31 @@ func embedElm(v reflect.Value, all map[string]interface{}) {
 			continue
 		}
 
-		if fieldName == "DiscoveryType" || fieldName == "ServiceName" {
-			all["_"+tagName] = val.Interface()
-			delete(all, tagName)
+		switch fieldName {
+		case "DiscoveryType", "ServiceName":
+			if annotation {
+				all[tagName] = val.Interface()
+				delete(all, "_"+tagName)
+			} else {
+				all["_"+tagName] = val.Interface()
+				delete(all, tagName)
+			}
 			continue
+		case "DupDiscoveryType", "DupServiceName":
+			if annotation {
+				// restore the renamed field written in the rename mode
+				name := strings.TrimPrefix(tagName, "_")
+				if _, ok := all[name]; !ok {
+					all[name] = val.Interface()
+				}
+				delete(all, tagName)
+				continue
+			}
+		case "Seed":
+			if !annotation {
+				delete(all, tagName)
+				continue
+			}
 		}
 
 		if val.Kind() == reflect.Ptr {
@@ -140,12 +255,13 @@ func (ups *Upstreams) GetAll() *map[string]interface{} {
 
 func (ups *Upstreams) Marshal() ([]byte, error) {
 	embedElm(reflect.ValueOf(ups), ups.All)
+	touch(ups.All)
 
 	return json.Marshal(ups.All)
 }
 
 func (ups *Upstreams) Inject(nodes interface{}) {
-	ups.Nodes = nodes
+	ups.Upstream.inject(nodes)
 }
 
 func (ups *Upstreams) GetUpstream() Upstream {
@@ -186,12 +302,13 @@ func (routes *Routes) GetAll() *map[string]interface{} {
 
 func (routes *Routes) Marshal() ([]byte, error) {
 	embedElm(reflect.ValueOf(routes), routes.All)
+	touch(routes.All)
 
 	return json.Marshal(routes.All)
 }
 
 func (routes *Routes) Inject(nodes interface{}) {
-	routes.Upstream.Nodes = nodes
+	routes.Upstream.inject(nodes)
 }
 
 func (routes *Routes) GetUpstream() Upstream {
@@ -229,12 +346,13 @@ func (services *Services) GetAll() *map[string]interface{} {
 
 func (services *Services) Marshal() ([]byte, error) {
 	embedElm(reflect.ValueOf(services), services.All)
+	touch(services.All)
 
 	return json.Marshal(services.All)
 }
 
 func (services *Services) Inject(nodes interface{}) {
-	services.Upstream.Nodes = nodes
+	services.Upstream.inject(nodes)
 }
 
 func (services *Services) GetUpstream() Upstream {
@@ -260,3 +378,97 @@ func NewServices(value []byte) (A6Conf, error) {
 
 	return services, nil
 }
+
+// StreamRoutes are the TCP/UDP routes. A stream route referencing an upstream by upstream_id
+// is bound to the service of the referenced upstream, see Message.ResolveUpstream
+type StreamRoutes struct {
+	Upstream     Upstream               `json:"upstream"`
+	All          map[string]interface{} `json:"-"`
+	hasNodesAttr bool
+
+	// upstreamID is the upstream referenced by upstream_id
+	upstreamID string
+	// inline is the upstream parsed from the value of a stream route referencing an upstream
+	inline Upstream
+	// referenced holds the discovery of the referenced upstream once resolved
+	referenced *Upstream
+}
+
+func (routes *StreamRoutes) GetAll() *map[string]interface{} {
+	return &routes.All
+}
+
+func (routes *StreamRoutes) Marshal() ([]byte, error) {
+	embedElm(reflect.ValueOf(routes), routes.All)
+	touch(routes.All)
+
+	return json.Marshal(routes.All)
+}
+
+func (routes *StreamRoutes) Inject(nodes interface{}) {
+	routes.Upstream.inject(nodes)
+}
+
+func (routes *StreamRoutes) GetUpstream() Upstream {
+	return routes.Upstream
+}
+
+func (routes *StreamRoutes) HasNodesAttr() bool {
+	return routes.hasNodesAttr
+}
+
+// resolve replaces the discovery of the upstream with the one of the referenced upstream, an empty one
+// leaves the stream route without service discovery. The upstream parsed from the value is kept when it
+// already declares the same service, i.e. it is written by apisix-seed.
+func (routes *StreamRoutes) resolve(ref Upstream) {
+	up := routes.inline
+	name, typ := up.ServiceName, up.DiscoveryType
+	if name == "" {
+		name = up.DupServiceName
+	}
+	if typ == "" {
+		typ = up.DupDiscoveryType
+	}
+	if ref.ServiceName == "" || name != ref.ServiceName || typ != ref.DiscoveryType {
+		up.ServiceName, up.DiscoveryType = ref.ServiceName, ref.DiscoveryType
+		up.DupServiceName, up.DupDiscoveryType = "", ""
+		up.Seed = nil
+	}
+	up.DiscoveryArgs = nil
+	if ref.DiscoveryArgs != nil {
+		args := *ref.DiscoveryArgs
+		up.DiscoveryArgs = &args
+	}
+	routes.Upstream = up
+}
+
+func NewStreamRoutes(value []byte) (A6Conf, error) {
+	routes := &StreamRoutes{
+		All: make(map[string]interface{}),
+	}
+	err := unmarshal(value, routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if routes.Upstream.Nodes != nil {
+		routes.hasNodesAttr = true
+	}
+
+	var ref struct {
+		UpstreamID json.RawMessage `json:"upstream_id"`
+	}
+	if err = json.Unmarshal(value, &ref); err != nil {
+		return nil, err
+	}
+	// the id is either a string or an integer
+	if id := string(ref.UpstreamID); id != "null" {
+		routes.upstreamID = strings.Trim(id, `"`)
+	}
+	if routes.upstreamID != "" {
+		// unresolved until the referenced upstream is known
+		routes.inline = routes.Upstream
+		routes.resolve(Upstream{})
+	}
+	return routes, nil
+}
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -90,7 +91,18 @@ func TestInject_Routes(t *testing.T) {
 	assert.Len(t, a6.GetUpstream().Nodes, 2)
 }
 
+// keepUpdateTime pins the APISIX version to 2 so that update_time is compared as it is, see TestMarshal_APISIXVersion.
+// The returned function restores the default options.
+func keepUpdateTime() func() {
+	opts := DefaultOptions()
+	opts.APISIXVersion = APISIXVersion2
+	SetOptions(opts)
+	return func() { SetOptions(DefaultOptions()) }
+}
+
 func TestMarshal_Routes(t *testing.T) {
+	defer keepUpdateTime()()
+
 	givenA6Str := `{
     "status": 1,
     "id": "3",
@@ -177,6 +189,10 @@ func TestHasNodesAttr_Routes(t *testing.T) {
 			name:  "normal",
 			a6Str: `{"uri":"/hh","upstream":{"type":"roundrobin","nodes":[{"host":"192.168.1.1","port":80,"weight":1}]}}`,
 			want:  true,
+		}, {
+			name:  "hash nodes",
+			a6Str: `{"uri":"/hh","upstream":{"type":"roundrobin","nodes":{"192.168.1.1:80":1}}}`,
+			want:  true,
 		},
 	}
 	for _, tt := range tests {
@@ -267,6 +283,8 @@ func TestInject_Services(t *testing.T) {
 }
 
 func TestMarshal_Services(t *testing.T) {
+	defer keepUpdateTime()()
+
 	givenA6Str := `{
     "enable_websocket": false,
     "upstream": {
@@ -428,6 +446,8 @@ func TestInject_Upstreams(t *testing.T) {
 }
 
 func TestMarshal_Upstreams(t *testing.T) {
+	defer keepUpdateTime()()
+
 	givenA6Str := `{
     "status":1,
     "id":"3",
@@ -517,3 +537,152 @@ func TestHasNodesAttr_Upstreams(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshal_Annotation(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WriteMode = WriteModeAnnotation
+	SetOptions(opts)
+	defer SetOptions(DefaultOptions())
+
+	tests := []struct {
+		name  string
+		a6Str string
+		want  string
+	}{
+		{
+			name:  "operator-authored",
+			a6Str: `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS","discovery_args":{"group_name":"DEFAULT_GROUP"}}}`,
+			want:  `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS","discovery_args":{"group_name":"DEFAULT_GROUP"},"nodes":[{"host":"192.168.1.1","port":80,"weight":1}]}}`,
+		},
+		{
+			name:  "written in the rename mode",
+			a6Str: `{"uri":"/hh","upstream":{"_discovery_type":"nacos","_service_name":"APISIX-NACOS","discovery_args":{"group_name":"DEFAULT_GROUP"},"nodes":[]}}`,
+			want:  `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS","discovery_args":{"group_name":"DEFAULT_GROUP"},"nodes":[{"host":"192.168.1.1","port":80,"weight":1}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a6, err := NewA6Conf([]byte(tt.a6Str), A6RoutesConf)
+			assert.Nil(t, err)
+			a6.Inject([]*Node{{Host: "192.168.1.1", Port: 80, Weight: 1}})
+			ss, err := a6.Marshal()
+			assert.Nil(t, err)
+
+			all := make(map[string]interface{})
+			assert.Nil(t, json.Unmarshal(ss, &all))
+			seed := all["upstream"].(map[string]interface{})["_seed"].(map[string]interface{})
+			assert.Equal(t, "@DEFAULT_GROUP@APISIX-NACOS", seed["service_id"])
+			assert.Equal(t, "nacos", seed["discoverer"])
+			assert.NotZero(t, seed["update_time"])
+
+			delete(all["upstream"].(map[string]interface{}), "_seed")
+			ss, _ = json.Marshal(all)
+			assert.JSONEq(t, tt.want, string(ss))
+		})
+	}
+
+	caseDesc := "parse the annotation"
+	a6Str := `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS","nodes":[],
+"_seed":{"service_id":"@@APISIX-NACOS","discoverer":"nacos","update_time":1648871506}}}`
+	a6, err := NewA6Conf([]byte(a6Str), A6RoutesConf)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, "@@APISIX-NACOS", a6.GetUpstream().Seed.ServiceID, caseDesc)
+
+	caseDesc = "switch back to the rename mode"
+	SetOptions(DefaultOptions())
+	a6.Inject([]*Node{})
+	ss, err := a6.Marshal()
+	assert.Nil(t, err, caseDesc)
+	assert.JSONEq(t, `{"uri":"/hh","upstream":{"_discovery_type":"nacos","_service_name":"APISIX-NACOS","nodes":[]}}`, string(ss), caseDesc)
+}
+
+func TestToA6Type(t *testing.T) {
+	assert.Equal(t, A6RoutesConf, ToA6Type("/apisix/routes"))
+	assert.Equal(t, A6UpstreamsConf, ToA6Type("/apisix/upstreams"))
+	assert.Equal(t, A6ServicesConf, ToA6Type("/apisix/services"))
+	assert.Equal(t, A6StreamRoutesConf, ToA6Type("/apisix/stream_routes"))
+
+	RegisterA6Type("/apisix/custom", A6UpstreamsConf)
+	assert.Equal(t, A6UpstreamsConf, ToA6Type("/apisix/custom"))
+	assert.Equal(t, A6UpstreamsConf, ToA6Type("/apisix/custom/"))
+}
+
+func TestMarshal_StreamRoutes(t *testing.T) {
+	givenA6Str := `{
+    "id": "1",
+    "server_port": 9100,
+    "upstream": {
+        "type": "roundrobin",
+        "discovery_type": "nacos",
+        "service_name": "APISIX-NACOS"
+    }
+}`
+	wantA6Str := `{
+    "id": "1",
+    "server_port": 9100,
+    "upstream": {
+        "type": "roundrobin",
+        "_discovery_type": "nacos",
+        "_service_name": "APISIX-NACOS",
+        "nodes": [
+            {
+                "host": "192.168.1.1",
+                "port": 80,
+                "weight": 1
+            }
+        ]
+    }
+}`
+	caseDesc := "sanity"
+	a6, err := NewA6Conf([]byte(givenA6Str), A6StreamRoutesConf)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, "nacos", a6.GetUpstream().DiscoveryType, caseDesc)
+	assert.Equal(t, "APISIX-NACOS", a6.GetUpstream().ServiceName, caseDesc)
+	assert.False(t, a6.HasNodesAttr(), caseDesc)
+
+	a6.Inject([]*Node{{Host: "192.168.1.1", Port: 80, Weight: 1}})
+	ss, err := a6.Marshal()
+	assert.Nil(t, err, caseDesc)
+	assert.JSONEq(t, wantA6Str, string(ss), caseDesc)
+}
+
+func TestMarshal_APISIXVersion(t *testing.T) {
+	a6Str := `{"uri":"/hh","create_time":1648871506,"update_time":1648871506,
+"upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS"}}`
+
+	tests := []struct {
+		caseDesc string
+		version  string
+		touched  bool
+	}{
+		{caseDesc: "auto refreshes update_time", version: APISIXVersionAuto, touched: true},
+		{caseDesc: "APISIX 2.x keeps update_time", version: APISIXVersion2, touched: false},
+		{caseDesc: "APISIX 3.x refreshes update_time", version: APISIXVersion3, touched: true},
+	}
+	defer SetOptions(DefaultOptions())
+
+	opts := DefaultOptions()
+	for _, tc := range tests {
+		opts.APISIXVersion = tc.version
+		SetOptions(opts)
+		a6, err := NewA6Conf([]byte(a6Str), A6RoutesConf)
+		assert.Nil(t, err, tc.caseDesc)
+		a6.Inject([]*Node{{Host: "192.168.1.1", Port: 80, Weight: 1}})
+		ss, err := a6.Marshal()
+		assert.Nil(t, err, tc.caseDesc)
+
+		all := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(ss, &all), tc.caseDesc)
+		assert.Equal(t, float64(1648871506), all["create_time"], tc.caseDesc)
+		assert.Equal(t, tc.touched, all["update_time"] != float64(1648871506), tc.caseDesc)
+	}
+
+	caseDesc := "update_time is not added"
+	opts.APISIXVersion = APISIXVersionAuto
+	SetOptions(opts)
+	a6, err := NewA6Conf([]byte(`{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS"}}`), A6RoutesConf)
+	assert.Nil(t, err, caseDesc)
+	ss, err := a6.Marshal()
+	assert.Nil(t, err, caseDesc)
+	assert.NotContains(t, string(ss), "update_time", caseDesc)
+}
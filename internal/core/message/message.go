@@ -1,6 +1,8 @@
 package message
 
 import (
+	"encoding/json"
+	"fmt"
 	"reflect"
 )
 
@@ -25,7 +27,18 @@ type Message struct {
 	Value   string
 	Version int64
 	Action  StoreEvent
-	a6Conf  A6Conf
+	// Target is the etcd target the entity belongs to, empty for the default one
+	Target string
+	a6Conf A6Conf
+	a6Type int
+}
+
+// ID identifies the entity across all targets
+func (msg *Message) ID() string {
+	if msg.Target == "" {
+		return msg.Key
+	}
+	return msg.Target + ":" + msg.Key
 }
 
 func NewMessage(key string, value []byte, version int64, action StoreEvent, a6Type int) (*Message, error) {
@@ -34,6 +47,7 @@ func NewMessage(key string, value []byte, version int64, action StoreEvent, a6Ty
 		Value:   string(value),
 		Version: version,
 		Action:  action,
+		a6Type:  a6Type,
 	}
 	if len(value) != 0 {
 		a6, err := NewA6Conf(value, a6Type)
@@ -73,10 +87,102 @@ func (msg *Message) DiscoveryArgs() map[string]interface{} {
 	}
 }
 
+// Protection returns the node protection policy declared in the upstream's discovery_args
+func (msg *Message) Protection() *Protection {
+	up := msg.a6Conf.GetUpstream()
+	if up.DiscoveryArgs == nil {
+		return nil
+	}
+	return up.DiscoveryArgs.Protection
+}
+
+func (msg *Message) Nodes() interface{} {
+	return msg.a6Conf.GetUpstream().Nodes
+}
+
 func (msg *Message) InjectNodes(nodes interface{}) {
 	msg.a6Conf.Inject(nodes)
 }
 
+// UpstreamID returns the upstream referenced by upstream_id of a stream route, empty for other entities
+func (msg *Message) UpstreamID() string {
+	if routes, ok := msg.a6Conf.(*StreamRoutes); ok {
+		return routes.upstreamID
+	}
+	return ""
+}
+
+// ResolveUpstream binds a stream route referencing an upstream by upstream_id to the service of the upstream,
+// so that it shares the subscription of the upstream and the nodes are also written to its own upstream.
+// ups is nil when the upstream is unknown, the stream route is then left without service discovery.
+// It does nothing for other entities.
+func (msg *Message) ResolveUpstream(ups *Message) {
+	routes, ok := msg.a6Conf.(*StreamRoutes)
+	if !ok || routes.upstreamID == "" {
+		return
+	}
+	ref := Upstream{}
+	if ups != nil && ServiceFilter(ups) {
+		ref.ServiceName, ref.DiscoveryType = ups.ServiceName(), ups.DiscoveryType()
+		ref.DiscoveryArgs = ups.a6Conf.GetUpstream().DiscoveryArgs
+	}
+	routes.resolve(ref)
+	routes.referenced = &ref
+}
+
+// Clone returns a copy of the entity parsed from its value again, without the changes made afterwards,
+// e.g. the injected nodes. It is safe to call concurrently.
+func (msg *Message) Clone() (*Message, error) {
+	if msg.a6Conf == nil {
+		return nil, fmt.Errorf("entity %s has no value", msg.Key)
+	}
+	cloned, err := NewMessage(msg.Key, []byte(msg.Value), msg.Version, msg.Action, msg.a6Type)
+	if err != nil {
+		return nil, err
+	}
+	cloned.Target = msg.Target
+	if routes, ok := msg.a6Conf.(*StreamRoutes); ok && routes.referenced != nil {
+		cloned.a6Conf.(*StreamRoutes).resolve(*routes.referenced)
+		cloned.a6Conf.(*StreamRoutes).referenced = routes.referenced
+	}
+	return cloned, nil
+}
+
+// WithNodes returns a copy of the entity with the nodes injected, the entity itself is left untouched, see Clone
+func (msg *Message) WithNodes(nodes interface{}) (*Message, error) {
+	rendered, err := msg.Clone()
+	if err != nil {
+		return nil, err
+	}
+	rendered.InjectNodes(nodes)
+	return rendered, nil
+}
+
+// NodesFormat returns the format of the nodes written to the entity, see Options
+func (msg *Message) NodesFormat() string {
+	up := msg.a6Conf.GetUpstream()
+	return up.nodesFormat()
+}
+
+// FormatNodes returns the nodes in the format written to the entity
+func (msg *Message) FormatNodes(nodes []*Node) interface{} {
+	return FormatNodes(nodes, msg.NodesFormat())
+}
+
+// NodesWritten reports whether the value already holds the nodes in the format of the entity,
+// hash is the content hash of the nodes, see HashNodes
+func (msg *Message) NodesWritten(nodes []*Node, hash string) bool {
+	format := msg.NodesFormat()
+	if NodesFormatOf(msg.Nodes()) != format {
+		return false
+	}
+	if format == NodesFormatHash {
+		// the hash format keeps no metadata
+		hash = HashNodes(FormatNodes(nodes, format))
+	}
+	return HashNodes(msg.Nodes()) == hash
+}
+
 func (msg *Message) HasNodesAttr() bool {
 	return msg.a6Conf.HasNodesAttr()
 }
@@ -85,6 +191,101 @@ func (msg *Message) Marshal() ([]byte, error) {
 	return msg.a6Conf.Marshal()
 }
 
+// SeedOwned reports whether the value has been rewritten by apisix-seed, in either write mode
+func (msg *Message) SeedOwned() bool {
+	up := msg.a6Conf.GetUpstream()
+	if routes, ok := msg.a6Conf.(*StreamRoutes); ok && routes.upstreamID != "" {
+		up = routes.inline
+	}
+	return up.DupServiceName != "" || up.DupDiscoveryType != "" || up.Seed != nil
+}
+
+// Written reports whether the value is in the form written by apisix-seed in the current write mode
+func (msg *Message) Written() bool {
+	if msg.a6Conf == nil {
+		return false
+	}
+	up := msg.a6Conf.GetUpstream()
+	if CurrentOptions().WriteMode == WriteModeAnnotation {
+		return up.Seed != nil && up.DupServiceName == "" && up.DupDiscoveryType == ""
+	}
+	return up.ServiceName == "" && up.DiscoveryType == "" && up.Seed == nil &&
+		up.DupServiceName != "" && up.DupDiscoveryType != ""
+}
+
+// Restore returns the operator-authored form of the value by reverting the seed-owned fields.
+// The renamed discovery fields are renamed back when rename is true, otherwise they are removed.
+// The injected nodes are removed when dropNodes is true.
+func (msg *Message) Restore(rename, dropNodes bool) (string, error) {
+	all := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(msg.Value), &all); err != nil {
+		return "", err
+	}
+
+	up := all
+	if _, ok := msg.a6Conf.(*Upstreams); !ok {
+		up, _ = all["upstream"].(map[string]interface{})
+		if up == nil {
+			return msg.Value, nil
+		}
+	}
+	referenced := msg.UpstreamID() != ""
+	if referenced {
+		// the discovery of a stream route referencing an upstream is the one of the upstream, see ResolveUpstream
+		rename = false
+		delete(up, "discovery_args")
+	}
+
+	for _, field := range []string{"service_name", "discovery_type"} {
+		val, ok := up["_"+field]
+		if !ok {
+			continue
+		}
+		if _, ok = up[field]; rename && !ok {
+			up[field] = val
+		}
+		delete(up, "_"+field)
+	}
+	delete(up, "_seed")
+	if dropNodes {
+		delete(up, "nodes")
+	}
+	if referenced && len(up) == 0 {
+		delete(all, "upstream")
+	}
+
+	bs, err := json.Marshal(all)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// NodesLen returns the number of nodes, which may be either an array or a hash
+func NodesLen(nodes interface{}) int {
+	v := reflect.Indirect(reflect.ValueOf(nodes))
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len()
+	default:
+		return 0
+	}
+}
+
+// SameNodes reports whether two node sets are semantically equal regardless of their Go types
+func SameNodes(nodes, newNodes interface{}) bool {
+	var v, newV interface{}
+	bs, err := json.Marshal(nodes)
+	if err != nil || json.Unmarshal(bs, &v) != nil {
+		return false
+	}
+	bs, err = json.Marshal(newNodes)
+	if err != nil || json.Unmarshal(bs, &newV) != nil {
+		return false
+	}
+	return reflect.DeepEqual(v, newV)
+}
+
 func ServiceFilter(msg *Message) bool {
 	if msg.ServiceName() != "" && msg.DiscoveryType() != "" {
 		return true
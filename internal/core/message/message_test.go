@@ -172,3 +172,146 @@ func TestServiceReplace(t *testing.T) {
 		assert.Equal(t, tc.ret, ServiceReplace(msg, newMsg), tc.desc)
 	}
 }
+
+func TestRestore(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		value     string
+		a6Type    int
+		rename    bool
+		dropNodes bool
+		want      string
+	}{
+		{
+			desc:      "decommission route",
+			value:     `{"uri":"/hh","upstream":{"_discovery_type":"nacos","_service_name":"APISIX-NACOS","nodes":[{"host":"1.1.1.1","port":80,"weight":1}]}}`,
+			a6Type:    A6RoutesConf,
+			rename:    true,
+			dropNodes: true,
+			want:      `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS"}}`,
+		},
+		{
+			desc:      "decommission upstream",
+			value:     `{"_discovery_type":"nacos","_service_name":"APISIX-NACOS","nodes":[{"host":"1.1.1.1","port":80,"weight":1}]}`,
+			a6Type:    A6UpstreamsConf,
+			rename:    true,
+			dropNodes: true,
+			want:      `{"discovery_type":"nacos","service_name":"APISIX-NACOS"}`,
+		},
+		{
+			desc:   "leave discovery with operator nodes",
+			value:  `{"uri":"/hh","upstream":{"_service_name":"APISIX-NACOS","nodes":[{"host":"2.2.2.2","port":80,"weight":1}]}}`,
+			a6Type: A6RoutesConf,
+			want:   `{"uri":"/hh","upstream":{"nodes":[{"host":"2.2.2.2","port":80,"weight":1}]}}`,
+		},
+		{
+			desc:      "decommission annotated route",
+			value:     `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS","_seed":{"discoverer":"nacos"},"nodes":[]}}`,
+			a6Type:    A6RoutesConf,
+			rename:    true,
+			dropNodes: true,
+			want:      `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"APISIX-NACOS"}}`,
+		},
+		{
+			desc:      "decommission stream route referencing an upstream",
+			value:     `{"server_port":9100,"upstream_id":1,"upstream":{"_discovery_type":"nacos","_service_name":"APISIX-NACOS","discovery_args":{"group_name":"DEFAULT_GROUP"},"nodes":[]}}`,
+			a6Type:    A6StreamRoutesConf,
+			rename:    true,
+			dropNodes: true,
+			want:      `{"server_port":9100,"upstream_id":1}`,
+		},
+		{
+			desc:   "without upstream",
+			value:  `{"uri":"/hh","upstream_id":"1"}`,
+			a6Type: A6RoutesConf,
+			rename: true,
+			want:   `{"uri":"/hh","upstream_id":"1"}`,
+		},
+	}
+	for _, tc := range testCases {
+		msg, err := NewMessage("/apisix/routes/a", []byte(tc.value), 1, EventAdd, tc.a6Type)
+		assert.Nil(t, err, tc.desc)
+		value, err := msg.Restore(tc.rename, tc.dropNodes)
+		assert.Nil(t, err, tc.desc)
+		assert.JSONEq(t, tc.want, value, tc.desc)
+	}
+}
+
+func TestResolveUpstream(t *testing.T) {
+	ups, err := NewMessage("/apisix/upstreams/1",
+		[]byte(`{"_service_name":"APISIX-NACOS","_discovery_type":"nacos","discovery_args":{"group_name":"DEFAULT_GROUP"}}`),
+		1, EventAdd, A6UpstreamsConf)
+	assert.Nil(t, err)
+
+	caseDesc := "unresolved"
+	msg, err := NewMessage("/apisix/stream_routes/1", []byte(`{"server_port":9100,"upstream_id":1}`), 1, EventAdd, A6StreamRoutesConf)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, "1", msg.UpstreamID(), caseDesc)
+	assert.False(t, ServiceFilter(msg), caseDesc)
+
+	caseDesc = "bound to the service of the upstream"
+	msg.ResolveUpstream(ups)
+	assert.True(t, ServiceFilter(msg), caseDesc)
+	assert.Equal(t, "APISIX-NACOS", msg.ServiceName(), caseDesc)
+	assert.Equal(t, "nacos", msg.DiscoveryType(), caseDesc)
+	assert.Equal(t, "DEFAULT_GROUP", msg.DiscoveryArgs()["group_name"], caseDesc)
+	assert.False(t, msg.Written(), caseDesc)
+
+	caseDesc = "the nodes are written to the stream route"
+	rendered, err := msg.WithNodes([]*Node{{Host: "1.1.1.1", Port: 80, Weight: 1}})
+	assert.Nil(t, err, caseDesc)
+	bs, err := rendered.Marshal()
+	assert.Nil(t, err, caseDesc)
+	assert.JSONEq(t, `{"server_port":9100,"upstream_id":1,"upstream":{"_service_name":"APISIX-NACOS","_discovery_type":"nacos",
+"discovery_args":{"group_name":"DEFAULT_GROUP"},"nodes":[{"host":"1.1.1.1","port":80,"weight":1}]}}`, string(bs), caseDesc)
+
+	caseDesc = "written by apisix-seed"
+	written, err := NewMessage(msg.Key, bs, 2, EventAdd, A6StreamRoutesConf)
+	assert.Nil(t, err, caseDesc)
+	assert.False(t, ServiceFilter(written), caseDesc)
+	assert.True(t, written.SeedOwned(), caseDesc)
+	written.ResolveUpstream(ups)
+	assert.True(t, written.Written(), caseDesc)
+
+	caseDesc = "the upstream leaves service discovery"
+	written.ResolveUpstream(nil)
+	assert.False(t, ServiceFilter(written), caseDesc)
+	assert.True(t, written.SeedOwned(), caseDesc)
+
+	caseDesc = "not a stream route"
+	assert.Equal(t, "", ups.UpstreamID(), caseDesc)
+	ups.ResolveUpstream(nil)
+	assert.True(t, ServiceFilter(ups), caseDesc)
+}
+
+func TestSameNodes(t *testing.T) {
+	msg, err := NewMessage("/apisix/routes/a",
+		[]byte(`{"uri":"/hh","upstream":{"nodes":[{"host":"1.1.1.1","port":80,"weight":1}]}}`), 1, EventAdd, A6RoutesConf)
+	assert.Nil(t, err)
+
+	assert.True(t, SameNodes(msg.Nodes(), []*Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}))
+	assert.False(t, SameNodes(msg.Nodes(), []*Node{{Host: "1.1.1.1", Port: 81, Weight: 1}}))
+}
+
+func TestWithNodes(t *testing.T) {
+	givenA6Str := `{"id":"1","nodes":{"1.1.1.1:80":1},"discovery_type":"nacos","service_name":"APISIX-NACOS"}`
+	msg, err := NewMessage("/apisix/upstreams/1", []byte(givenA6Str), 2, EventAdd, A6UpstreamsConf)
+	assert.Nil(t, err)
+	msg.Target = "bu1"
+
+	rendered, err := msg.WithNodes([]*Node{{Host: "1.1.1.2", Port: 80, Weight: 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, "bu1:/apisix/upstreams/1", rendered.ID())
+	assert.Equal(t, int64(2), rendered.Version)
+	bs, err := rendered.Marshal()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id":"1","nodes":[{"host":"1.1.1.2","port":80,"weight":1}],"_discovery_type":"nacos","_service_name":"APISIX-NACOS"}`, string(bs))
+
+	caseDesc := "the entity is untouched"
+	assert.True(t, SameNodes(map[string]interface{}{"1.1.1.1:80": 1}, msg.Nodes()), caseDesc)
+	assert.Equal(t, givenA6Str, msg.Value, caseDesc)
+
+	caseDesc = "no value"
+	_, err = (&Message{Key: "/apisix/upstreams/2"}).WithNodes(nil)
+	assert.EqualError(t, err, "entity /apisix/upstreams/2 has no value", caseDesc)
+}
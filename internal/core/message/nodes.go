@@ -0,0 +1,136 @@
+package message
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NormalizeNodes returns a copy of the nodes ordered by host and port, the nodes sharing the same host and port
+// are merged into the first one with the weight decided by the merge policy, see Options.
+// Registries return the nodes in any order, so that the same set would produce different values otherwise.
+func NormalizeNodes(nodes []*Node) []*Node {
+	merge := CurrentOptions().NodesMerge
+
+	normalized := make([]*Node, 0, len(nodes))
+	seen := make(map[string]*Node, len(nodes))
+	for _, node := range nodes {
+		addr := node.Host + ":" + strconv.Itoa(node.Port)
+		if first, ok := seen[addr]; ok {
+			switch merge {
+			case NodesMergeSum:
+				first.Weight += node.Weight
+			case NodesMergeMax:
+				if node.Weight > first.Weight {
+					first.Weight = node.Weight
+				}
+			}
+			continue
+		}
+		n := *node
+		seen[addr] = &n
+		normalized = append(normalized, &n)
+	}
+	sort.SliceStable(normalized, func(i, j int) bool {
+		if normalized[i].Host != normalized[j].Host {
+			return normalized[i].Host < normalized[j].Host
+		}
+		return normalized[i].Port < normalized[j].Port
+	})
+	return normalized
+}
+
+// FormatNodes returns the nodes in the format written to APISIX, see Options.
+// In the hash format, the IPv6 hosts are enclosed in brackets and the port is omitted when it is unset.
+func FormatNodes(nodes []*Node, format string) interface{} {
+	if format != NodesFormatHash {
+		return nodes
+	}
+	hash := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		hash[nodeAddr(node.Host, node.Port)] = node.Weight
+	}
+	return hash
+}
+
+func nodeAddr(host string, port int) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == 0 {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ParseNodes parses the nodes of a value, which may be either an array of nodes or a hash of "host:port" to weight
+func ParseNodes(nodes interface{}) ([]*Node, error) {
+	if nodes == nil {
+		return nil, nil
+	}
+	bs, err := json.Marshal(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(bs), []byte("{")) {
+		var parsed []*Node
+		if err = json.Unmarshal(bs, &parsed); err != nil {
+			return nil, err
+		}
+		return parsed, nil
+	}
+
+	var hash map[string]int
+	if err = json.Unmarshal(bs, &hash); err != nil {
+		return nil, err
+	}
+	parsed := make([]*Node, 0, len(hash))
+	for addr, weight := range hash {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			// the port is optional
+			parsed = append(parsed, &Node{Host: strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), Weight: weight})
+			continue
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, &Node{Host: host, Port: p, Weight: weight})
+	}
+	return parsed, nil
+}
+
+// NodesFormatOf returns the format of the nodes of a value, or an empty string when they are missing
+func NodesFormatOf(nodes interface{}) string {
+	switch reflect.Indirect(reflect.ValueOf(nodes)).Kind() {
+	case reflect.Map:
+		return NodesFormatHash
+	case reflect.Slice, reflect.Array:
+		return NodesFormatArray
+	default:
+		return ""
+	}
+}
+
+// HashNodes returns the content hash of the normalized nodes in either format,
+// or an empty string when they are missing or not parseable
+func HashNodes(nodes interface{}) string {
+	parsed, err := ParseNodes(nodes)
+	if err != nil || parsed == nil {
+		return ""
+	}
+	bs, err := json.Marshal(NormalizeNodes(parsed))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
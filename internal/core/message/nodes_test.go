@@ -0,0 +1,209 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeNodes(t *testing.T) {
+	givenNodes := []*Node{
+		{Host: "1.1.1.2", Port: 80, Weight: 1},
+		{Host: "1.1.1.1", Port: 81, Weight: 1},
+		{Host: "1.1.1.1", Port: 80, Weight: 2, Metadata: "first"},
+		{Host: "1.1.1.1", Port: 80, Weight: 3},
+	}
+	defer SetOptions(DefaultOptions())
+
+	tests := []struct {
+		caseDesc string
+		merge    string
+		want     []*Node
+	}{
+		{
+			caseDesc: "max",
+			merge:    NodesMergeMax,
+			want: []*Node{
+				{Host: "1.1.1.1", Port: 80, Weight: 3, Metadata: "first"},
+				{Host: "1.1.1.1", Port: 81, Weight: 1},
+				{Host: "1.1.1.2", Port: 80, Weight: 1},
+			},
+		},
+		{
+			caseDesc: "sum",
+			merge:    NodesMergeSum,
+			want: []*Node{
+				{Host: "1.1.1.1", Port: 80, Weight: 5, Metadata: "first"},
+				{Host: "1.1.1.1", Port: 81, Weight: 1},
+				{Host: "1.1.1.2", Port: 80, Weight: 1},
+			},
+		},
+		{
+			caseDesc: "first",
+			merge:    NodesMergeFirst,
+			want: []*Node{
+				{Host: "1.1.1.1", Port: 80, Weight: 2, Metadata: "first"},
+				{Host: "1.1.1.1", Port: 81, Weight: 1},
+				{Host: "1.1.1.2", Port: 80, Weight: 1},
+			},
+		},
+	}
+	for _, tc := range tests {
+		opts := DefaultOptions()
+		opts.NodesMerge = tc.merge
+		SetOptions(opts)
+		assert.Equal(t, tc.want, NormalizeNodes(givenNodes), tc.caseDesc)
+	}
+	assert.Equal(t, 2, givenNodes[2].Weight, "the nodes given are untouched")
+}
+
+func TestHashNodes(t *testing.T) {
+	nodes := []*Node{{Host: "1.1.1.1", Port: 80, Weight: 1}, {Host: "1.1.1.2", Port: 80, Weight: 1}}
+	hash := HashNodes(nodes)
+	assert.NotEmpty(t, hash)
+
+	caseDesc := "the order does not matter"
+	assert.Equal(t, hash, HashNodes([]*Node{nodes[1], nodes[0]}), caseDesc)
+
+	caseDesc = "parsed from a value"
+	msg, err := NewMessage("/apisix/upstreams/1",
+		[]byte(`{"nodes":[{"host":"1.1.1.2","port":80,"weight":1},{"host":"1.1.1.1","port":80,"weight":1}]}`),
+		1, EventAdd, A6UpstreamsConf)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, hash, HashNodes(msg.Nodes()), caseDesc)
+
+	caseDesc = "weights matter"
+	assert.NotEqual(t, hash, HashNodes([]*Node{{Host: "1.1.1.1", Port: 80, Weight: 2}, nodes[1]}), caseDesc)
+
+	caseDesc = "hash format"
+	assert.Equal(t, hash, HashNodes(map[string]interface{}{"1.1.1.2:80": 1, "1.1.1.1:80": 1}), caseDesc)
+
+	caseDesc = "missing"
+	assert.Equal(t, "", HashNodes(nil), caseDesc)
+}
+
+func TestFormatNodes(t *testing.T) {
+	nodes := []*Node{
+		{Host: "1.1.1.1", Port: 80, Weight: 1, Metadata: "dropped"},
+		{Host: "::1", Port: 80, Weight: 2},
+		{Host: "[fe80::1]", Port: 8080, Weight: 3},
+		{Host: "example.com", Weight: 4},
+		{Host: "::2", Weight: 5},
+	}
+
+	caseDesc := "array"
+	assert.Equal(t, nodes, FormatNodes(nodes, NodesFormatArray), caseDesc)
+
+	caseDesc = "hash"
+	hash := FormatNodes(nodes, NodesFormatHash)
+	assert.Equal(t, map[string]int{
+		"1.1.1.1:80":     1,
+		"[::1]:80":       2,
+		"[fe80::1]:8080": 3,
+		"example.com":    4,
+		"[::2]":          5,
+	}, hash, caseDesc)
+
+	caseDesc = "parse hash"
+	parsed, err := ParseNodes(hash)
+	assert.Nil(t, err, caseDesc)
+	assert.ElementsMatch(t, []*Node{
+		{Host: "1.1.1.1", Port: 80, Weight: 1},
+		{Host: "::1", Port: 80, Weight: 2},
+		{Host: "fe80::1", Port: 8080, Weight: 3},
+		{Host: "example.com", Weight: 4},
+		{Host: "::2", Weight: 5},
+	}, parsed, caseDesc)
+
+	caseDesc = "parse array"
+	parsed, err = ParseNodes([]interface{}{map[string]interface{}{"host": "1.1.1.1", "port": 80, "weight": 1}})
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, []*Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}, parsed, caseDesc)
+
+	caseDesc = "parse invalid port"
+	_, err = ParseNodes(map[string]interface{}{"1.1.1.1:http": 1})
+	assert.NotNil(t, err, caseDesc)
+}
+
+func TestNodesWritten(t *testing.T) {
+	defer SetOptions(DefaultOptions())
+	nodes := []*Node{{Host: "1.1.1.1", Port: 80, Weight: 1, Metadata: "dropped"}}
+	hash := HashNodes(nodes)
+
+	tests := []struct {
+		caseDesc string
+		format   string
+		value    string
+		want     bool
+	}{
+		{
+			caseDesc: "array written",
+			format:   NodesFormatArray,
+			value:    `{"nodes":[{"host":"1.1.1.1","port":80,"weight":1,"metadata":"dropped"}]}`,
+			want:     true,
+		},
+		{
+			caseDesc: "hash written",
+			format:   NodesFormatHash,
+			value:    `{"nodes":{"1.1.1.1:80":1}}`,
+			want:     true,
+		},
+		{
+			caseDesc: "array to hash",
+			format:   NodesFormatHash,
+			value:    `{"nodes":[{"host":"1.1.1.1","port":80,"weight":1,"metadata":"dropped"}]}`,
+			want:     false,
+		},
+		{
+			caseDesc: "overridden by the upstream",
+			format:   NodesFormatHash,
+			value: `{"nodes":[{"host":"1.1.1.1","port":80,"weight":1,"metadata":"dropped"}],` +
+				`"discovery_args":{"nodes_format":"array"}}`,
+			want: true,
+		},
+		{
+			caseDesc: "weights changed",
+			format:   NodesFormatHash,
+			value:    `{"nodes":{"1.1.1.1:80":2}}`,
+			want:     false,
+		},
+	}
+	for _, tc := range tests {
+		opts := DefaultOptions()
+		opts.NodesFormat = tc.format
+		SetOptions(opts)
+		msg, err := NewMessage("/apisix/upstreams/1", []byte(tc.value), 1, EventAdd, A6UpstreamsConf)
+		assert.Nil(t, err, tc.caseDesc)
+		assert.Equal(t, tc.want, msg.NodesWritten(nodes, hash), tc.caseDesc)
+	}
+}
+
+func TestInjectNodesFormat(t *testing.T) {
+	defer SetOptions(DefaultOptions())
+	opts := DefaultOptions()
+	opts.NodesFormat = NodesFormatHash
+	SetOptions(opts)
+	nodes := []*Node{{Host: "::1", Port: 80, Weight: 1}}
+
+	caseDesc := "global format"
+	msg, err := NewMessage("/apisix/upstreams/1", []byte(`{"service_name":"svc","discovery_type":"nacos"}`),
+		1, EventAdd, A6UpstreamsConf)
+	assert.Nil(t, err, caseDesc)
+	rendered, err := msg.WithNodes(nodes)
+	assert.Nil(t, err, caseDesc)
+	bs, err := rendered.Marshal()
+	assert.Nil(t, err, caseDesc)
+	assert.Contains(t, string(bs), `"nodes":{"[::1]:80":1}`, caseDesc)
+
+	caseDesc = "overridden by the upstream"
+	msg, err = NewMessage("/apisix/upstreams/1",
+		[]byte(`{"service_name":"svc","discovery_type":"nacos","discovery_args":{"nodes_format":"array"}}`),
+		1, EventAdd, A6UpstreamsConf)
+	assert.Nil(t, err, caseDesc)
+	rendered, err = msg.WithNodes(nodes)
+	assert.Nil(t, err, caseDesc)
+	bs, err = rendered.Marshal()
+	assert.Nil(t, err, caseDesc)
+	assert.Contains(t, string(bs), `"nodes":[{"host":"::1","port":80,"weight":1}]`, caseDesc)
+	assert.Contains(t, string(bs), `"nodes_format":"array"`, caseDesc)
+}
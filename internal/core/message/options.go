@@ -0,0 +1,67 @@
+package message
+
+import "sync/atomic"
+
+// write modes, see Options
+const (
+	// WriteModeRename renames service_name/discovery_type to _service_name/_discovery_type in the written value
+	WriteModeRename = "rename"
+	// WriteModeAnnotation keeps the operator's fields and records the ownership in the `_seed` annotation
+	WriteModeAnnotation = "annotation"
+)
+
+// APISIX versions, see Options
+const (
+	APISIXVersionAuto = "auto"
+	APISIXVersion2    = "2"
+	APISIXVersion3    = "3"
+)
+
+// policies to merge the weights of the nodes sharing the same host and port, see NormalizeNodes
+const (
+	NodesMergeMax   = "max"
+	NodesMergeSum   = "sum"
+	NodesMergeFirst = "first"
+)
+
+// formats of the nodes written to APISIX, see FormatNodes
+const (
+	NodesFormatArray = "array"
+	NodesFormatHash  = "hash"
+)
+
+// Options decide how the entities are written. They are taken from the configuration by the caller, see SetOptions.
+type Options struct {
+	WriteMode string
+	// APISIXVersion other than 2 refreshes update_time on every write, and tolerates an empty directory in etcd
+	APISIXVersion string
+	NodesMerge    string
+	// NodesFormat is overridden by `discovery_args.nodes_format` of an upstream
+	NodesFormat string
+}
+
+// DefaultOptions are used until SetOptions is called
+func DefaultOptions() Options {
+	return Options{
+		WriteMode:     WriteModeRename,
+		APISIXVersion: APISIXVersionAuto,
+		NodesMerge:    NodesMergeMax,
+		NodesFormat:   NodesFormatArray,
+	}
+}
+
+// options are replaced as a whole, as the entities are rendered by the Rewriters while the configuration is reloaded
+var options atomic.Value
+
+// SetOptions replaces the options, the entities rendered afterwards use the new ones
+func SetOptions(opts Options) {
+	options.Store(opts)
+}
+
+// CurrentOptions returns the options the entities are rendered with
+func CurrentOptions() Options {
+	if opts, ok := options.Load().(Options); ok {
+		return opts
+	}
+	return DefaultOptions()
+}
@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+)
+
+// Snapshot is the node set of a service at a moment. It is shared by all readers and never modified,
+// a new Snapshot is published when the service changes.
+type Snapshot struct {
+	// Service is the key of the service, see Key
+	Service string
+	// Nodes are normalized, see message.NormalizeNodes
+	Nodes []*message.Node
+	// Hash is the content hash of the nodes, see message.HashNodes
+	Hash string
+}
+
+type service struct {
+	snapshot *Snapshot
+	// entities bound to the service by ID, see message.ID
+	entities map[string]*message.Message
+}
+
+var (
+	// hubMutex guards services and bindings, which are changed by discoverers and read by the Rewriters
+	hubMutex sync.RWMutex
+	services = map[string]*service{}
+	// bindings: entity ID -> service key
+	bindings = map[string]string{}
+)
+
+// Key returns the key of a service across discoverers, e.g. nacos/@@APISIX-NACOS
+func Key(discoverer, id string) string {
+	return discoverer + "/" + id
+}
+
+// Bind binds the entity to a service, the previous binding of the entity is replaced.
+// The entity is kept as the latest form to render, it must not be modified afterwards.
+func Bind(key string, msg *message.Message) {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	if prev, ok := bindings[msg.ID()]; ok && prev != key {
+		unbind(prev, msg.ID())
+	}
+	svc, ok := services[key]
+	if !ok {
+		svc = &service{}
+		services[key] = svc
+	}
+	if svc.entities == nil {
+		svc.entities = make(map[string]*message.Message)
+	}
+	svc.entities[msg.ID()] = msg
+	bindings[msg.ID()] = key
+}
+
+// Unbind removes the binding of the entity, and returns the key of the service it was bound to
+// with the number of the entities still bound to the service. The service is dropped when there is none.
+func Unbind(msg *message.Message) (string, int) {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	key, ok := bindings[msg.ID()]
+	if !ok {
+		return "", 0
+	}
+	return key, unbind(key, msg.ID())
+}
+
+func unbind(key, id string) int {
+	delete(bindings, id)
+	svc, ok := services[key]
+	if !ok {
+		return 0
+	}
+	delete(svc.entities, id)
+	if len(svc.entities) == 0 {
+		delete(services, key)
+	}
+	return len(svc.entities)
+}
+
+// Publish replaces the nodes of a service and returns the entities bound to it ordered by ID,
+// which are to be notified. The nodes are normalized into a copy, so the caller may reuse them.
+func Publish(key string, nodes []*message.Node) []*message.Message {
+	normalized := message.NormalizeNodes(nodes)
+	hash := message.HashNodes(normalized)
+
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	svc, ok := services[key]
+	if !ok {
+		svc = &service{}
+		services[key] = svc
+	}
+	svc.snapshot = &Snapshot{Service: key, Nodes: normalized, Hash: hash}
+
+	ids := make([]string, 0, len(svc.entities))
+	for id := range svc.entities {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	entities := make([]*message.Message, 0, len(ids))
+	for _, id := range ids {
+		entities = append(entities, svc.entities[id])
+	}
+	return entities
+}
+
+// Lookup returns the latest nodes of a service, false if they are unknown yet
+func Lookup(key string) (*Snapshot, bool) {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
+	svc, ok := services[key]
+	if !ok || svc.snapshot == nil {
+		return nil, false
+	}
+	return svc.snapshot, true
+}
+
+// Resolve returns the latest nodes of the service an entity is bound to
+func Resolve(id string) (*Snapshot, bool) {
+	hubMutex.RLock()
+	key, ok := bindings[id]
+	hubMutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return Lookup(key)
+}
+
+// Entities returns the IDs of the entities bound to a service in order
+func Entities(key string) []string {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
+	ids := make([]string, 0)
+	if svc, ok := services[key]; ok {
+		for id := range svc.entities {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Entity returns the latest form of the entity with the nodes of its service.
+// It returns false when the entity is no longer bound or the nodes of its service are unknown yet.
+func Entity(id string) (*message.Message, *Snapshot, bool) {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
+	key, ok := bindings[id]
+	if !ok {
+		return nil, nil, false
+	}
+	svc := services[key]
+	if svc.snapshot == nil {
+		return nil, nil, false
+	}
+	return svc.entities[id], svc.snapshot, true
+}
+
+// Render returns a copy of the latest form of the entity with the nodes of its service injected,
+// see Entity
+func Render(id string) (*message.Message, bool, error) {
+	msg, snapshot, ok := Entity(id)
+	if !ok {
+		return nil, false, nil
+	}
+	rendered, err := msg.WithNodes(snapshot.Nodes)
+	if err != nil {
+		return nil, false, err
+	}
+	return rendered, true, nil
+}
+
+// Clear drops all services and bindings
+func Clear() {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	services = map[string]*service{}
+	bindings = map[string]string{}
+}
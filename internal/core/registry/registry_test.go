@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+)
+
+func newMsg(t *testing.T, key, service string) *message.Message {
+	a6Str := `{"uri":"/hh","upstream":{"discovery_type":"nacos","service_name":"` + service + `"}}`
+	msg, err := message.NewMessage(key, []byte(a6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	return msg
+}
+
+func TestRegistry(t *testing.T) {
+	defer Clear()
+	givenNodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	nacos, backup := Key("nacos", "@@APISIX-NACOS"), Key("nacos", "@@APISIX-BACKUP")
+	msg1 := newMsg(t, "/apisix/routes/1", "APISIX-NACOS")
+	msg2 := newMsg(t, "/apisix/routes/2", "APISIX-NACOS")
+
+	caseDesc := "publish to the bound entities"
+	Bind(nacos, msg2)
+	Bind(nacos, msg1)
+	assert.Equal(t, []*message.Message{msg1, msg2}, Publish(nacos, givenNodes), caseDesc)
+	assert.Equal(t, []string{"/apisix/routes/1", "/apisix/routes/2"}, Entities(nacos), caseDesc)
+
+	caseDesc = "nodes are copied"
+	givenNodes[0].Port = 81
+	snapshot, ok := Resolve(msg1.ID())
+	assert.True(t, ok, caseDesc)
+	assert.Equal(t, nacos, snapshot.Service, caseDesc)
+	assert.Equal(t, 80, snapshot.Nodes[0].Port, caseDesc)
+
+	caseDesc = "render a copy"
+	rendered, ok, err := Render(msg1.ID())
+	assert.Nil(t, err, caseDesc)
+	assert.True(t, ok, caseDesc)
+	assert.True(t, message.SameNodes(snapshot.Nodes, rendered.Nodes()), caseDesc)
+	assert.Nil(t, msg1.Nodes(), caseDesc)
+
+	caseDesc = "render the latest form"
+	updated := newMsg(t, "/apisix/routes/1", "APISIX-NACOS")
+	updated.Version = 2
+	Bind(nacos, updated)
+	rendered, _, _ = Render(msg1.ID())
+	assert.Equal(t, int64(2), rendered.Version, caseDesc)
+
+	caseDesc = "move to another service"
+	Bind(backup, msg2)
+	assert.Equal(t, []string{"/apisix/routes/1"}, Entities(nacos), caseDesc)
+	_, ok, _ = Render(msg2.ID())
+	assert.False(t, ok, caseDesc)
+
+	caseDesc = "unbind"
+	key, remaining := Unbind(msg1)
+	assert.Equal(t, nacos, key, caseDesc)
+	assert.Equal(t, 0, remaining, caseDesc)
+	_, ok = Lookup(nacos)
+	assert.False(t, ok, caseDesc)
+	key, _ = Unbind(msg1)
+	assert.Equal(t, "", key, caseDesc)
+	_, ok, _ = Render(msg1.ID())
+	assert.False(t, ok, caseDesc)
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	defer Clear()
+	key := Key("nacos", "@@APISIX-NACOS")
+	msg := newMsg(t, "/apisix/routes/1", "APISIX-NACOS")
+	Bind(key, msg)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			Publish(key, []*message.Node{{Host: "1.1.1.1", Port: 80 + i, Weight: 1}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if rendered, ok, err := Render(msg.ID()); ok {
+				assert.Nil(t, err)
+				_, err = rendered.Marshal()
+				assert.Nil(t, err)
+			}
+		}
+	}()
+	wg.Wait()
+	assert.Nil(t, msg.Nodes())
+}
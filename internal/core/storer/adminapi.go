@@ -0,0 +1,263 @@
+package storer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/api7/gopkg/pkg/log"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/metrics"
+)
+
+var errNotFound = errors.New("not found")
+
+// adminNode is a resource returned by the APISIX Admin API
+type adminNode struct {
+	Key           string          `json:"key"`
+	Value         json.RawMessage `json:"value"`
+	ModifiedIndex int64           `json:"modifiedIndex"`
+}
+
+// adminResp is compatible with the responses of both APISIX 2.x and 3.x
+type adminResp struct {
+	adminNode
+	// APISIX 2.x wraps resources in `node`, an empty directory holds `"nodes": {}`
+	Node *struct {
+		adminNode
+		Nodes json.RawMessage `json:"nodes"`
+	} `json:"node"`
+	// APISIX 3.x lists resources in `list`
+	List []*adminNode `json:"list"`
+}
+
+func (resp *adminResp) nodes() ([]*adminNode, error) {
+	if resp.List != nil {
+		return resp.List, nil
+	}
+
+	nodes := make([]*adminNode, 0)
+	if resp.Node == nil || !bytes.HasPrefix(bytes.TrimSpace(resp.Node.Nodes), []byte("[")) {
+		return nodes, nil
+	}
+	err := json.Unmarshal(resp.Node.Nodes, &nodes)
+	return nodes, err
+}
+
+func (resp *adminResp) node() *adminNode {
+	if resp.Node != nil {
+		return &resp.Node.adminNode
+	}
+	return &resp.adminNode
+}
+
+// AdminAPI reads and writes APISIX resources through the APISIX Admin API,
+// the modifiedIndex of resources is used as the message version
+type AdminAPI struct {
+	client   *http.Client
+	conf     *conf.AdminAPI
+	prefix   string
+	interval time.Duration
+}
+
+func NewAdminAPI(adminConf *conf.AdminAPI, prefix string) (*AdminAPI, error) {
+	if adminConf == nil || adminConf.Host == "" {
+		return nil, fmt.Errorf("admin api host can not be empty")
+	}
+
+	return &AdminAPI{
+		client: &http.Client{
+			Timeout: time.Duration(adminConf.Timeout) * time.Second,
+		},
+		conf:     adminConf,
+		prefix:   prefix,
+		interval: time.Duration(adminConf.WatchInterval) * time.Second,
+	}, nil
+}
+
+// url converts an etcd key like /apisix/routes/1 to the Admin API url
+func (s *AdminAPI) url(key string) string {
+	return s.conf.Host + s.conf.Prefix + strings.TrimPrefix(key, s.prefix)
+}
+
+func (s *AdminAPI) do(ctx context.Context, method, key string, body []byte) (*adminResp, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-KEY", s.conf.Key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, content)
+	}
+
+	ret := &adminResp{}
+	if err = json.Unmarshal(content, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// List the content of a given prefix
+func (s *AdminAPI) List(ctx context.Context, prefix string) ([]*message.Message, error) {
+	resp, err := s.do(ctx, http.MethodGet, strings.TrimSuffix(prefix, "/"), nil)
+	if err == errNotFound {
+		return []*message.Message{}, nil
+	}
+	if err != nil {
+		log.Errorf("admin api list prefix[%s] failed: %s", prefix, err)
+		return nil, fmt.Errorf("admin api list prefix[%s] failed: %s", prefix, err)
+	}
+
+	nodes, err := resp.nodes()
+	if err != nil {
+		log.Errorf("admin api list prefix[%s] format failed: %s", prefix, err)
+		return nil, fmt.Errorf("admin api list prefix[%s] format failed: %s", prefix, err)
+	}
+
+	msgs := make([]*message.Message, 0, len(nodes))
+	for _, node := range nodes {
+		msg, err := message.NewMessage(node.Key, node.Value, node.ModifiedIndex, message.EventAdd, message.ToA6Type(prefix))
+		if err != nil {
+			log.Errorf("admin api list prefix[%s] format failed: %s", prefix, err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// Update a value at the specified key.
+// The Admin API has no compare-and-swap, so the version is checked right before writing, and a write landing
+// between the check and the PUT is overwritten. The key is read again after the PUT to narrow the window:
+// a version other than the written one means another write followed, which the watch delivers.
+func (s *AdminAPI) Update(ctx context.Context, key, value string, version int64) error {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		metrics.Rewrites.WithLabelValues(metrics.ResultFailure).Inc()
+		log.Errorf("admin api get key[%s] failed: %s", key, err)
+		return fmt.Errorf("admin api get key[%s] failed: %s", key, err)
+	}
+	if resp.node().ModifiedIndex != version {
+		metrics.Rewrites.WithLabelValues(metrics.ResultConflict).Inc()
+		log.Infof("key[%s] may have been updated by other instances", key)
+		return nil
+	}
+
+	if resp, err = s.do(ctx, http.MethodPut, key, []byte(value)); err != nil {
+		metrics.Rewrites.WithLabelValues(metrics.ResultFailure).Inc()
+		log.Errorf("admin api update key[%s] failed: %s", key, err)
+		return fmt.Errorf("admin api update key[%s] failed: %s", key, err)
+	}
+	written := resp.node().ModifiedIndex
+
+	resp, err = s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		metrics.Rewrites.WithLabelValues(metrics.ResultFailure).Inc()
+		log.Errorf("admin api verify key[%s] failed: %s", key, err)
+		return fmt.Errorf("admin api verify key[%s] failed: %s", key, err)
+	}
+	if resp.node().ModifiedIndex != written {
+		metrics.Rewrites.WithLabelValues(metrics.ResultConflict).Inc()
+		log.Infof("key[%s] has been updated by other instances after the update, version: %d", key, written)
+		return nil
+	}
+	metrics.Rewrites.WithLabelValues(metrics.ResultSuccess).Inc()
+	log.Infof("admin api update key[%s], version: %d", key, version)
+	return nil
+}
+
+// Watch for changes on a prefix by listing it periodically and diffing with the last result
+func (s *AdminAPI) Watch(ctx context.Context, prefix string) <-chan []*message.Message {
+	ch := make(chan []*message.Message, 1)
+
+	go func() {
+		defer close(ch)
+
+		versions := make(map[string]int64)
+		if msgs, err := s.List(ctx, prefix); err == nil {
+			for _, msg := range msgs {
+				versions[msg.Key] = msg.Version
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.interval):
+			}
+
+			msgs, err := s.List(ctx, prefix)
+			if err != nil {
+				continue
+			}
+
+			changes := make([]*message.Message, 0)
+			current := make(map[string]int64, len(msgs))
+			for _, msg := range msgs {
+				current[msg.Key] = msg.Version
+				if version, ok := versions[msg.Key]; !ok || version != msg.Version {
+					log.Infof("watch changed, key: %s, version: %d", msg.Key, msg.Version)
+					changes = append(changes, msg)
+				}
+			}
+			for key, version := range versions {
+				if _, ok := current[key]; ok {
+					continue
+				}
+				msg, err := message.NewMessage(key, nil, version, message.EventDelete, message.ToA6Type(prefix))
+				if err != nil {
+					continue
+				}
+				changes = append(changes, msg)
+			}
+			versions = current
+
+			if len(changes) == 0 {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- changes:
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Check whether the Admin API is reachable
+func (s *AdminAPI) Check(ctx context.Context) error {
+	_, err := s.do(ctx, http.MethodGet, s.prefix+"/routes", nil)
+	if err == nil || err == errNotFound {
+		return nil
+	}
+	return fmt.Errorf("admin api is unreachable: %s", err)
+}
@@ -0,0 +1,208 @@
+package storer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/metrics"
+)
+
+// fakeAdminAPI mimics the APISIX 3.x Admin API
+type fakeAdminAPI struct {
+	mutex    sync.Mutex
+	index    int64
+	values   map[string]string
+	versions map[string]int64
+	// number of the requests served
+	requests int
+	// afterPut is called with the mutex held once a PUT is answered, e.g. to write the key again as another instance
+	afterPut func(key string)
+}
+
+func newFakeAdminAPI() *fakeAdminAPI {
+	return &fakeAdminAPI{
+		values:   make(map[string]string),
+		versions: make(map[string]int64),
+	}
+}
+
+func (f *fakeAdminAPI) put(key, value string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.putLocked(key, value)
+}
+
+func (f *fakeAdminAPI) putLocked(key, value string) {
+	f.index++
+	f.values[key] = value
+	f.versions[key] = f.index
+}
+
+func (f *fakeAdminAPI) delete(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.values, key)
+	delete(f.versions, key)
+}
+
+func (f *fakeAdminAPI) node(key string) map[string]interface{} {
+	return map[string]interface{}{
+		"key":           key,
+		"value":         json.RawMessage(f.values[key]),
+		"modifiedIndex": f.versions[key],
+	}
+}
+
+func (f *fakeAdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-API-KEY") != "test-key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	key := "/apisix" + strings.TrimPrefix(r.URL.Path, "/apisix/admin")
+
+	if r.Method == http.MethodPut {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.put(key, string(body))
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests++
+	if r.Method == http.MethodPut && f.afterPut != nil {
+		defer f.afterPut(key)
+	}
+
+	if _, ok := f.values[key]; ok {
+		_ = json.NewEncoder(w).Encode(f.node(key))
+		return
+	}
+
+	list := make([]interface{}, 0)
+	for k := range f.values {
+		if strings.HasPrefix(k, key+"/") {
+			list = append(list, f.node(k))
+		}
+	}
+	if len(list) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"total": len(list),
+		"list":  list,
+	})
+}
+
+func newTestAdminAPI(t *testing.T) (*fakeAdminAPI, *AdminAPI, func()) {
+	fake := newFakeAdminAPI()
+	server := httptest.NewServer(fake)
+
+	client, err := NewAdminAPI(&conf.AdminAPI{
+		Host:          server.URL,
+		Key:           "test-key",
+		Prefix:        "/apisix/admin",
+		Timeout:       1,
+		WatchInterval: 1,
+	}, "/apisix")
+	assert.Nil(t, err)
+	return fake, client, server.Close
+}
+
+func TestAdminAPIListAndUpdate(t *testing.T) {
+	fake, client, closeFn := newTestAdminAPI(t)
+	defer closeFn()
+
+	caseDesc := "list empty prefix"
+	msgs, err := client.List(context.Background(), "/apisix/routes")
+	assert.Nil(t, err, caseDesc)
+	assert.Len(t, msgs, 0, caseDesc)
+
+	caseDesc = "list"
+	fake.put("/apisix/routes/1", getA6Conf("first"))
+	fake.put("/apisix/routes/2", getA6Conf("second"))
+	msgs, err = client.List(context.Background(), "/apisix/routes")
+	assert.Nil(t, err, caseDesc)
+	assert.Len(t, msgs, 2, caseDesc)
+	for _, msg := range msgs {
+		assert.Equal(t, "APISIX-NACOS", msg.ServiceName(), caseDesc)
+	}
+
+	caseDesc = "update with the latest version"
+	err = client.Update(context.Background(), "/apisix/routes/1", `{"uri":"/updated"}`, 1)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, `{"uri":"/updated"}`, fake.values["/apisix/routes/1"], caseDesc)
+
+	caseDesc = "update with a stale version"
+	err = client.Update(context.Background(), "/apisix/routes/2", `{"uri":"/stale"}`, 1)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, getA6Conf("second"), fake.values["/apisix/routes/2"], caseDesc)
+
+	caseDesc = "updated by another instance after the update"
+	fake.put("/apisix/routes/3", getA6Conf("third"))
+	fake.afterPut = func(key string) {
+		fake.afterPut = nil
+		fake.putLocked(key, `{"uri":"/other"}`)
+	}
+	conflicts := testutil.ToFloat64(metrics.Rewrites.WithLabelValues(metrics.ResultConflict))
+	err = client.Update(context.Background(), "/apisix/routes/3", `{"uri":"/updated"}`, fake.versions["/apisix/routes/3"])
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, `{"uri":"/other"}`, fake.values["/apisix/routes/3"], caseDesc)
+	assert.Equal(t, conflicts+1, testutil.ToFloat64(metrics.Rewrites.WithLabelValues(metrics.ResultConflict)), caseDesc)
+
+	caseDesc = "update a deleted key"
+	fake.delete("/apisix/routes/2")
+	err = client.Update(context.Background(), "/apisix/routes/2", `{"uri":"/deleted"}`, 2)
+	assert.NotNil(t, err, caseDesc)
+}
+
+func TestAdminAPIWatch(t *testing.T) {
+	fake, client, closeFn := newTestAdminAPI(t)
+	defer closeFn()
+
+	fake.put("/apisix/routes/1", getA6Conf("first"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := client.Watch(ctx, "/apisix/routes")
+	// wait for the first list
+	assert.Eventually(t, func() bool {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		return fake.requests > 0
+	}, time.Second, 10*time.Millisecond)
+
+	fake.put("/apisix/routes/2", getA6Conf("second"))
+	fake.delete("/apisix/routes/1")
+
+	select {
+	case msgs := <-ch:
+		assert.Len(t, msgs, 2)
+		for _, msg := range msgs {
+			switch msg.Key {
+			case "/apisix/routes/2":
+				assert.Equal(t, message.EventAdd, msg.Action)
+				assert.Equal(t, int64(2), msg.Version)
+			case "/apisix/routes/1":
+				assert.Equal(t, message.EventDelete, msg.Action)
+			default:
+				assert.Fail(t, "unexpected key "+msg.Key)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Test watch timeout reached")
+	}
+}
@@ -0,0 +1,121 @@
+package storer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/utils"
+)
+
+// DryRun wraps a storage and prints the diff of each update instead of writing it.
+// The current values are the ones seen by List and Watch.
+type DryRun struct {
+	stg Interface
+	out io.Writer
+
+	mutex   sync.Mutex
+	values  map[string]string
+	changed map[string]struct{}
+}
+
+func NewDryRun(stg Interface, out io.Writer) *DryRun {
+	return &DryRun{
+		stg:     stg,
+		out:     out,
+		values:  make(map[string]string),
+		changed: make(map[string]struct{}),
+	}
+}
+
+func (s *DryRun) List(ctx context.Context, prefix string) ([]*message.Message, error) {
+	msgs, err := s.stg.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.record(msgs)
+	return msgs, nil
+}
+
+// Update prints the diff between the current value and the value to write
+func (s *DryRun) Update(_ context.Context, key, value string, version int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lines := utils.DiffLines(indent(s.values[key]), indent(value))
+	if len(lines) == 0 {
+		return nil
+	}
+	s.changed[key] = struct{}{}
+
+	fmt.Fprintf(s.out, "--- %s (version %d)\n+++ %s\n%s\n", key, version, key, strings.Join(lines, "\n"))
+	return nil
+}
+
+func (s *DryRun) Watch(ctx context.Context, prefix string) <-chan []*message.Message {
+	ch := make(chan []*message.Message, 1)
+	go func() {
+		defer close(ch)
+
+		for msgs := range s.stg.Watch(ctx, prefix) {
+			s.record(msgs)
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- msgs:
+			}
+		}
+	}()
+	return ch
+}
+
+// Check checks the wrapped storage if it is a Checker
+func (s *DryRun) Check(ctx context.Context) error {
+	if checker, ok := s.stg.(Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// Close closes the wrapped storage if it is an io.Closer
+func (s *DryRun) Close() error {
+	if closer, ok := s.stg.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Changed returns the number of keys which would have been changed
+func (s *DryRun) Changed() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.changed)
+}
+
+func (s *DryRun) record(msgs []*message.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, msg := range msgs {
+		if msg.Action == message.EventDelete {
+			delete(s.values, msg.Key)
+			continue
+		}
+		s.values[msg.Key] = msg.Value
+	}
+}
+
+// indent formats a JSON value to compare it line by line
+func indent(value string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(value), "", "  "); err != nil {
+		return value
+	}
+	return buf.String()
+}
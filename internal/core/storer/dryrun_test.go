@@ -0,0 +1,47 @@
+package storer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+)
+
+func TestDryRun(t *testing.T) {
+	msg, err := message.NewMessage("/apisix/routes/1", []byte(`{"uri":"/hh","upstream":{"nodes":[]}}`),
+		1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	mStg := &MockInterface{}
+	mStg.On("List", mock.Anything, mock.Anything).Return([]*message.Message{msg}, nil)
+
+	out := &bytes.Buffer{}
+	dr := NewDryRun(mStg, out)
+	_, err = dr.List(context.Background(), "/apisix/routes")
+	assert.Nil(t, err)
+
+	caseDesc := "unchanged"
+	assert.Nil(t, dr.Update(context.Background(), "/apisix/routes/1", `{"uri":"/hh","upstream":{"nodes":[]}}`, 1), caseDesc)
+	assert.Equal(t, "", out.String(), caseDesc)
+	assert.Equal(t, 0, dr.Changed(), caseDesc)
+
+	caseDesc = "changed"
+	assert.Nil(t, dr.Update(context.Background(), "/apisix/routes/1", `{"uri":"/hh","upstream":{"nodes":{"1.1.1.1:80":1}}}`, 1), caseDesc)
+	assert.Equal(t, `--- /apisix/routes/1 (version 1)
++++ /apisix/routes/1
+ {
+   "uri": "/hh",
+   "upstream": {
+-    "nodes": []
++    "nodes": {
++      "1.1.1.1:80": 1
++    }
+   }
+ }
+`, out.String(), caseDesc)
+	assert.Equal(t, 1, dr.Changed(), caseDesc)
+	mStg.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything)
+}
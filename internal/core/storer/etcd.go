@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/api7/gopkg/pkg/log"
@@ -11,8 +12,8 @@ import (
 	"github.com/api7/apisix-seed/internal/core/message"
 
 	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/metrics"
 
-	"go.etcd.io/etcd/client/pkg/v3/transport"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 )
@@ -21,19 +22,31 @@ var (
 	DirPlaceholder = []byte("init_dir")
 )
 
+// isDirPlaceholder reports whether the kv marks the directory of prefix instead of holding a resource.
+// APISIX 2.x writes the placeholder to the directory key, while APISIX 3.x does not create directories.
+func isDirPlaceholder(prefix string, key, value []byte) bool {
+	dir := strings.TrimSuffix(prefix, "/")
+	if string(key) == dir || string(key) == dir+"/" {
+		return true
+	}
+	value = bytes.TrimSpace(value)
+	return bytes.Equal(value, DirPlaceholder) || bytes.Equal(bytes.Trim(value, `"`), DirPlaceholder)
+}
+
 type EtcdV3 struct {
-	client  *clientv3.Client
-	conf    clientv3.Config
-	timeout time.Duration
+	client   *clientv3.Client
+	conf     clientv3.Config
+	timeout  time.Duration
+	reloader *tlsReloader
 }
 
 func NewEtcd(etcdConf *conf.Etcd) (*EtcdV3, error) {
-	timeout := time.Duration(etcdConf.Timeout)
-	s := &EtcdV3{timeout: timeout}
-
-	if s.timeout == 0 {
-		s.timeout = 10 * time.Second
+	// the timeout is configured in seconds
+	timeout := time.Duration(etcdConf.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
 	}
+	s := &EtcdV3{timeout: timeout}
 
 	config := clientv3.Config{
 		Endpoints:            etcdConf.Host,
@@ -43,16 +56,13 @@ func NewEtcd(etcdConf *conf.Etcd) (*EtcdV3, error) {
 		Password:             etcdConf.Password,
 	}
 
-	if etcdConf.TLS != nil && etcdConf.TLS.Verify {
-		tlsInfo := transport.TLSInfo{
-			CertFile: etcdConf.TLS.CertFile,
-			KeyFile:  etcdConf.TLS.KeyFile,
-		}
-		tlsConf, err := tlsInfo.ClientConfig()
+	if etcdConf.TLS != nil {
+		tlsConf, reloader, err := newTLSConfig(etcdConf.TLS)
 		if err != nil {
 			return nil, err
 		}
 		config.TLS = tlsConf
+		s.reloader = reloader
 	}
 
 	s.conf = config
@@ -60,6 +70,9 @@ func NewEtcd(etcdConf *conf.Etcd) (*EtcdV3, error) {
 		return nil, err
 	}
 
+	if s.reloader != nil {
+		go s.reloader.watch()
+	}
 	return s, nil
 }
 
@@ -103,17 +116,20 @@ func (s *EtcdV3) List(ctx context.Context, prefix string) ([]*message.Message, e
 		return nil, fmt.Errorf("etcd list prefix[%s] failed: %s", prefix, err)
 	}
 	if resp.Count == 0 {
+		// APISIX 3.x does not create the directory, so an empty prefix is expected
+		if message.CurrentOptions().APISIXVersion != message.APISIXVersion2 {
+			return []*message.Message{}, nil
+		}
 		log.Warnf("etcd list prefix[%s] is not found", prefix)
 		return nil, fmt.Errorf("etcd list prefix[%s] is not found", prefix)
 	}
 
-	// We use a placeholder to mark a key to be a directory. So we need to skip the hack here.
-	if bytes.Equal(resp.Kvs[0].Value, DirPlaceholder) {
-		resp.Kvs = resp.Kvs[1:]
-	}
-
 	msgs := make([]*message.Message, 0, len(resp.Kvs))
 	for _, kv := range resp.Kvs {
+		// We use a placeholder to mark a key to be a directory. So we need to skip the hack here.
+		if isDirPlaceholder(prefix, kv.Key, kv.Value) {
+			continue
+		}
 		msg, err := message.NewMessage(string(kv.Key), kv.Value, kv.Version, message.EventAdd, message.ToA6Type(prefix))
 		if err != nil {
 			log.Errorf("etcd list prefix[%s] format failed: %s", prefix, err)
@@ -150,12 +166,16 @@ func (s *EtcdV3) Update(ctx context.Context, key, value string, version int64) e
 
 	resp, err := txn.Commit()
 	if err != nil {
+		metrics.Rewrites.WithLabelValues(metrics.ResultFailure).Inc()
 		log.Errorf("etcd update key[%s] failed: %s", key, err)
 		return fmt.Errorf("etcd update key[%s] failed: %s", key, err)
 	}
 	if !resp.Succeeded {
+		metrics.Rewrites.WithLabelValues(metrics.ResultConflict).Inc()
 		log.Infof("key[%s] may have been updated by other instances", key)
+		return nil
 	}
+	metrics.Rewrites.WithLabelValues(metrics.ResultSuccess).Inc()
 	log.Infof("etcd update key[%s], version: %d", key, version)
 	return nil
 }
@@ -211,12 +231,11 @@ func (s *EtcdV3) Watch(ctx context.Context, prefix string) <-chan []*message.Mes
 					zap.String("watch key", prefix),
 					zap.Error(event.Err()),
 				)
-				close(ch)
 				return
 			}
 			for _, ev := range event.Events {
 				// We use a placeholder to mark a key to be a directory. So we need to skip the hack here.
-				if bytes.Equal(ev.Kv.Value, DirPlaceholder) {
+				if isDirPlaceholder(prefix, ev.Kv.Key, ev.Kv.Value) {
 					continue
 				}
 
@@ -239,15 +258,33 @@ func (s *EtcdV3) Watch(ctx context.Context, prefix string) <-chan []*message.Mes
 				msgs = append(msgs, msg)
 			}
 
-			ch <- msgs
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- msgs:
+			}
 		}
 	}()
 
 	return ch
 }
 
+// Check whether any etcd endpoint is reachable
+func (s *EtcdV3) Check(ctx context.Context) error {
+	var err error
+	for _, ep := range s.client.Endpoints() {
+		if _, err = s.client.Status(ctx, ep); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("etcd is unreachable: %v", err)
+}
+
 // Close the client connection
 func (s *EtcdV3) Close() error {
+	if s.reloader != nil {
+		s.reloader.stop()
+	}
 	if err := s.client.Close(); err != nil {
 		log.Errorf("etcd client close failed: %s", err)
 		return err
@@ -101,11 +101,20 @@ func testList(t *testing.T, client *EtcdV3) {
 	err := client.DeletePrefix(context.Background(), prefix)
 	assert.Nil(t, err, "Test delete prefix")
 
-	// List should fail
+	// List should fail with APISIX 2.x
+	opts := message.DefaultOptions()
+	opts.APISIXVersion = message.APISIXVersion2
+	message.SetOptions(opts)
+	defer message.SetOptions(message.DefaultOptions())
 	wantErr := fmt.Errorf("etcd list prefix[%s] is not found", prefix)
 	pairs, err := client.List(context.Background(), prefix)
 	assert.Equal(t, wantErr, err, "Test list non-existing prefix")
 	assert.Nil(t, pairs)
+
+	message.SetOptions(message.DefaultOptions())
+	pairs, err = client.List(context.Background(), prefix)
+	assert.Nil(t, err, "Test list non-existing prefix without placeholders")
+	assert.Len(t, pairs, 0)
 }
 
 // nolint:unused
@@ -160,6 +169,26 @@ func testWatch(t *testing.T, client *EtcdV3) {
 
 }
 
+func TestIsDirPlaceholder(t *testing.T) {
+	tests := []struct {
+		caseDesc string
+		key      string
+		value    string
+		want     bool
+	}{
+		{caseDesc: "resource", key: "/apisix/routes/1", value: getA6Conf("first"), want: false},
+		{caseDesc: "APISIX 2.x placeholder", key: "/apisix/routes/", value: "init_dir", want: true},
+		{caseDesc: "quoted placeholder", key: "/apisix/routes/x", value: `"init_dir"`, want: true},
+		{caseDesc: "directory key", key: "/apisix/routes", value: "", want: true},
+		{caseDesc: "deleted directory key", key: "/apisix/routes/", value: "", want: true},
+	}
+
+	for _, tc := range tests {
+		got := isDirPlaceholder("/apisix/routes", []byte(tc.key), []byte(tc.value))
+		assert.Equal(t, tc.want, got, tc.caseDesc)
+	}
+}
+
 func getA6Conf(uri string) string {
 	a6fmt := `{
 		"uri": "%s",
@@ -0,0 +1,462 @@
+package storer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/api7/gopkg/pkg/log"
+	"gopkg.in/yaml.v3"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/metrics"
+)
+
+// standaloneEnd marks the end of apisix.yaml, APISIX ignores the file until the marker is written
+const standaloneEnd = "#END\n"
+
+type standaloneWatcher struct {
+	ctx    context.Context
+	prefix string
+	ch     chan []*message.Message
+}
+
+// Standalone reads the operator-authored resources from a source file in the apisix.yaml format,
+// and renders them together with the discovered nodes into the apisix.yaml of APISIX standalone mode.
+// It behaves like etcd: both the changes of the source file and the updates bump the version of a key.
+type Standalone struct {
+	conf      *conf.Standalone
+	prefix    string
+	resources []string
+
+	mutex sync.Mutex
+	raw   []byte
+	// top-level fields of the source file other than the watched resources, e.g. plugins
+	others map[string]interface{}
+	// resource name -> keys in the order of the source file
+	order    map[string][]string
+	sources  map[string]string
+	values   map[string]string
+	versions map[string]int64
+
+	// renderMutex is held from the snapshot of the resources to the rename,
+	// so that the output file is never replaced with an older snapshot
+	renderMutex sync.Mutex
+
+	watchMutex sync.Mutex
+	watchers   []*standaloneWatcher
+
+	// the messages waiting to be dispatched in order, see dispatchLoop
+	eventMutex sync.Mutex
+	events     [][]*message.Message
+	notify     chan struct{}
+
+	stopCh chan struct{}
+}
+
+func NewStandalone(standaloneConf *conf.Standalone, prefix string, resources []string) (*Standalone, error) {
+	if standaloneConf == nil || standaloneConf.Source == "" || standaloneConf.Output == "" {
+		return nil, fmt.Errorf("standalone source and output can not be empty")
+	}
+
+	s := &Standalone{
+		conf:      standaloneConf,
+		prefix:    prefix,
+		resources: resources,
+		order:     make(map[string][]string),
+		sources:   make(map[string]string),
+		values:    make(map[string]string),
+		versions:  make(map[string]int64),
+		notify:    make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+	}
+
+	content, err := ioutil.ReadFile(standaloneConf.Source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.load(content); err != nil {
+		return nil, fmt.Errorf("load standalone source %s failed: %s", standaloneConf.Source, err)
+	}
+	if err = s.render(); err != nil {
+		return nil, fmt.Errorf("render standalone output %s failed: %s", standaloneConf.Output, err)
+	}
+
+	go s.watchSource(time.Duration(standaloneConf.WatchInterval) * time.Second)
+	go s.dispatchLoop()
+	return s, nil
+}
+
+func (s *Standalone) key(resource, id string) string {
+	return s.prefix + "/" + resource + "/" + id
+}
+
+type standaloneItem struct {
+	key   string
+	value []byte
+}
+
+// parse reads the watched resources of the source file without touching the current state
+func (s *Standalone) parse(doc map[string]interface{}) (map[string][]standaloneItem, error) {
+	parsed := make(map[string][]standaloneItem, len(s.resources))
+	for _, resource := range s.resources {
+		items, _ := doc[resource].([]interface{})
+		seen := make(map[string]struct{}, len(items))
+		for i, item := range items {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s[%d] is not an object", resource, i)
+			}
+			id := strconv.Itoa(i + 1)
+			if obj["id"] != nil {
+				id = fmt.Sprint(obj["id"])
+			}
+			key := s.key(resource, id)
+			if _, ok = seen[key]; ok {
+				return nil, fmt.Errorf("duplicate id %s in %s", id, resource)
+			}
+			seen[key] = struct{}{}
+
+			value, err := json.Marshal(obj)
+			if err != nil {
+				return nil, err
+			}
+			parsed[resource] = append(parsed[resource], standaloneItem{key: key, value: value})
+		}
+	}
+	return parsed, nil
+}
+
+// load applies the source file, the keys changed since the last load are returned as messages
+func (s *Standalone) load(content []byte) ([]*message.Message, error) {
+	doc := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	parsed, err := s.parse(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	msgs := make([]*message.Message, 0)
+	for _, resource := range s.resources {
+		a6Type := message.ToA6Type(s.prefix + "/" + resource)
+		delete(doc, resource)
+
+		order := make([]string, 0, len(parsed[resource]))
+		current := make(map[string]struct{}, len(parsed[resource]))
+		for _, item := range parsed[resource] {
+			current[item.key] = struct{}{}
+			order = append(order, item.key)
+			if s.sources[item.key] == string(item.value) {
+				continue
+			}
+
+			s.sources[item.key] = string(item.value)
+			s.values[item.key] = string(item.value)
+			s.versions[item.key]++
+			msg, err := message.NewMessage(item.key, item.value, s.versions[item.key], message.EventAdd, a6Type)
+			if err != nil {
+				log.Errorf("standalone source key[%s] format failed: %s", item.key, err)
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+
+		for _, key := range s.order[resource] {
+			if _, ok := current[key]; ok {
+				continue
+			}
+			msg, err := message.NewMessage(key, nil, s.versions[key], message.EventDelete, a6Type)
+			delete(s.sources, key)
+			delete(s.values, key)
+			delete(s.versions, key)
+			if err != nil {
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+		s.order[resource] = order
+	}
+	s.others = doc
+	s.raw = content
+
+	return msgs, nil
+}
+
+// render atomically replaces the output file with the current resources
+func (s *Standalone) render() error {
+	s.renderMutex.Lock()
+	defer s.renderMutex.Unlock()
+
+	s.mutex.Lock()
+	doc := make(map[string]interface{}, len(s.others)+len(s.resources))
+	for k, v := range s.others {
+		doc[k] = v
+	}
+	for _, resource := range s.resources {
+		if len(s.order[resource]) == 0 {
+			continue
+		}
+		items := make([]interface{}, 0, len(s.order[resource]))
+		for _, key := range s.order[resource] {
+			var item interface{}
+			// the numbers are kept as they are, e.g. create_time is not written as a float
+			decoder := json.NewDecoder(strings.NewReader(s.values[key]))
+			decoder.UseNumber()
+			if err := decoder.Decode(&item); err != nil {
+				s.mutex.Unlock()
+				return err
+			}
+			items = append(items, fromJSONNumbers(item))
+		}
+		doc[resource] = items
+	}
+	s.mutex.Unlock()
+
+	content, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	content = append(content, standaloneEnd...)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.conf.Output), filepath.Base(s.conf.Output)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.conf.Output)
+}
+
+// fromJSONNumbers converts the json.Number values decoded with UseNumber to the integers or floats yaml writes
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, elm := range v {
+			v[k] = fromJSONNumbers(elm)
+		}
+	case []interface{}:
+		for i, elm := range v {
+			v[i] = fromJSONNumbers(elm)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	}
+	return v
+}
+
+func (s *Standalone) watchSource(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		content, err := ioutil.ReadFile(s.conf.Source)
+		if err != nil {
+			log.Errorf("read standalone source %s failed: %s", s.conf.Source, err)
+			continue
+		}
+
+		s.mutex.Lock()
+		changed := !bytes.Equal(content, s.raw)
+		s.mutex.Unlock()
+		if !changed {
+			continue
+		}
+
+		msgs, err := s.load(content)
+		if err != nil {
+			log.Errorf("load standalone source %s failed: %s", s.conf.Source, err)
+			continue
+		}
+		if err = s.render(); err != nil {
+			log.Errorf("render standalone output %s failed: %s", s.conf.Output, err)
+		}
+		s.enqueue(msgs)
+	}
+}
+
+// enqueue queues the messages to dispatch, it never blocks on the watchers
+func (s *Standalone) enqueue(msgs []*message.Message) {
+	s.eventMutex.Lock()
+	s.events = append(s.events, msgs)
+	s.eventMutex.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchLoop dispatches the queued messages one by one, in the order of the changes
+func (s *Standalone) dispatchLoop() {
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.notify:
+		}
+
+		s.eventMutex.Lock()
+		events := s.events
+		s.events = nil
+		s.eventMutex.Unlock()
+
+		for _, msgs := range events {
+			s.dispatch(msgs)
+		}
+	}
+}
+
+// dispatch sends the messages to the watchers of their prefixes
+func (s *Standalone) dispatch(msgs []*message.Message) {
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+
+	for _, w := range s.watchers {
+		matched := make([]*message.Message, 0)
+		for _, msg := range msgs {
+			if strings.HasPrefix(msg.Key, w.prefix+"/") {
+				matched = append(matched, msg)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		select {
+		case <-w.ctx.Done():
+		case w.ch <- matched:
+		}
+	}
+}
+
+// List the content of a given prefix
+func (s *Standalone) List(_ context.Context, prefix string) ([]*message.Message, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	resource := strings.TrimPrefix(prefix, s.prefix+"/")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	msgs := make([]*message.Message, 0, len(s.order[resource]))
+	for _, key := range s.order[resource] {
+		msg, err := message.NewMessage(key, []byte(s.values[key]), s.versions[key], message.EventAdd, message.ToA6Type(prefix))
+		if err != nil {
+			log.Errorf("standalone list prefix[%s] format failed: %s", prefix, err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Update a value at the specified key and render the output file
+func (s *Standalone) Update(_ context.Context, key, value string, version int64) error {
+	s.mutex.Lock()
+	current, ok := s.versions[key]
+	if !ok {
+		s.mutex.Unlock()
+		metrics.Rewrites.WithLabelValues(metrics.ResultFailure).Inc()
+		return fmt.Errorf("standalone key[%s] not found", key)
+	}
+	if current != version {
+		s.mutex.Unlock()
+		metrics.Rewrites.WithLabelValues(metrics.ResultConflict).Inc()
+		log.Infof("key[%s] may have been updated by the source file", key)
+		return nil
+	}
+	s.values[key] = value
+	s.versions[key]++
+	version = s.versions[key]
+	s.mutex.Unlock()
+
+	if err := s.render(); err != nil {
+		metrics.Rewrites.WithLabelValues(metrics.ResultFailure).Inc()
+		log.Errorf("render standalone output %s failed: %s", s.conf.Output, err)
+		return fmt.Errorf("render standalone output %s failed: %s", s.conf.Output, err)
+	}
+	metrics.Rewrites.WithLabelValues(metrics.ResultSuccess).Inc()
+	log.Infof("standalone update key[%s], version: %d", key, version)
+
+	msg, err := message.NewMessage(key, []byte(value), version, message.EventAdd, message.ToA6Type(path.Dir(key)))
+	if err != nil {
+		return nil
+	}
+	// like the events of etcd, the update is delivered asynchronously,
+	// the watchers may be waiting for the caller to consume the discoverers
+	s.enqueue([]*message.Message{msg})
+	return nil
+}
+
+// Watch for changes on a prefix, including the changes of the source file and the updates
+func (s *Standalone) Watch(ctx context.Context, prefix string) <-chan []*message.Message {
+	w := &standaloneWatcher{
+		ctx:    ctx,
+		prefix: strings.TrimSuffix(prefix, "/"),
+		ch:     make(chan []*message.Message, 1),
+	}
+
+	s.watchMutex.Lock()
+	s.watchers = append(s.watchers, w)
+	s.watchMutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.watchMutex.Lock()
+		defer s.watchMutex.Unlock()
+		for i, watcher := range s.watchers {
+			if watcher == w {
+				s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+				break
+			}
+		}
+		close(w.ch)
+	}()
+
+	return w.ch
+}
+
+// Check whether the source file is readable
+func (s *Standalone) Check(_ context.Context) error {
+	_, err := os.Stat(s.conf.Source)
+	return err
+}
+
+// Close stops watching the source file
+func (s *Standalone) Close() error {
+	close(s.stopCh)
+	return nil
+}
@@ -0,0 +1,178 @@
+package storer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+)
+
+const standaloneSource = `
+routes:
+  - id: 1
+    uri: /hh
+    upstream:
+      discovery_type: nacos
+      service_name: APISIX-NACOS
+  - id: 2
+    uri: /static
+    create_time: 1648871506
+    upstream:
+      nodes:
+        "127.0.0.1:80": 1
+plugins:
+  - name: proxy-rewrite
+`
+
+func newTestStandalone(t *testing.T) (string, *conf.Standalone, *Standalone, func()) {
+	dir, err := ioutil.TempDir("", "apisix-seed-standalone")
+	assert.Nil(t, err)
+
+	standaloneConf := &conf.Standalone{
+		Source:        filepath.Join(dir, "apisix.seed.yaml"),
+		Output:        filepath.Join(dir, "apisix.yaml"),
+		WatchInterval: 1,
+	}
+	assert.Nil(t, ioutil.WriteFile(standaloneConf.Source, []byte(standaloneSource), 0644))
+
+	s, err := NewStandalone(standaloneConf, "/apisix", []string{"routes", "upstreams"})
+	assert.Nil(t, err)
+	return dir, standaloneConf, s, func() {
+		_ = s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readStandaloneOutput(t *testing.T, path string) map[string]interface{} {
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(string(content), "#END\n"))
+
+	doc := make(map[string]interface{})
+	assert.Nil(t, yaml.Unmarshal(content, &doc))
+	return doc
+}
+
+func TestStandaloneListAndUpdate(t *testing.T) {
+	_, standaloneConf, s, cleanup := newTestStandalone(t)
+	defer cleanup()
+
+	caseDesc := "render the source"
+	doc := readStandaloneOutput(t, standaloneConf.Output)
+	assert.Len(t, doc["routes"], 2, caseDesc)
+	assert.NotNil(t, doc["plugins"], caseDesc)
+	assert.Nil(t, doc["upstreams"], caseDesc)
+
+	caseDesc = "keep the integers"
+	content, err := ioutil.ReadFile(standaloneConf.Output)
+	assert.Nil(t, err, caseDesc)
+	assert.Contains(t, string(content), "create_time: 1648871506", caseDesc)
+
+	caseDesc = "list"
+	msgs, err := s.List(context.Background(), "/apisix/routes")
+	assert.Nil(t, err, caseDesc)
+	assert.Len(t, msgs, 2, caseDesc)
+	assert.Equal(t, "/apisix/routes/1", msgs[0].Key, caseDesc)
+	assert.Equal(t, "APISIX-NACOS", msgs[0].ServiceName(), caseDesc)
+	assert.Equal(t, int64(1), msgs[0].Version, caseDesc)
+
+	caseDesc = "update with the latest version"
+	msgs[0].InjectNodes([]*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}})
+	value, err := msgs[0].Marshal()
+	assert.Nil(t, err, caseDesc)
+	assert.Nil(t, s.Update(context.Background(), "/apisix/routes/1", string(value), 1), caseDesc)
+	doc = readStandaloneOutput(t, standaloneConf.Output)
+	route := doc["routes"].([]interface{})[0].(map[string]interface{})
+	upstream := route["upstream"].(map[string]interface{})
+	assert.Equal(t, "APISIX-NACOS", upstream["_service_name"], caseDesc)
+	assert.Len(t, upstream["nodes"], 1, caseDesc)
+
+	caseDesc = "update with a stale version"
+	assert.Nil(t, s.Update(context.Background(), "/apisix/routes/1", `{"uri":"/stale"}`, 1), caseDesc)
+	msgs, _ = s.List(context.Background(), "/apisix/routes")
+	assert.Equal(t, string(value), string(msgs[0].Value), caseDesc)
+	assert.Equal(t, int64(2), msgs[0].Version, caseDesc)
+
+	caseDesc = "update a missing key"
+	assert.NotNil(t, s.Update(context.Background(), "/apisix/routes/3", `{"uri":"/missing"}`, 1), caseDesc)
+}
+
+func TestStandaloneWatch(t *testing.T) {
+	_, standaloneConf, s, cleanup := newTestStandalone(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := s.Watch(ctx, "/apisix/routes")
+
+	source := strings.Replace(standaloneSource, "uri: /static", "uri: /changed", 1)
+	source = strings.Replace(source, "  - id: 1\n    uri: /hh\n", "  - id: 3\n    uri: /hh\n", 1)
+	assert.Nil(t, ioutil.WriteFile(standaloneConf.Source, []byte(source), 0644))
+
+	select {
+	case msgs := <-ch:
+		assert.Len(t, msgs, 3)
+		for _, msg := range msgs {
+			switch msg.Key {
+			case "/apisix/routes/3":
+				assert.Equal(t, message.EventAdd, msg.Action)
+				assert.Equal(t, int64(1), msg.Version)
+			case "/apisix/routes/2":
+				assert.Equal(t, message.EventAdd, msg.Action)
+				assert.Equal(t, int64(2), msg.Version)
+			case "/apisix/routes/1":
+				assert.Equal(t, message.EventDelete, msg.Action)
+			default:
+				assert.Fail(t, "unexpected key "+msg.Key)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Test watch timeout reached")
+	}
+
+	doc := readStandaloneOutput(t, standaloneConf.Output)
+	route := doc["routes"].([]interface{})[1].(map[string]interface{})
+	assert.Equal(t, "/changed", route["uri"])
+
+	caseDesc := "echo the update"
+	assert.Nil(t, s.Update(context.Background(), "/apisix/routes/3", `{"uri":"/hh"}`, 1), caseDesc)
+	select {
+	case msgs := <-ch:
+		assert.Len(t, msgs, 1, caseDesc)
+		assert.Equal(t, int64(2), msgs[0].Version, caseDesc)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Test watch timeout reached")
+	}
+}
+
+func TestStandaloneWatchOrder(t *testing.T) {
+	_, _, s, cleanup := newTestStandalone(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := s.Watch(ctx, "/apisix/routes")
+
+	for version := int64(1); version <= 5; version++ {
+		assert.Nil(t, s.Update(context.Background(), "/apisix/routes/2", `{"uri":"/static"}`, version))
+	}
+	for version := int64(2); version <= 6; version++ {
+		select {
+		case msgs := <-ch:
+			assert.Len(t, msgs, 1)
+			assert.Equal(t, version, msgs[0].Version)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "Test watch timeout reached")
+			return
+		}
+	}
+}
@@ -2,7 +2,11 @@ package storer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,9 +21,19 @@ type Interface interface {
 	Watch(context.Context, string) <-chan []*message.Message
 }
 
+// Checker is implemented by the storages able to report whether they are reachable
+type Checker interface {
+	Check(context.Context) error
+}
+
 type GenericStoreOption struct {
 	BasePath string
 	Prefix   string
+	// Target is the etcd target of the store, empty for the default one
+	Target string
+	// Include and Exclude are matched against the resource id, see conf.Resource
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
 }
 
 type GenericStore struct {
@@ -48,6 +62,19 @@ func NewGenericStore(typ string, opt GenericStoreOption, stg Interface) (*Generi
 }
 
 func (s *GenericStore) List(filter func(*message.Message) bool) ([]*message.Message, error) {
+	objPtrs, err := s.Fetch(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, objPtr := range objPtrs {
+		s.Store(objPtr.Key, objPtr)
+	}
+	return objPtrs, nil
+}
+
+// Fetch lists the entities from the storage like List, but leaves the cache untouched
+func (s *GenericStore) Fetch(filter func(*message.Message) bool) ([]*message.Message, error) {
 	lc, lcancel := context.WithTimeout(context.TODO(), 5*time.Second)
 	defer lcancel()
 	ret, err := s.Stg.List(lc, s.opt.BasePath)
@@ -57,8 +84,11 @@ func (s *GenericStore) List(filter func(*message.Message) bool) ([]*message.Mess
 
 	objPtrs := make([]*message.Message, 0)
 	for i := range ret {
+		if !s.match(ret[i].Key) {
+			continue
+		}
+		ret[i].Target = s.opt.Target
 		if filter == nil || filter(ret[i]) {
-			s.Store(ret[i].Key, ret[i])
 			objPtrs = append(objPtrs, ret[i])
 		}
 	}
@@ -71,8 +101,48 @@ func (s *GenericStore) Watch() <-chan []*message.Message {
 	s.cancel = cancel
 
 	ch := s.Stg.Watch(c, s.opt.BasePath)
+	if len(s.opt.Include) == 0 && len(s.opt.Exclude) == 0 && s.opt.Target == "" {
+		return ch
+	}
+
+	filteredCh := make(chan []*message.Message, 1)
+	go func() {
+		defer close(filteredCh)
+
+		for msgs := range ch {
+			filtered := make([]*message.Message, 0, len(msgs))
+			for _, msg := range msgs {
+				if s.match(msg.Key) {
+					msg.Target = s.opt.Target
+					filtered = append(filtered, msg)
+				}
+			}
+			if len(filtered) > 0 {
+				filteredCh <- filtered
+			}
+		}
+	}()
+
+	return filteredCh
+}
 
-	return ch
+// match reports whether the key is watched according to the include and exclude patterns
+func (s *GenericStore) match(key string) bool {
+	id := strings.TrimPrefix(strings.TrimPrefix(key, s.opt.BasePath), "/")
+	for _, re := range s.opt.Exclude {
+		if re.MatchString(id) {
+			return false
+		}
+	}
+	if len(s.opt.Include) == 0 {
+		return true
+	}
+	for _, re := range s.opt.Include {
+		if re.MatchString(id) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *GenericStore) Unwatch() {
@@ -92,6 +162,16 @@ func (s *GenericStore) UpdateNodes(ctx context.Context, msg *message.Message) (e
 	return nil
 }
 
+// Restore rewrites the entity back to its operator-authored form, see message.Restore
+func (s *GenericStore) Restore(ctx context.Context, msg *message.Message, rename, dropNodes bool) error {
+	value, err := msg.Restore(rename, dropNodes)
+	if err != nil {
+		log.Errorf("restore %s failed: %s", msg.Key, err)
+		return fmt.Errorf("restore failed: %s", err)
+	}
+	return s.Stg.Update(ctx, msg.Key, value, msg.Version)
+}
+
 func (s *GenericStore) Store(key string, objPtr interface{}) (interface{}, bool) {
 	oldObj, ok := s.cache.LoadOrStore(key, objPtr)
 	if ok {
@@ -104,6 +184,72 @@ func (s *GenericStore) Delete(key string) (interface{}, bool) {
 	return s.cache.LoadAndDelete(key)
 }
 
+func (s *GenericStore) Load(key string) (interface{}, bool) {
+	return s.cache.Load(key)
+}
+
+// Range calls f for each cached entity until f returns false
+func (s *GenericStore) Range(f func(key, objPtr interface{}) bool) {
+	s.cache.Range(f)
+}
+
 func (s *GenericStore) BasePath() string {
 	return s.opt.BasePath
 }
+
+// EntityDump is a cached entity of a store, used for debugging
+type EntityDump struct {
+	Key           string          `json:"key"`
+	Version       int64           `json:"version"`
+	DiscoveryType string          `json:"discovery_type"`
+	ServiceName   string          `json:"service_name"`
+	Nodes         interface{}     `json:"nodes"`
+	Value         json.RawMessage `json:"value"`
+}
+
+// StoreDump is the cache of a store, used for debugging
+type StoreDump struct {
+	Target   string        `json:"target"`
+	Resource string        `json:"resource"`
+	BasePath string        `json:"base_path"`
+	Entities []*EntityDump `json:"entities"`
+}
+
+// Dump returns the cached entities ordered by key.
+// The nodes and the value are the ones read from the storage, the latest nodes of the services are kept in the registry.
+func (s *GenericStore) Dump() *StoreDump {
+	dump := &StoreDump{
+		Target:   s.opt.Target,
+		Resource: s.Typ,
+		BasePath: s.opt.BasePath,
+		Entities: make([]*EntityDump, 0),
+	}
+	s.cache.Range(func(_, value interface{}) bool {
+		msg := value.(*message.Message)
+		entity := &EntityDump{
+			Key:           msg.Key,
+			Version:       msg.Version,
+			DiscoveryType: msg.DiscoveryType(),
+			ServiceName:   msg.ServiceName(),
+			Nodes:         msg.Nodes(),
+			Value:         json.RawMessage(msg.Value),
+		}
+		if !json.Valid(entity.Value) {
+			entity.Value, _ = json.Marshal(msg.Value)
+		}
+		dump.Entities = append(dump.Entities, entity)
+		return true
+	})
+	sort.Slice(dump.Entities, func(i, j int) bool {
+		return dump.Entities[i].Key < dump.Entities[j].Key
+	})
+	return dump
+}
+
+// Name identifies the store across all targets
+func (s *GenericStore) Name() string {
+	if s.opt.Target == "" {
+		return s.opt.BasePath
+	}
+	return s.opt.Target + ":" + s.opt.BasePath
+}
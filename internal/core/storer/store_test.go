@@ -176,6 +176,63 @@ func TestList(t *testing.T) {
 	})
 }
 
+func TestListWithPatterns(t *testing.T) {
+	msgs := make([]*message.Message, 0, 3)
+	for _, key := range []string{"/apisix/routes/1", "/apisix/routes/legacy-1", "/apisix/routes/legacy-2"} {
+		a6Str := `{"uri":"/test","upstream":{"service_name":"APISIX-ZK","type":"roundrobin","discovery_type":"mock_zk"}}`
+		msg, err := message.NewMessage(key, []byte(a6Str), 1, message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		msgs = append(msgs, msg)
+	}
+	mStg := &MockInterface{}
+	mStg.On("List", mock.Anything, mock.Anything).Return(msgs, nil)
+
+	tests := []struct {
+		caseDesc string
+		include  []string
+		exclude  []string
+		wantKeys []string
+	}{
+		{
+			caseDesc: "exclude",
+			exclude:  []string{"^legacy-"},
+			wantKeys: []string{"/apisix/routes/1"},
+		},
+		{
+			caseDesc: "include",
+			include:  []string{"^legacy-"},
+			wantKeys: []string{"/apisix/routes/legacy-1", "/apisix/routes/legacy-2"},
+		},
+		{
+			caseDesc: "include and exclude",
+			include:  []string{"^legacy-"},
+			exclude:  []string{"2$"},
+			wantKeys: []string{"/apisix/routes/legacy-1"},
+		},
+	}
+	for _, tc := range tests {
+		include, err := compilePatterns(tc.include)
+		assert.Nil(t, err, tc.caseDesc)
+		exclude, err := compilePatterns(tc.exclude)
+		assert.Nil(t, err, tc.caseDesc)
+
+		store, err := NewGenericStore("test", GenericStoreOption{
+			BasePath: "/apisix/routes",
+			Prefix:   "/apisix",
+			Include:  include,
+			Exclude:  exclude,
+		}, mStg)
+		assert.Nil(t, err, tc.caseDesc)
+		ret, err := store.List(nil)
+		assert.Nil(t, err, tc.caseDesc)
+		keys := make([]string, 0, len(ret))
+		for _, msg := range ret {
+			keys = append(keys, msg.Key)
+		}
+		assert.Equal(t, tc.wantKeys, keys, tc.caseDesc)
+	}
+}
+
 func TestWatch(t *testing.T) {
 	caseDesc := "sanity"
 	ch := make(chan []*message.Message, 1)
@@ -197,6 +254,47 @@ func TestWatch(t *testing.T) {
 	assert.Equal(t, "/apisxi/routes/a", msgs[0].Key)
 }
 
+func TestTargetStores(t *testing.T) {
+	a6Str := `{"uri":"/test","upstream":{"service_name":"APISIX-ZK","type":"roundrobin","discovery_type":"mock_zk"}}`
+	newStg := func(key string) *MockInterface {
+		msg, err := message.NewMessage(key, []byte(a6Str), 1, message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		ch := make(chan []*message.Message, 1)
+		ch <- []*message.Message{msg}
+		mStg := &MockInterface{}
+		mStg.On("List", mock.Anything, mock.Anything).Return([]*message.Message{msg}, nil)
+		mStg.On("Watch", mock.Anything, mock.Anything).Return(ch)
+		return mStg
+	}
+
+	ClrearStores()
+	defer ClrearStores()
+	for _, target := range []string{"bu1", "bu2"} {
+		err := InitStore("routes", GenericStoreOption{
+			BasePath: "/apisix/routes",
+			Prefix:   "/apisix",
+			Target:   target,
+		}, newStg("/apisix/routes/1"))
+		assert.Nil(t, err)
+	}
+	assert.Len(t, GetStores(), 2)
+
+	for _, target := range []string{"bu1", "bu2"} {
+		caseDesc := "list " + target
+		store := GetTargetStore(target, "routes")
+		msgs, err := store.List(nil)
+		assert.Nil(t, err, caseDesc)
+		assert.Equal(t, target, msgs[0].Target, caseDesc)
+		assert.Equal(t, target+":/apisix/routes/1", msgs[0].ID(), caseDesc)
+
+		caseDesc = "watch " + target
+		msgs = <-store.Watch()
+		assert.Equal(t, target, msgs[0].Target, caseDesc)
+	}
+
+	assert.Panics(t, func() { GetStore("routes") }, "no default target")
+}
+
 func TestUpdateNodes(t *testing.T) {
 	caseDesc := "sanity"
 	mStg := &MockInterface{}
@@ -215,3 +313,35 @@ func TestUpdateNodes(t *testing.T) {
 	err = store.UpdateNodes(context.Background(), givenMsg)
 	assert.Nil(t, err, caseDesc)
 }
+
+func TestDump(t *testing.T) {
+	store, err := NewGenericStore("routes", GenericStoreOption{
+		BasePath: "/apisix/routes",
+		Prefix:   "/apisix",
+		Target:   "bu1",
+	}, &MockInterface{})
+	assert.Nil(t, err)
+
+	a6Str := `{"uri":"/test","upstream":{"service_name":"APISIX-ZK","type":"roundrobin","discovery_type":"mock_zk"}}`
+	for i, key := range []string{"/apisix/routes/2", "/apisix/routes/1"} {
+		msg, err := message.NewMessage(key, []byte(a6Str), int64(i+1), message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		store.Store(key, msg)
+	}
+	obj, _ := store.cache.Load("/apisix/routes/1")
+	obj.(*message.Message).InjectNodes([]*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}})
+
+	dump := store.Dump()
+	assert.Equal(t, "bu1", dump.Target)
+	assert.Equal(t, "routes", dump.Resource)
+	assert.Len(t, dump.Entities, 2)
+
+	entity := dump.Entities[0]
+	assert.Equal(t, "/apisix/routes/1", entity.Key)
+	assert.Equal(t, int64(2), entity.Version)
+	assert.Equal(t, "mock_zk", entity.DiscoveryType)
+	assert.Equal(t, "APISIX-ZK", entity.ServiceName)
+	assert.Equal(t, []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}, entity.Nodes)
+	assert.JSONEq(t, a6Str, string(entity.Value))
+	assert.Nil(t, dump.Entities[1].Nodes)
+}
@@ -2,14 +2,23 @@ package storer
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/api7/gopkg/pkg/log"
 
 	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
 )
 
-var storeHub = map[string]*GenericStore{}
+var (
+	// hubMutex guards storeHub, which is changed when the configuration is reloaded
+	hubMutex sync.RWMutex
+	// storeHub: target -> entity -> store, the default target is named ""
+	storeHub = map[string]map[string]*GenericStore{}
+)
 
 func InitStore(key string, opt GenericStoreOption, stg Interface) error {
 	s, err := NewGenericStore(key, opt, stg)
@@ -18,36 +27,71 @@ func InitStore(key string, opt GenericStoreOption, stg Interface) error {
 		return err
 	}
 
-	storeHub[key] = s
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	if _, ok := storeHub[opt.Target]; !ok {
+		storeHub[opt.Target] = map[string]*GenericStore{}
+	}
+	storeHub[opt.Target][key] = s
 	return nil
 }
 
-func InitStores(stg Interface) (err error) {
-	err = InitStore("routes", GenericStoreOption{
-		BasePath: conf.ETCDConfig.Prefix + "/routes",
-		Prefix:   conf.ETCDConfig.Prefix,
-	}, stg)
-	if err != nil {
-		return
+// RemoveTargetStore removes the store of a resource from a target and returns it, nil if there is none
+func RemoveTargetStore(target, key string) *GenericStore {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	s := storeHub[target][key]
+	delete(storeHub[target], key)
+	return s
+}
+
+func InitStores(stg Interface) error {
+	return InitTargetStores("", conf.ETCDConfig.Prefix, stg)
+}
+
+// InitTargetStores creates the stores of all watched resources under the prefix of a target
+func InitTargetStores(target, prefix string, stg Interface) error {
+	for _, res := range conf.ResourceConfigs {
+		if err := InitTargetStore(target, prefix, stg, res); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	err = InitStore("services", GenericStoreOption{
-		BasePath: conf.ETCDConfig.Prefix + "/services",
-		Prefix:   conf.ETCDConfig.Prefix,
-	}, stg)
-	if err != nil {
+// InitTargetStore creates the store of a watched resource under the prefix of a target
+func InitTargetStore(target, prefix string, stg Interface, res *conf.Resource) (err error) {
+	basePath := prefix + "/" + res.Name
+	message.RegisterA6Type(basePath, message.A6TypeNames[res.Type])
+
+	opt := GenericStoreOption{
+		BasePath: basePath,
+		Prefix:   prefix,
+		Target:   target,
+	}
+	if opt.Include, err = compilePatterns(res.Include); err != nil {
 		return
 	}
-
-	err = InitStore("upstreams", GenericStoreOption{
-		BasePath: conf.ETCDConfig.Prefix + "/upstreams",
-		Prefix:   conf.ETCDConfig.Prefix,
-	}, stg)
-	if err != nil {
+	if opt.Exclude, err = compilePatterns(res.Exclude); err != nil {
 		return
 	}
 
-	return
+	return InitStore(res.Name, opt, stg)
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Errorf("compile pattern %s err: %s", pattern, err)
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
 }
 
 func FromatKey(key, prefix string) (string, string, string) {
@@ -67,21 +111,74 @@ func FromatKey(key, prefix string) (string, string, string) {
 }
 
 func GetStore(entity string) *GenericStore {
-	if s, ok := storeHub[entity]; ok {
+	return GetTargetStore("", entity)
+}
+
+func GetTargetStore(target, entity string) *GenericStore {
+	if s, ok := LookupTargetStore(target, entity); ok {
 		return s
 	}
-	panic(fmt.Sprintf("no store with key: %s", entity))
+	panic(fmt.Sprintf("no store with key: %s in target: %q", entity, target))
 }
 
+// LookupTargetStore is like GetTargetStore but reports whether the store exists
+func LookupTargetStore(target, entity string) (*GenericStore, bool) {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
+	s, ok := storeHub[target][entity]
+	return s, ok
+}
+
+// LookupUpstream returns the cached upstream of a target by id. The upstreams without service discovery
+// are not cached, see components.Watcher.
+func LookupUpstream(target, id string) (*message.Message, bool) {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
+	for _, s := range storeHub[target] {
+		if message.ToA6Type(s.BasePath()) != message.A6UpstreamsConf {
+			continue
+		}
+		if obj, ok := s.Load(s.BasePath() + "/" + id); ok {
+			return obj.(*message.Message), true
+		}
+	}
+	return nil, false
+}
+
+// GetStores returns the stores of all targets
 func GetStores() []*GenericStore {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
 	stores := make([]*GenericStore, 0, len(storeHub))
-	for _, store := range storeHub {
-		stores = append(stores, store)
+	for _, targetStores := range storeHub {
+		for _, store := range targetStores {
+			stores = append(stores, store)
+		}
 	}
 	return stores
 }
 
+// Dump returns the caches of the stores of all targets ordered by name
+func Dump() []*StoreDump {
+	stores := GetStores()
+	sort.Slice(stores, func(i, j int) bool {
+		return stores[i].Name() < stores[j].Name()
+	})
+
+	dumps := make([]*StoreDump, 0, len(stores))
+	for _, store := range stores {
+		dumps = append(dumps, store.Dump())
+	}
+	return dumps
+}
+
 func ClrearStores() {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
 	for key := range storeHub {
 		delete(storeHub, key)
 	}
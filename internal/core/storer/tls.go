@@ -0,0 +1,171 @@
+package storer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/api7/gopkg/pkg/log"
+
+	"github.com/api7/apisix-seed/internal/conf"
+)
+
+// tlsReloadInterval is the interval to check the changes of the certificate files
+var tlsReloadInterval = 10 * time.Second
+
+// tlsReloader keeps the client certificate and the CA of etcd up to date with their files,
+// so that rotated certificates are used by the following handshakes without a restart
+type tlsReloader struct {
+	conf *conf.TLS
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes map[string]time.Time
+
+	stopCh chan struct{}
+}
+
+// newTLSConfig builds the TLS config of the etcd client.
+// The server certificate is verified in VerifyConnection against the latest CA,
+// so InsecureSkipVerify only disables the verification of the standard library.
+func newTLSConfig(tlsConf *conf.TLS) (*tls.Config, *tlsReloader, error) {
+	if (tlsConf.CertFile == "") != (tlsConf.KeyFile == "") {
+		return nil, nil, errors.New("tls cert and key must both be present or both absent")
+	}
+
+	r := &tlsReloader{
+		conf:     tlsConf,
+		modTimes: make(map[string]time.Time),
+		stopCh:   make(chan struct{}),
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: tlsConf.SNI,
+		// nolint:gosec
+		InsecureSkipVerify: true,
+		VerifyConnection:   r.verifyConnection,
+	}
+	if tlsConf.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			return r.cert, nil
+		}
+	}
+	if tlsConf.SkipVerify() {
+		log.Warn("the certificate of etcd is not verified, which is insecure")
+	}
+
+	return config, r, nil
+}
+
+func (r *tlsReloader) verifyConnection(cs tls.ConnectionState) error {
+	if r.conf.SkipVerify() {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("etcd presents no certificate")
+	}
+
+	r.mutex.RLock()
+	roots := r.roots
+	r.mutex.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// reload reads the certificate files which have changed since the last reload
+func (r *tlsReloader) reload() (bool, error) {
+	changed := false
+	modTimes := make(map[string]time.Time, 3)
+	for _, path := range []string{r.conf.CertFile, r.conf.KeyFile, r.conf.CAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[path] = info.ModTime()
+		if !info.ModTime().Equal(r.modTimes[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.conf.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &c
+	}
+
+	var roots *x509.CertPool
+	if r.conf.CAFile != "" {
+		content, err := ioutil.ReadFile(r.conf.CAFile)
+		if err != nil {
+			return false, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(content) {
+			return false, fmt.Errorf("no certificate found in %s", r.conf.CAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	r.cert = cert
+	r.roots = roots
+	r.mutex.Unlock()
+	r.modTimes = modTimes
+	return true, nil
+}
+
+func (r *tlsReloader) watch() {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := r.reload()
+		if err != nil {
+			// keep the loaded certificates, the files may be in the middle of a rotation
+			log.Errorf("reload etcd certificates failed: %s", err)
+			continue
+		}
+		if changed {
+			log.Info("etcd certificates reloaded")
+		}
+	}
+}
+
+func (r *tlsReloader) stop() {
+	close(r.stopCh)
+}
@@ -0,0 +1,203 @@
+package storer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/api7/apisix-seed/internal/conf"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func writeTestCert(t *testing.T, dir, name string, c *testCert) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certFile, c.pem, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, c.keyPEM(t), 0600))
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apisix-seed-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "private-ca", nil, true)
+	server := newTestCert(t, "etcd.local", ca, false)
+	client := newTestCert(t, "apisix-seed", ca, false)
+	caFile, _ := writeTestCert(t, dir, "ca", ca)
+	certFile, keyFile := writeTestCert(t, dir, "client", client)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	serverCert, err := tls.X509KeyPair(server.pem, server.keyPEM(t))
+	assert.Nil(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(tlsConf *conf.TLS) (string, error) {
+		config, _, err := newTLSConfig(tlsConf)
+		if err != nil {
+			return "", err
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := c.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+	verify := false
+
+	tests := []struct {
+		caseDesc string
+		tlsConf  *conf.TLS
+		wantErr  bool
+	}{
+		{
+			caseDesc: "custom CA and SNI",
+			tlsConf:  &conf.TLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, SNI: "etcd.local"},
+		},
+		{
+			caseDesc: "SNI mismatch",
+			tlsConf:  &conf.TLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, SNI: "other.local"},
+			wantErr:  true,
+		},
+		{
+			caseDesc: "system roots",
+			tlsConf:  &conf.TLS{CertFile: certFile, KeyFile: keyFile, SNI: "etcd.local"},
+			wantErr:  true,
+		},
+		{
+			caseDesc: "insecure",
+			tlsConf:  &conf.TLS{CertFile: certFile, KeyFile: keyFile, Verify: &verify},
+		},
+	}
+	for _, tc := range tests {
+		cn, err := get(tc.tlsConf)
+		if tc.wantErr {
+			assert.NotNil(t, err, tc.caseDesc)
+			continue
+		}
+		assert.Nil(t, err, tc.caseDesc)
+		assert.Equal(t, "apisix-seed", cn, tc.caseDesc)
+	}
+
+	caseDesc := "cert without key"
+	_, _, err = newTLSConfig(&conf.TLS{CertFile: certFile})
+	assert.NotNil(t, err, caseDesc)
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apisix-seed-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "private-ca", nil, true)
+	caFile, _ := writeTestCert(t, dir, "ca", ca)
+	certFile, keyFile := writeTestCert(t, dir, "client", newTestCert(t, "client-1", ca, false))
+
+	config, r, err := newTLSConfig(&conf.TLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+	assert.Nil(t, err)
+	clientCN := func() string {
+		cert, err := config.GetClientCertificate(nil)
+		assert.Nil(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.Nil(t, err)
+		return parsed.Subject.CommonName
+	}
+
+	caseDesc := "unchanged"
+	changed, err := r.reload()
+	assert.Nil(t, err, caseDesc)
+	assert.False(t, changed, caseDesc)
+	assert.Equal(t, "client-1", clientCN(), caseDesc)
+
+	caseDesc = "broken rotation keeps the loaded certificate"
+	assert.Nil(t, ioutil.WriteFile(certFile, []byte("broken"), 0600), caseDesc)
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, future, future), caseDesc)
+	_, err = r.reload()
+	assert.NotNil(t, err, caseDesc)
+	assert.Equal(t, "client-1", clientCN(), caseDesc)
+
+	caseDesc = "rotated"
+	writeTestCert(t, dir, "client", newTestCert(t, "client-2", ca, false))
+	future = future.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, future, future), caseDesc)
+	changed, err = r.reload()
+	assert.Nil(t, err, caseDesc)
+	assert.True(t, changed, caseDesc)
+	assert.Equal(t, "client-2", clientCN(), caseDesc)
+}
@@ -1,7 +1,10 @@
 package discoverer
 
 import (
+	"context"
+
 	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/metrics"
 )
 
 type NewDiscoverFunc func(disConfig interface{}) (Discoverer, error)
@@ -14,3 +17,57 @@ type Discoverer interface {
 	Delete(*message.Message) error
 	Watch() chan *message.Message
 }
+
+// HealthChecker is implemented by the discoverers able to report the connectivity to their registries
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// RegistryPublisher is implemented by the discoverers publishing the nodes of their services to the registry,
+// see registry.Publish. The entities of the other discoverers are written with the nodes injected
+// into the messages they send.
+type RegistryPublisher interface {
+	PublishesNodes()
+}
+
+// InjectsNodes reports whether a discoverer sends the entities with the nodes injected,
+// false when it publishes the nodes to the registry or it is unknown
+func InjectsNodes(typ string) bool {
+	dis, ok := LookupDiscoverer(typ)
+	if !ok {
+		return false
+	}
+	_, ok = dis.(RegistryPublisher)
+	return !ok
+}
+
+// service states of ServiceDump
+const (
+	ServiceOK        = "ok"
+	ServiceStale     = "stale"     // nodes are served from the snapshot as the registry is unreachable
+	ServiceUnwatched = "unwatched" // the service is missing in the registry
+)
+
+// ServiceDump is the cached state of a service, used for debugging
+type ServiceDump struct {
+	ID       string          `json:"id"`
+	Service  string          `json:"service"`
+	Status   string          `json:"status"`
+	Nodes    []*message.Node `json:"nodes"`
+	Entities []string        `json:"entities"`
+}
+
+// Dumper is implemented by the discoverers able to dump their caches
+type Dumper interface {
+	Dump() []*ServiceDump
+}
+
+// observeNodes records the number of nodes currently served for the service
+func observeNodes(dis, id string, nodes []*message.Node) {
+	metrics.ServiceNodes.WithLabelValues(dis, id).Set(float64(len(nodes)))
+}
+
+// forgetNodes drops the service which is no longer served
+func forgetNodes(dis, id string) {
+	metrics.ServiceNodes.DeleteLabelValues(dis, id)
+}
@@ -36,3 +36,8 @@ func (m *MockInterface) Watch() chan *message.Message {
 	ret := m.Called()
 	return ret.Get(0).(chan *message.Message)
 }
+
+func (m *MockInterface) Dump() []*ServiceDump {
+	ret := m.Called()
+	return ret.Get(0).([]*ServiceDump)
+}
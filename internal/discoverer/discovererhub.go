@@ -2,6 +2,7 @@ package discoverer
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/api7/gopkg/pkg/log"
 
@@ -12,7 +13,11 @@ var (
 	Discoveries = make(map[string]NewDiscoverFunc)
 )
 
-var discovererHub = map[string]Discoverer{}
+var (
+	// hubMutex guards discovererHub, which is changed when the configuration is reloaded
+	hubMutex      sync.RWMutex
+	discovererHub = map[string]Discoverer{}
+)
 
 func InitDiscoverer(key string, disConfig interface{}) error {
 	discoverer, err := Discoveries[key](disConfig)
@@ -21,11 +26,44 @@ func InitDiscoverer(key string, disConfig interface{}) error {
 		return err
 	}
 
+	hubMutex.Lock()
 	discovererHub[key] = discoverer
+	hubMutex.Unlock()
 	return nil
 }
 
+// ReplaceDiscoverer creates the discoverer of key with a new configuration, and returns the previous one to be stopped.
+// The previous one is kept when the new one fails to be created.
+func ReplaceDiscoverer(key string, disConfig interface{}) (Discoverer, error) {
+	discoverer, err := Discoveries[key](disConfig)
+	if err != nil {
+		log.Errorf("New %s Discoverer err: %s", key, err)
+		return nil, err
+	}
+
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	old := discovererHub[key]
+	discovererHub[key] = discoverer
+	return old, nil
+}
+
+// RemoveDiscoverer removes the discoverer of key and returns it to be stopped
+func RemoveDiscoverer(key string) Discoverer {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	discoverer := discovererHub[key]
+	delete(discovererHub, key)
+	return discoverer
+}
+
 func InitDiscoverers() (err error) {
+	if err = InitSnapshot(conf.SnapshotConfig); err != nil {
+		return
+	}
+
 	for key, disConfig := range conf.DisConfigs {
 		err = InitDiscoverer(key, disConfig)
 		if err != nil {
@@ -36,16 +74,42 @@ func InitDiscoverers() (err error) {
 }
 
 func GetDiscoverer(key string) Discoverer {
-	if d, ok := discovererHub[key]; ok {
+	if d, ok := LookupDiscoverer(key); ok {
 		return d
 	}
 	panic(fmt.Sprintf("no discoverer with key: %s", key))
 }
 
+// LookupDiscoverer is like GetDiscoverer but reports whether the discoverer exists
+func LookupDiscoverer(key string) (Discoverer, bool) {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
+	d, ok := discovererHub[key]
+	return d, ok
+}
+
 func GetDiscoverers() []Discoverer {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
 	discoverers := make([]Discoverer, 0, len(discovererHub))
 	for _, discoverer := range discovererHub {
 		discoverers = append(discoverers, discoverer)
 	}
 	return discoverers
 }
+
+// Dump returns the cached services of each discoverer
+func Dump() map[string][]*ServiceDump {
+	hubMutex.RLock()
+	defer hubMutex.RUnlock()
+
+	dumps := make(map[string][]*ServiceDump, len(discovererHub))
+	for key, discoverer := range discovererHub {
+		if dumper, ok := discoverer.(Dumper); ok {
+			dumps[key] = dumper.Dump()
+		}
+	}
+	return dumps
+}
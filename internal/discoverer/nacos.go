@@ -1,18 +1,24 @@
 package discoverer
 
 import (
+	"context"
 	"fmt"
 	"hash"
 	"hash/crc32"
+	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/nacos-group/nacos-sdk-go/common/logger"
 
 	"github.com/api7/apisix-seed/internal/conf"
 	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/core/registry"
+	"github.com/api7/apisix-seed/internal/metrics"
 	"github.com/api7/gopkg/pkg/log"
 	"github.com/nacos-group/nacos-sdk-go/clients"
 	"github.com/nacos-group/nacos-sdk-go/clients/naming_client"
@@ -21,6 +27,8 @@ import (
 	"github.com/nacos-group/nacos-sdk-go/vo"
 )
 
+const nacosRefetchInterval = 5 * time.Second
+
 func init() {
 	Discoveries["nacos"] = NewNacosDiscoverer
 }
@@ -35,12 +43,17 @@ func serviceID(service string, args map[string]interface{}) string {
 	return serviceId
 }
 
+// nacosKey returns the key of the service in the registry
+func nacosKey(serviceId string) string {
+	return registry.Key("nacos", serviceId)
+}
+
+// NacosService is a subscribed service, its nodes and the entities using it are kept in the registry
 type NacosService struct {
-	id     string
-	name   string
-	args   map[string]interface{}
-	nodes  []*message.Node             // nodes are the upstream machines of the service
-	a6Conf map[string]*message.Message // entities are the upstreams/services/routes that use the service
+	id    string
+	name  string
+	args  map[string]interface{}
+	stale bool // nodes are served from the snapshot as nacos is unreachable
 }
 
 type NacosDiscoverer struct {
@@ -62,7 +75,8 @@ type NacosDiscoverer struct {
 
 	crc hash.Hash32
 
-	msgCh chan *message.Message
+	msgCh  chan *message.Message
+	stopCh chan struct{}
 }
 
 func NewNacosDiscoverer(disConfig interface{}) (Discoverer, error) {
@@ -105,120 +119,315 @@ func NewNacosDiscoverer(disConfig interface{}) (Discoverer, error) {
 		cache:          make(map[string]*NacosService),
 		crc:            crc32.NewIEEE(),
 		msgCh:          make(chan *message.Message, 10),
+		stopCh:         make(chan struct{}),
 	}
 	logger.SetLogger(log.DefaultLogger)
 	return &discoverer, nil
 }
 
+// Stop unsubscribes all services. The message channel is left open, as the callbacks of nacos may still be running,
+// they give up sending once the discoverer is stopped.
 func (d *NacosDiscoverer) Stop() {
+	// stop the senders before waiting for the lock they may hold
+	close(d.stopCh)
+
 	d.cacheMutex.Lock()
 	defer d.cacheMutex.Unlock()
 
-	close(d.msgCh)
-
 	// Unsubscribe all services
 	for _, service := range d.cache {
+		if service.stale {
+			continue
+		}
 		d.unsubscribe(service)
 	}
 }
 
+// PublishesNodes marks the discoverer as a RegistryPublisher
+func (d *NacosDiscoverer) PublishesNodes() {}
+
+// Check reports an error when no nacos server is reachable or any service is served from the snapshot
+func (d *NacosDiscoverer) Check(ctx context.Context) error {
+	d.cacheMutex.Lock()
+	stale := 0
+	for _, service := range d.cache {
+		if service.stale {
+			stale++
+		}
+	}
+	d.cacheMutex.Unlock()
+	if stale > 0 {
+		return fmt.Errorf("%d services are served from the snapshot", stale)
+	}
+
+	var err error
+	for _, configs := range d.ServerConfigs {
+		for _, config := range configs {
+			if err = probeNacos(ctx, config); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("nacos is unreachable: %v", err)
+}
+
+// probeNacos requests the liveness endpoint of a nacos server, any response means the server is reachable
+func probeNacos(ctx context.Context, config constant.ServerConfig) error {
+	scheme, contextPath := config.Scheme, config.ContextPath
+	if scheme == "" {
+		scheme = "http"
+	}
+	if contextPath == "" {
+		contextPath = "/nacos"
+	}
+	u := fmt.Sprintf("%s://%s:%d%s/v1/console/health/liveness", scheme, config.IpAddr, config.Port, contextPath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (d *NacosDiscoverer) Query(msg *message.Message) error {
+	_, err := d.QueryContext(context.Background(), msg)
+	return err
+}
+
+// QueryContext binds the entity to its service, which is fetched and subscribed when it is not cached yet
+func (d *NacosDiscoverer) QueryContext(ctx context.Context, msg *message.Message) (*ServiceNodes, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	serviceId := serviceID(msg.ServiceName(), msg.DiscoveryArgs())
 
 	d.cacheMutex.Lock()
-	defer d.cacheMutex.Unlock()
+	err := d.query(serviceId, msg)
+	sn := boundNodes(nacosKey(serviceId))
+	d.cacheMutex.Unlock()
+	if err != nil {
+		return nil, newError(ErrorTemporary, ServiceID(msg), err)
+	}
+	// sent without holding cacheMutex, so that a slow receiver never blocks the callbacks
+	d.send(msg)
+	return sn, nil
+}
 
-	if discover, ok := d.cache[serviceId]; ok {
-		// cache information is already available
-		msg.InjectNodes(discover.nodes)
-		discover.a6Conf[msg.Key] = msg
-	} else {
+// query binds the entity to the service, which is fetched when it is not cached yet.
+// The caller must hold cacheMutex and send the entity after releasing it.
+func (d *NacosDiscoverer) query(serviceId string, msg *message.Message) error {
+	if _, ok := d.cache[serviceId]; !ok {
 		// fetch new service information
 		dis := &NacosService{
 			id:   serviceId,
 			name: msg.ServiceName(),
 			args: msg.DiscoveryArgs(),
 		}
-		nodes, err := d.fetch(dis)
+		nodes, err := d.fetchOrSnapshot(dis)
 		if err != nil {
 			return err
 		}
 
-		msg.InjectNodes(nodes)
-
-		dis.nodes = nodes
-		dis.a6Conf = map[string]*message.Message{
-			msg.Key: msg,
-		}
-
+		registry.Publish(nacosKey(serviceId), nodes)
+		observeNodes("nacos", serviceId, nodes)
 		d.cache[serviceId] = dis
 	}
-	d.msgCh <- msg
-
+	registry.Bind(nacosKey(serviceId), msg)
 	return nil
 }
 
+// release unsubscribes the service when no entity is bound to it any longer.
+// The caller must hold cacheMutex.
+func (d *NacosDiscoverer) release(serviceId string) {
+	discover, ok := d.cache[serviceId]
+	if !ok || len(registry.Entities(nacosKey(serviceId))) > 0 {
+		return
+	}
+	if !discover.stale {
+		d.unsubscribe(discover)
+	}
+	delete(d.cache, serviceId)
+	snapshot.Delete("nacos", serviceId)
+	forgetNodes("nacos", serviceId)
+}
+
 func (d *NacosDiscoverer) Delete(msg *message.Message) error {
+	return d.DeleteContext(context.Background(), msg)
+}
+
+// DeleteContext unbinds the entity, the service is unsubscribed when it is not used any longer
+func (d *NacosDiscoverer) DeleteContext(ctx context.Context, msg *message.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	serviceId := serviceID(msg.ServiceName(), msg.DiscoveryArgs())
 
 	d.cacheMutex.Lock()
 	defer d.cacheMutex.Unlock()
 
-	if discover, ok := d.cache[serviceId]; ok {
-		delete(discover.a6Conf, msg.Key)
-
-		// When a service is not used, it needs to be unsubscribed
-		if len(discover.a6Conf) == 0 {
-			d.unsubscribe(discover)
-			delete(d.cache, serviceId)
-		}
-	}
+	registry.Unbind(msg)
+	// When a service is not used, it needs to be unsubscribed
+	d.release(serviceId)
 	return nil
 }
 
 func (d *NacosDiscoverer) Update(oldMsg, msg *message.Message) error {
+	_, err := d.UpdateContext(context.Background(), oldMsg, msg)
+	return err
+}
+
+// UpdateContext binds the updated entity to its service, nothing is returned when the entity is not bound yet
+func (d *NacosDiscoverer) UpdateContext(ctx context.Context, oldMsg, msg *message.Message) (*ServiceNodes, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	msgArgs := oldMsg.DiscoveryArgs()
 	newMsgArgs := msg.DiscoveryArgs()
 	serviceId := serviceID(oldMsg.ServiceName(), msgArgs)
 	newServiceId := serviceID(msg.ServiceName(), newMsgArgs)
 
+	d.cacheMutex.Lock()
+	if _, ok := d.cache[serviceId]; !ok {
+		d.cacheMutex.Unlock()
+		return nil, nil
+	}
+	if serviceId == newServiceId && reflect.DeepEqual(msgArgs["metadata"], newMsgArgs["metadata"]) {
+		// keep the latest form of the entity to render
+		registry.Bind(nacosKey(serviceId), msg)
+		sn := boundNodes(nacosKey(serviceId))
+		d.cacheMutex.Unlock()
+		return sn, nil
+	}
+
+	// the service is fetched again with the new metadata unless other entities still use it
+	registry.Unbind(oldMsg)
+	d.release(serviceId)
+	err := d.query(newServiceId, msg)
+	sn := boundNodes(nacosKey(newServiceId))
+	d.cacheMutex.Unlock()
+	if err != nil {
+		return nil, newError(ErrorTemporary, ServiceID(msg), err)
+	}
+	d.send(msg)
+	return sn, nil
+}
+
+func (d *NacosDiscoverer) Watch() chan *message.Message {
+	return d.msgCh
+}
+
+// send delivers the message unless the discoverer is stopped
+func (d *NacosDiscoverer) send(msg *message.Message) {
+	select {
+	case <-d.stopCh:
+	case d.msgCh <- msg:
+	}
+}
+
+// Dump returns the cached services with their nodes and bound entities
+func (d *NacosDiscoverer) Dump() []*ServiceDump {
 	d.cacheMutex.Lock()
 	defer d.cacheMutex.Unlock()
-	if discover, ok := d.cache[serviceId]; ok {
-		if serviceId == newServiceId && reflect.DeepEqual(msgArgs["metadata"], newMsgArgs["metadata"]) {
-			discover.a6Conf[msg.Key].Version = msg.Version
-			return nil
+
+	dumps := make([]*ServiceDump, 0, len(d.cache))
+	for _, discover := range d.cache {
+		dump := &ServiceDump{
+			ID:       discover.id,
+			Service:  discover.name,
+			Status:   ServiceOK,
+			Entities: registry.Entities(nacosKey(discover.id)),
 		}
+		if snapshot, ok := registry.Lookup(nacosKey(discover.id)); ok {
+			dump.Nodes = snapshot.Nodes
+		}
+		if discover.stale {
+			dump.Status = ServiceStale
+		}
+		dumps = append(dumps, dump)
+	}
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].ID < dumps[j].ID
+	})
+	return dumps
+}
 
-		d.unsubscribe(discover)
+// fetchOrSnapshot fetches the service from nacos, and falls back to the snapshot when nacos is unreachable.
+// The caller must hold cacheMutex and put the service into the cache.
+func (d *NacosDiscoverer) fetchOrSnapshot(service *NacosService) ([]*message.Node, error) {
+	nodes, err := d.fetch(service)
+	if err == nil {
+		service.stale = false
+		snapshot.Set("nacos", service.id, nodes)
+		return nodes, nil
+	}
 
-		newDiscover := &NacosService{
-			args: msg.DiscoveryArgs(),
-			id:   newServiceId,
-			name: msg.ServiceName(),
-		}
-		nodes, err := d.fetch(newDiscover)
-		if err != nil {
-			return err
+	nodes, ok := snapshot.Get("nacos", service.id)
+	if !ok {
+		return nil, err
+	}
+	log.Warnf("Nacos service[%s] is unreachable, serve nodes from the snapshot: %s", service.id, err)
+	service.stale = true
+	go d.refetch(service.id)
+	return nodes, nil
+}
+
+// refetch retries a service served from the snapshot until nacos is reachable again
+func (d *NacosDiscoverer) refetch(serviceId string) {
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-time.After(nacosRefetchInterval):
 		}
 
-		msg.InjectNodes(nodes)
-		newDiscover.nodes = nodes
-		newDiscover.a6Conf = map[string]*message.Message{
-			msg.Key: msg,
+		if d.tryRefetch(serviceId) {
+			return
 		}
+	}
+}
 
-		delete(d.cache, serviceId)
-		d.cache[newServiceId] = newDiscover
+func (d *NacosDiscoverer) tryRefetch(serviceId string) bool {
+	entities, done := d.refetchNodes(serviceId)
+	for _, msg := range entities {
+		d.send(msg)
+	}
+	return done
+}
 
-		d.msgCh <- msg
+// refetchNodes fetches the stale service and returns the entities to notify
+func (d *NacosDiscoverer) refetchNodes(serviceId string) ([]*message.Message, bool) {
+	d.cacheMutex.Lock()
+	defer d.cacheMutex.Unlock()
+
+	select {
+	case <-d.stopCh:
+		return nil, true
+	default:
 	}
 
-	return nil
-}
+	discover, ok := d.cache[serviceId]
+	if !ok || !discover.stale {
+		return nil, true
+	}
 
-func (d *NacosDiscoverer) Watch() chan *message.Message {
-	return d.msgCh
+	nodes, err := d.fetch(discover)
+	if err != nil {
+		log.Warnf("Nacos refetch service[%s] failed: %s", serviceId, err)
+		return nil, false
+	}
+	log.Infof("Nacos service[%s] is reachable again", serviceId)
+	snapshot.Set("nacos", serviceId, nodes)
+	discover.stale = false
+	observeNodes("nacos", serviceId, nodes)
+	return registry.Publish(nacosKey(serviceId), nodes), true
 }
 
 func (d *NacosDiscoverer) fetch(service *NacosService) ([]*message.Node, error) {
@@ -227,7 +436,8 @@ func (d *NacosDiscoverer) fetch(service *NacosService) ([]*message.Node, error)
 	if _, ok := d.namingClients[namespace]; !ok {
 		err := d.newClient(namespace)
 		if err != nil {
-			return nil, err
+			// the client configuration is invalid, retrying does not help
+			return nil, &Error{Kind: ErrorInvalid, Service: "nacos/" + service.name, Err: err}
 		}
 	}
 
@@ -282,6 +492,11 @@ func (d *NacosDiscoverer) fetch(service *NacosService) ([]*message.Node, error)
 
 func (d *NacosDiscoverer) newSubscribeCallback(serviceId string, metadata interface{}) func([]model.SubscribeService, error) {
 	return func(services []model.SubscribeService, err error) {
+		start := time.Now()
+		defer func() {
+			metrics.RegistryCallbackDuration.WithLabelValues("nacos").Observe(time.Since(start).Seconds())
+		}()
+
 		nodes := make([]*message.Node, 0)
 		meta, ok := metadata.(map[string]interface{})
 
@@ -311,14 +526,19 @@ func (d *NacosDiscoverer) newSubscribeCallback(serviceId string, metadata interf
 		}
 
 		d.cacheMutex.Lock()
-		defer d.cacheMutex.Unlock()
-
-		discover := d.cache[serviceId]
-		discover.nodes = nodes
-
-		for _, msg := range discover.a6Conf {
-			msg.InjectNodes(nodes)
-			d.msgCh <- msg
+		if _, ok := d.cache[serviceId]; !ok {
+			// the service has been unsubscribed
+			d.cacheMutex.Unlock()
+			return
+		}
+		snapshot.Set("nacos", serviceId, nodes)
+		observeNodes("nacos", serviceId, nodes)
+		entities := registry.Publish(nacosKey(serviceId), nodes)
+		d.cacheMutex.Unlock()
+
+		// sent without holding cacheMutex, so that a slow receiver never blocks Query
+		for _, msg := range entities {
+			d.send(msg)
 		}
 	}
 }
@@ -1,18 +1,23 @@
 package discoverer
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/core/registry"
 	"gopkg.in/yaml.v3"
 
 	"github.com/api7/apisix-seed/internal/conf"
 	"github.com/nacos-group/nacos-sdk-go/clients"
+	"github.com/nacos-group/nacos-sdk-go/clients/naming_client"
 	"github.com/nacos-group/nacos-sdk-go/common/constant"
 	"github.com/nacos-group/nacos-sdk-go/vo"
 	"github.com/stretchr/testify/assert"
@@ -350,6 +355,135 @@ func registerService(t *testing.T, ip string, group string, metadata map[string]
 }
 
 func naMsg2Value(msg *message.Message) string {
-	str, _ := msg.Marshal()
+	rendered, _, _ := registry.Render(msg.ID())
+	if rendered == nil {
+		return ""
+	}
+	str, _ := rendered.Marshal()
 	return string(str)
 }
+
+func TestNacosCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/nacos/v1/console/health/liveness", r.URL.Path)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	d := &NacosDiscoverer{
+		ServerConfigs: map[string][]constant.ServerConfig{
+			"": {
+				{IpAddr: "127.0.0.1", Port: 1, Scheme: "http"},
+				{IpAddr: u.Hostname(), Port: uint64(port), Scheme: "http"},
+			},
+		},
+		cache: map[string]*NacosService{
+			"@@APISIX-NACOS": {id: "@@APISIX-NACOS"},
+		},
+	}
+
+	caseDesc := "reachable"
+	assert.Nil(t, d.Check(context.Background()), caseDesc)
+
+	caseDesc = "served from the snapshot"
+	d.cache["@@APISIX-NACOS"].stale = true
+	assert.EqualError(t, d.Check(context.Background()), "1 services are served from the snapshot", caseDesc)
+
+	caseDesc = "unreachable"
+	d.cache["@@APISIX-NACOS"].stale = false
+	ts.Close()
+	assert.NotNil(t, d.Check(context.Background()), caseDesc)
+}
+
+func TestNacosDump(t *testing.T) {
+	nodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	d := &NacosDiscoverer{
+		cache: map[string]*NacosService{
+			"@@APISIX-NACOS": {
+				id:   "@@APISIX-NACOS",
+				name: "APISIX-NACOS",
+			},
+			"@@APISIX-BACKUP": {
+				id:    "@@APISIX-BACKUP",
+				name:  "APISIX-BACKUP",
+				stale: true,
+			},
+		},
+	}
+	defer registry.Clear()
+	registry.Publish(nacosKey("@@APISIX-NACOS"), nodes)
+	registry.Publish(nacosKey("@@APISIX-BACKUP"), nodes)
+	registry.Bind(nacosKey("@@APISIX-NACOS"), &message.Message{Key: "/apisix/routes/2"})
+	registry.Bind(nacosKey("@@APISIX-NACOS"), &message.Message{Key: "/apisix/routes/1"})
+	registry.Bind(nacosKey("@@APISIX-BACKUP"), &message.Message{Key: "/apisix/upstreams/1", Target: "bu1"})
+
+	assert.Equal(t, []*ServiceDump{
+		{
+			ID:       "@@APISIX-BACKUP",
+			Service:  "APISIX-BACKUP",
+			Status:   ServiceStale,
+			Nodes:    nodes,
+			Entities: []string{"bu1:/apisix/upstreams/1"},
+		},
+		{
+			ID:       "@@APISIX-NACOS",
+			Service:  "APISIX-NACOS",
+			Status:   ServiceOK,
+			Nodes:    nodes,
+			Entities: []string{"/apisix/routes/1", "/apisix/routes/2"},
+		},
+	}, d.Dump())
+}
+
+func TestNacosV2(t *testing.T) {
+	nodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	d := &NacosDiscoverer{
+		cache: map[string]*NacosService{
+			"@@APISIX-NACOS": {
+				id:   "@@APISIX-NACOS",
+				name: "APISIX-NACOS",
+			},
+		},
+		// no server to create the clients with
+		ServerConfigs: map[string][]constant.ServerConfig{"": {}},
+		namingClients: make(map[string][]naming_client.INamingClient),
+		msgCh:         make(chan *message.Message, 10),
+		stopCh:        make(chan struct{}),
+	}
+	defer registry.Clear()
+	registry.Publish(nacosKey("@@APISIX-NACOS"), nodes)
+	assert.Equal(t, DiscovererV2(d), V2(d), "implement v2 natively")
+
+	newMsg := func(a6Str string) *message.Message {
+		msg, err := message.NewMessage("/apisix/routes/1", []byte(a6Str), 1, message.EventAdd, message.A6RoutesConf)
+		assert.Nil(t, err)
+		return msg
+	}
+	msg := newMsg(`{"uri":"/hh","upstream":{"service_name":"APISIX-NACOS","discovery_type":"nacos"}}`)
+
+	caseDesc := "query a cached service"
+	sn, err := d.QueryContext(context.Background(), msg)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, &ServiceNodes{ID: nacosKey("@@APISIX-NACOS"), Nodes: nodes}, sn, caseDesc)
+	assert.Equal(t, msg, <-d.msgCh, caseDesc)
+
+	caseDesc = "update the entity of the same service"
+	updated := newMsg(`{"uri":"/updated","upstream":{"service_name":"APISIX-NACOS","discovery_type":"nacos"}}`)
+	sn, err = d.UpdateContext(context.Background(), msg, updated)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, nacosKey("@@APISIX-NACOS"), sn.ID, caseDesc)
+
+	caseDesc = "invalid client configuration"
+	invalid := newMsg(`{"uri":"/hh","upstream":{"service_name":"APISIX-INVALID","discovery_type":"nacos"}}`)
+	_, err = d.QueryContext(context.Background(), invalid)
+	assert.NotNil(t, err, caseDesc)
+	assert.False(t, IsTemporary(err), caseDesc)
+
+	caseDesc = "done context"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, d.DeleteContext(ctx, msg), context.Canceled, caseDesc)
+	_, err = d.QueryContext(ctx, msg)
+	assert.ErrorIs(t, err, context.Canceled, caseDesc)
+}
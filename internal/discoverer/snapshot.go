@@ -0,0 +1,161 @@
+package discoverer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/api7/gopkg/pkg/log"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+)
+
+var snapshot = NewSnapshot("")
+
+// snapshotSaveDelay batches the changes written to the snapshot file, see Set
+var snapshotSaveDelay = time.Second
+
+// Snapshot keeps the last known good nodes of each service,
+// so that they can still be served when a registry is unreachable
+type Snapshot struct {
+	path string
+
+	mutex sync.Mutex
+	// discoverer name -> service id -> nodes
+	services map[string]map[string][]*message.Node
+	// a save is scheduled, see schedule
+	scheduled bool
+
+	// saveMutex keeps the saves in order
+	saveMutex sync.Mutex
+}
+
+// NewSnapshot creates a snapshot persisted in path, an empty path keeps the snapshot in memory only
+func NewSnapshot(path string) *Snapshot {
+	return &Snapshot{
+		path:     path,
+		services: make(map[string]map[string][]*message.Node),
+	}
+}
+
+// InitSnapshot loads the snapshot file declared in the configuration
+func InitSnapshot(snapshotConf *conf.Snapshot) error {
+	if snapshotConf == nil || snapshotConf.Path == "" {
+		return nil
+	}
+
+	s := NewSnapshot(snapshotConf.Path)
+	if err := s.load(); err != nil {
+		log.Errorf("load snapshot %s failed: %s", s.path, err)
+		return err
+	}
+	snapshot = s
+	return nil
+}
+
+func (s *Snapshot) load() error {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, &s.services)
+}
+
+// Get returns the last known good nodes of the service
+func (s *Snapshot) Get(dis, id string) ([]*message.Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nodes, ok := s.services[dis][id]
+	return nodes, ok
+}
+
+// Set records the nodes of the service, the snapshot file is saved in the background.
+// It is cheap enough to be called while holding the locks of the discoverers.
+func (s *Snapshot) Set(dis, id string, nodes []*message.Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.services[dis]; !ok {
+		s.services[dis] = make(map[string][]*message.Node)
+	}
+	s.services[dis][id] = nodes
+	s.schedule()
+}
+
+// Delete forgets the service, e.g. when it is not used any longer
+func (s *Snapshot) Delete(dis, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.services[dis][id]; !ok {
+		return
+	}
+	delete(s.services[dis], id)
+	s.schedule()
+}
+
+// schedule saves the snapshot file after snapshotSaveDelay, the changes made meanwhile are saved together.
+// The caller must hold mutex.
+func (s *Snapshot) schedule() {
+	if s.path == "" || s.scheduled {
+		return
+	}
+	s.scheduled = true
+	time.AfterFunc(snapshotSaveDelay, s.Flush)
+}
+
+// Flush saves the changes not saved yet, e.g. before exiting
+func (s *Snapshot) Flush() {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	s.mutex.Lock()
+	if !s.scheduled {
+		s.mutex.Unlock()
+		return
+	}
+	s.scheduled = false
+	content, err := json.Marshal(s.services)
+	s.mutex.Unlock()
+
+	if err == nil {
+		err = s.save(content)
+	}
+	if err != nil {
+		log.Errorf("save snapshot %s failed: %s", s.path, err)
+	}
+}
+
+// FlushSnapshot saves the changes of the snapshot not saved yet
+func FlushSnapshot() {
+	snapshot.Flush()
+}
+
+// save atomically replaces the snapshot file
+func (s *Snapshot) save(content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,64 @@
+package discoverer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/message"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apisix-seed-snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+	nodes := []*message.Node{
+		{Host: "1.1.1.1", Port: 80, Weight: 1},
+	}
+
+	caseDesc := "memory only"
+	s := NewSnapshot("")
+	s.Set("nacos", "@@APISIX-NACOS", nodes)
+	got, ok := s.Get("nacos", "@@APISIX-NACOS")
+	assert.True(t, ok, caseDesc)
+	assert.Equal(t, nodes, got, caseDesc)
+	_, ok = s.Get("zookeeper", "@@APISIX-NACOS")
+	assert.False(t, ok, caseDesc)
+
+	caseDesc = "init without snapshot file"
+	assert.Nil(t, InitSnapshot(&conf.Snapshot{Path: path}), caseDesc)
+	_, ok = snapshot.Get("nacos", "@@APISIX-NACOS")
+	assert.False(t, ok, caseDesc)
+
+	caseDesc = "save in the background"
+	snapshot.Set("nacos", "@@APISIX-NACOS", nodes)
+	snapshot.Set("nacos", "@@APISIX-DELETED", nodes)
+	snapshot.Delete("nacos", "@@APISIX-DELETED")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, caseDesc)
+
+	caseDesc = "persist and load"
+	FlushSnapshot()
+	snapshot = NewSnapshot("")
+	assert.Nil(t, InitSnapshot(&conf.Snapshot{Path: path}), caseDesc)
+	got, ok = snapshot.Get("nacos", "@@APISIX-NACOS")
+	assert.True(t, ok, caseDesc)
+	assert.Equal(t, nodes, got, caseDesc)
+	_, ok = snapshot.Get("nacos", "@@APISIX-DELETED")
+	assert.False(t, ok, caseDesc)
+
+	caseDesc = "broken snapshot file"
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{"), 0644), caseDesc)
+	assert.NotNil(t, InitSnapshot(&conf.Snapshot{Path: path}), caseDesc)
+
+	snapshot = NewSnapshot("")
+}
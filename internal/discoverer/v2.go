@@ -0,0 +1,159 @@
+package discoverer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/core/registry"
+)
+
+// ServiceNodes is the node set of a service which an entity is bound to
+type ServiceNodes struct {
+	// ID identifies the service across discoverers, e.g. nacos/@@APISIX-NACOS, see registry.Key
+	ID    string
+	Nodes []*message.Node
+}
+
+// ErrorKind tells the Watcher how to act on an error of a discoverer
+type ErrorKind int
+
+const (
+	// ErrorTemporary is worth retrying, e.g. the registry is unreachable
+	ErrorTemporary ErrorKind = iota
+	// ErrorInvalid is caused by the entity or the configuration, retrying does not help until they are changed,
+	// e.g. the discovery type is not configured
+	ErrorInvalid
+)
+
+// Error is the structured error returned by DiscovererV2
+type Error struct {
+	Kind ErrorKind
+	// Service is the ID of the service, see ServiceNodes
+	Service string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("service %s: %s", e.Service, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsTemporary reports whether the operation is worth retrying, errors not returned by a DiscovererV2
+// are considered temporary, while a done context is not
+func IsTemporary(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var dErr *Error
+	if errors.As(err, &dErr) {
+		return dErr.Kind == ErrorTemporary
+	}
+	return err != nil
+}
+
+// DiscovererV2 is the context-aware discoverer returning the bound node sets and structured errors.
+// Like the optional interfaces of database/sql drivers, it extends Discoverer, and V2 adapts the discoverers
+// which only implement Discoverer. The node changes are still delivered through Watch, which is shared by
+// the Rewriter and its Flush.
+type DiscovererV2 interface {
+	Discoverer
+
+	// QueryContext binds the entity to its service and returns the nodes
+	QueryContext(ctx context.Context, msg *message.Message) (*ServiceNodes, error)
+	// UpdateContext binds the updated entity to its service and returns the nodes
+	UpdateContext(ctx context.Context, oldMsg, msg *message.Message) (*ServiceNodes, error)
+	// DeleteContext unbinds the entity from its service
+	DeleteContext(ctx context.Context, msg *message.Message) error
+}
+
+// V2 returns the discoverer as a DiscovererV2
+func V2(d Discoverer) DiscovererV2 {
+	if v2, ok := d.(DiscovererV2); ok {
+		return v2
+	}
+	return &adapter{Discoverer: d}
+}
+
+// adapter implements DiscovererV2 with the methods of Discoverer. The context is checked before each call
+// as the calls can not be cancelled, and the errors are temporary unless the Discoverer returns an Error.
+type adapter struct {
+	Discoverer
+}
+
+func (a *adapter) QueryContext(ctx context.Context, msg *message.Message) (*ServiceNodes, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := a.Query(msg); err != nil {
+		return nil, wrapError(msg, err)
+	}
+	return serviceNodes(msg), nil
+}
+
+func (a *adapter) UpdateContext(ctx context.Context, oldMsg, msg *message.Message) (*ServiceNodes, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := a.Update(oldMsg, msg); err != nil {
+		return nil, wrapError(msg, err)
+	}
+	return serviceNodes(msg), nil
+}
+
+func (a *adapter) DeleteContext(ctx context.Context, msg *message.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := a.Delete(msg); err != nil {
+		return wrapError(msg, err)
+	}
+	return nil
+}
+
+// ServiceID returns the ID of the service an entity is bound to
+func ServiceID(msg *message.Message) string {
+	return msg.DiscoveryType() + "/" + msg.ServiceName()
+}
+
+func wrapError(msg *message.Message, err error) error {
+	return newError(ErrorTemporary, ServiceID(msg), err)
+}
+
+// newError returns err as an Error of the kind, an Error is returned as it is
+func newError(kind ErrorKind, service string, err error) error {
+	var dErr *Error
+	if errors.As(err, &dErr) {
+		return err
+	}
+	return &Error{Kind: kind, Service: service, Err: err}
+}
+
+// boundNodes returns the nodes published to the registry for a service
+func boundNodes(key string) *ServiceNodes {
+	sn := &ServiceNodes{ID: key}
+	if snapshot, ok := registry.Lookup(key); ok {
+		sn.Nodes = snapshot.Nodes
+	}
+	return sn
+}
+
+// serviceNodes returns the nodes of the service the entity is bound to in the registry,
+// or the nodes injected into the entity by the discoverers not using the registry
+func serviceNodes(msg *message.Message) *ServiceNodes {
+	if snapshot, ok := registry.Resolve(msg.ID()); ok {
+		return &ServiceNodes{
+			ID:    snapshot.Service,
+			Nodes: snapshot.Nodes,
+		}
+	}
+	nodes, _ := msg.Nodes().([]*message.Node)
+	return &ServiceNodes{
+		ID:    ServiceID(msg),
+		Nodes: nodes,
+	}
+}
@@ -0,0 +1,71 @@
+package discoverer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		caseDesc string
+		err      error
+		want     bool
+	}{
+		{caseDesc: "nil", err: nil, want: false},
+		{caseDesc: "plain error", err: errors.New("unreachable"), want: true},
+		{caseDesc: "temporary", err: &Error{Kind: ErrorTemporary, Err: errors.New("unreachable")}, want: true},
+		{caseDesc: "invalid", err: &Error{Kind: ErrorInvalid, Err: errors.New("invalid")}, want: false},
+		{caseDesc: "wrapped invalid", err: fmt.Errorf("query: %w", &Error{Kind: ErrorInvalid}), want: false},
+		{caseDesc: "canceled", err: context.Canceled, want: false},
+		{caseDesc: "deadline exceeded", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, IsTemporary(tc.err), tc.caseDesc)
+	}
+}
+
+func TestAdapter(t *testing.T) {
+	givenNodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	givenA6Str := `{"uri":"/hh","upstream":{"service_name":"APISIX-NACOS","discovery_type":"nacos"}}`
+	msg, err := message.NewMessage("/prefix/mocks/1", []byte(givenA6Str), 1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+
+	mDis := &MockInterface{}
+	d := V2(mDis)
+	_, ok := d.(*adapter)
+	assert.True(t, ok, "adapt the v1 discoverer")
+	assert.Equal(t, d, V2(d), "keep the v2 discoverer")
+
+	caseDesc := "query"
+	mDis.On("Query", mock.Anything).Run(func(args mock.Arguments) {
+		args[0].(*message.Message).InjectNodes(givenNodes)
+	}).Return(nil).Once()
+	nodes, err := d.QueryContext(context.Background(), msg)
+	assert.Nil(t, err, caseDesc)
+	assert.Equal(t, "nacos/APISIX-NACOS", nodes.ID, caseDesc)
+	assert.Equal(t, givenNodes, nodes.Nodes, caseDesc)
+
+	caseDesc = "wrap the error"
+	mDis.On("Update", mock.Anything, mock.Anything).Return(errors.New("unreachable")).Once()
+	_, err = d.UpdateContext(context.Background(), msg, msg)
+	assert.EqualError(t, err, "service nacos/APISIX-NACOS: unreachable", caseDesc)
+	assert.True(t, IsTemporary(err), caseDesc)
+
+	caseDesc = "keep the structured error"
+	mDis.On("Delete", mock.Anything).Return(&Error{Kind: ErrorInvalid, Service: "nacos/APISIX-NACOS", Err: errors.New("invalid")}).Once()
+	err = d.DeleteContext(context.Background(), msg)
+	assert.False(t, IsTemporary(err), caseDesc)
+
+	caseDesc = "done context"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = d.QueryContext(ctx, msg)
+	assert.ErrorIs(t, err, context.Canceled, caseDesc)
+	mDis.AssertNumberOfCalls(t, "Query", 1)
+}
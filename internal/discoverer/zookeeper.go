@@ -3,29 +3,55 @@ package discoverer
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/api7/gopkg/pkg/log"
 
 	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/core/registry"
 
 	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/metrics"
 	"github.com/go-zookeeper/zk"
 	"golang.org/x/net/context"
 )
 
+const zkRewatchInterval = 5 * time.Second
+
 func init() {
 	Discoveries["zookeeper"] = NewZookeeperDiscoverer
 }
 
+// zkKey returns the key of the service in the registry
+func zkKey(serviceName string) string {
+	return registry.Key("zookeeper", serviceName)
+}
+
+// ZookeeperService is a watched service, its nodes and the entities using it are kept in the registry
 type ZookeeperService struct {
 	Name         string
-	mutex        *sync.Mutex
-	BindEntities map[string]*message.Message
 	WatchPath    string
 	WatchContext context.Context
 	WatchCancel  context.CancelFunc
+
+	// stale is 1 while the nodes are served from the snapshot as zookeeper is unreachable
+	stale int32
+}
+
+func (s *ZookeeperService) setStale(stale bool) {
+	var v int32
+	if stale {
+		v = 1
+	}
+	atomic.StoreInt32(&s.stale, v)
+}
+
+func (s *ZookeeperService) isStale() bool {
+	return atomic.LoadInt32(&s.stale) == 1
 }
 
 type ZookeeperDiscoverer struct {
@@ -39,45 +65,139 @@ type ZookeeperDiscoverer struct {
 	msgCh chan *message.Message
 }
 
+// Stop removes all watches and closes the connection. The message channel is left open,
+// as the watches may still be running, they give up sending once the discoverer is stopped.
 func (zd *ZookeeperDiscoverer) Stop() {
+	zd.zkUnWatchCancel()
 	zd.zkWatchServices.Range(func(key, value interface{}) bool {
 		zd.removeWatchService(value.(*ZookeeperService))
 		return true
 	})
-	close(zd.msgCh)
 	zd.zkConn.Close()
-	zd.zkUnWatchCancel()
 }
 
 func (zd *ZookeeperDiscoverer) Query(msg *message.Message) error {
-	return zd.fetchService(msg.ServiceName(), map[string]*message.Message{msg.Key: msg})
+	_, err := zd.QueryContext(context.Background(), msg)
+	return err
 }
 
-func (zd *ZookeeperDiscoverer) Update(oldMsg, msg *message.Message) error {
-	zkService, ok := zd.zkWatchServices.Load(oldMsg.ServiceName())
-	if !ok {
-		return nil
+// QueryContext binds the entity to its service, which is watched when it is not yet
+func (zd *ZookeeperDiscoverer) QueryContext(ctx context.Context, msg *message.Message) (*ServiceNodes, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	service := zkService.(*ZookeeperService)
-	service.mutex.Lock()
-	defer service.mutex.Unlock()
-	if _, ok = service.BindEntities[oldMsg.Key]; ok {
-		service.BindEntities[oldMsg.Key].Version = msg.Version
+	registry.Bind(zkKey(msg.ServiceName()), msg)
+	if err := zd.fetchService(msg.ServiceName(), msg); err != nil {
+		return nil, newError(ErrorTemporary, ServiceID(msg), err)
 	}
+	return boundNodes(zkKey(msg.ServiceName())), nil
+}
+
+// PublishesNodes marks the discoverer as a RegistryPublisher
+func (zd *ZookeeperDiscoverer) PublishesNodes() {}
 
+// Check reports an error when the session with zookeeper is lost or any service is served from the snapshot
+func (zd *ZookeeperDiscoverer) Check(_ context.Context) error {
+	stale := 0
+	zd.zkWatchServices.Range(func(_, value interface{}) bool {
+		if value.(*ZookeeperService).isStale() {
+			stale++
+		}
+		return true
+	})
+	if stale > 0 {
+		return fmt.Errorf("%d services are served from the snapshot", stale)
+	}
+	if state := zd.zkConn.State(); state != zk.StateHasSession {
+		return fmt.Errorf("zookeeper session state: %s", state)
+	}
 	return nil
 }
 
+func (zd *ZookeeperDiscoverer) Update(oldMsg, msg *message.Message) error {
+	_, err := zd.UpdateContext(context.Background(), oldMsg, msg)
+	return err
+}
+
+// UpdateContext binds the updated entity to its service, nothing is returned when the service is not watched
+func (zd *ZookeeperDiscoverer) UpdateContext(ctx context.Context, oldMsg, msg *message.Message) (*ServiceNodes, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := zd.zkWatchServices.Load(oldMsg.ServiceName()); !ok {
+		return nil, nil
+	}
+	// keep the latest form of the entity to render
+	registry.Bind(zkKey(msg.ServiceName()), msg)
+	return boundNodes(zkKey(msg.ServiceName())), nil
+}
+
 func (zd *ZookeeperDiscoverer) Delete(msg *message.Message) error {
-	return zd.removeService(msg.ServiceName(), false)
+	return zd.DeleteContext(context.Background(), msg)
+}
+
+// DeleteContext stops watching the service when no entity is bound to it any longer
+func (zd *ZookeeperDiscoverer) DeleteContext(ctx context.Context, msg *message.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, remaining := registry.Unbind(msg); remaining > 0 {
+		return nil
+	}
+	snapshot.Delete("zookeeper", msg.ServiceName())
+	zd.zkUnWatchServices.Delete(msg.ServiceName())
+	zkService, ok := zd.zkWatchServices.Load(msg.ServiceName())
+	if !ok {
+		return nil
+	}
+	zd.stopWatchService(zkService.(*ZookeeperService))
+	return nil
 }
 
 func (zd *ZookeeperDiscoverer) Watch() chan *message.Message {
 	return zd.msgCh
 }
 
-// fetchService fetch service watch and send message notify
-func (zd *ZookeeperDiscoverer) fetchService(serviceName string, a6conf map[string]*message.Message) error {
+// Dump returns the watched services with their nodes and bound entities,
+// and the services waiting to be created in zookeeper
+func (zd *ZookeeperDiscoverer) Dump() []*ServiceDump {
+	dumps := make([]*ServiceDump, 0)
+	zd.zkWatchServices.Range(func(_, value interface{}) bool {
+		service := value.(*ZookeeperService)
+		dump := &ServiceDump{
+			ID:       service.Name,
+			Service:  service.Name,
+			Status:   ServiceOK,
+			Entities: registry.Entities(zkKey(service.Name)),
+		}
+		if snapshot, ok := registry.Lookup(zkKey(service.Name)); ok {
+			dump.Nodes = snapshot.Nodes
+		}
+		if service.isStale() {
+			dump.Status = ServiceStale
+		}
+		dumps = append(dumps, dump)
+		return true
+	})
+	zd.zkUnWatchServices.Range(func(key, _ interface{}) bool {
+		dumps = append(dumps, &ServiceDump{
+			ID:       key.(string),
+			Service:  key.(string),
+			Status:   ServiceUnwatched,
+			Nodes:    []*message.Node{},
+			Entities: registry.Entities(zkKey(key.(string))),
+		})
+		return true
+	})
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].ID < dumps[j].ID
+	})
+	return dumps
+}
+
+// fetchService fetch service watch and send message notify.
+// Only msg is notified when it is not nil, otherwise all entities bound to the service are.
+func (zd *ZookeeperDiscoverer) fetchService(serviceName string, msg *message.Message) error {
 	var service *ZookeeperService
 	zkService, ok := zd.zkWatchServices.Load(serviceName)
 
@@ -93,28 +213,33 @@ func (zd *ZookeeperDiscoverer) fetchService(serviceName string, a6conf map[strin
 		zd.addWatchService(service)
 	}
 
-	service.mutex.Lock()
-	for k, msg := range a6conf {
-		if _, ok = service.BindEntities[k]; !ok {
-			service.BindEntities[k] = msg
-		} else {
-			service.BindEntities[k].Version = msg.Version
-		}
-	}
-	service.mutex.Unlock()
-
 	serviceInfo, _, err := zd.zkConn.Get(service.WatchPath)
 	if err != nil {
-		return err
+		if err == zk.ErrNoNode {
+			// watched again once it is created, see watchServicePrefix
+			return &Error{Kind: ErrorInvalid, Service: "zookeeper/" + serviceName, Err: err}
+		}
+		// zookeeper is unreachable, serve the last known good nodes
+		nodes, ok := snapshot.Get("zookeeper", serviceName)
+		if !zkUnreachable(err) || !ok {
+			return err
+		}
+		log.Warnf("Zookeeper service[%s] is unreachable, serve nodes from the snapshot: %s", serviceName, err)
+		service.setStale(true)
+		zd.sendMessage(service, nodes, msg)
+		return nil
 	}
 
 	var nodes []*message.Node
 	err = json.Unmarshal(serviceInfo, &nodes)
 	if err != nil {
-		return err
+		// fetched again once the service is changed in zookeeper
+		return &Error{Kind: ErrorInvalid, Service: "zookeeper/" + serviceName, Err: err}
 	}
 
-	zd.sendMessage(service, nodes)
+	snapshot.Set("zookeeper", serviceName, nodes)
+	service.setStale(false)
+	zd.sendMessage(service, nodes, msg)
 
 	return nil
 }
@@ -127,7 +252,7 @@ func (zd *ZookeeperDiscoverer) removeService(serviceName string, isRewrite bool)
 	}
 
 	if isRewrite {
-		zd.sendMessage(zkService.(*ZookeeperService), make([]*message.Node, 0))
+		zd.sendMessage(zkService.(*ZookeeperService), make([]*message.Node, 0), nil)
 	}
 
 	zd.removeWatchService(zkService.(*ZookeeperService))
@@ -135,11 +260,19 @@ func (zd *ZookeeperDiscoverer) removeService(serviceName string, isRewrite bool)
 	return nil
 }
 
-// sendMessage send message notify
-func (zd *ZookeeperDiscoverer) sendMessage(zkService *ZookeeperService, nodes []*message.Node) {
-	for _, msg := range zkService.BindEntities {
-		msg.InjectNodes(nodes)
-		zd.msgCh <- msg
+// sendMessage publishes the nodes and notifies msg, or all bound entities when msg is nil
+func (zd *ZookeeperDiscoverer) sendMessage(zkService *ZookeeperService, nodes []*message.Node, msg *message.Message) {
+	observeNodes("zookeeper", zkService.Name, nodes)
+	entities := registry.Publish(zkKey(zkService.Name), nodes)
+	if msg != nil {
+		entities = []*message.Message{msg}
+	}
+	for _, msg := range entities {
+		select {
+		case <-zd.zkUnWatchContext.Done():
+			return
+		case zd.msgCh <- msg:
+		}
 	}
 }
 
@@ -165,7 +298,11 @@ func NewZookeeperDiscoverer(disConfig interface{}) (Discoverer, error) {
 
 	err = discoverer.initZookeeperRoot()
 	if err != nil {
-		return nil, err
+		if !zkUnreachable(err) {
+			return nil, err
+		}
+		// services can still be served from the snapshot until zookeeper is reachable
+		log.Warnf("zookeeper is unreachable, init root path: %s fail, err: %s", config.Prefix, err)
 	}
 
 	go discoverer.watchServicePrefix()
@@ -173,6 +310,11 @@ func NewZookeeperDiscoverer(disConfig interface{}) (Discoverer, error) {
 	return &discoverer, nil
 }
 
+// zkUnreachable reports whether err is caused by losing the connection to zookeeper
+func zkUnreachable(err error) bool {
+	return err == zk.ErrNoServer || err == zk.ErrConnectionClosed || err == zk.ErrSessionExpired
+}
+
 // initZookeeperRoot generate zookeeper root path
 func (zd *ZookeeperDiscoverer) initZookeeperRoot() error {
 	ok, _, err := zd.zkConn.Exists(zd.zkConfig.Prefix)
@@ -196,8 +338,6 @@ func (zd *ZookeeperDiscoverer) newZookeeperClient(serviceName string) (*Zookeepe
 	watchPath := zd.zkConfig.Prefix + "/" + serviceName
 	service := &ZookeeperService{
 		Name:         serviceName,
-		mutex:        &sync.Mutex{},
-		BindEntities: make(map[string]*message.Message),
 		WatchPath:    watchPath,
 		WatchContext: ctx,
 		WatchCancel:  cancel,
@@ -210,6 +350,15 @@ func (zd *ZookeeperDiscoverer) newZookeeperClient(serviceName string) (*Zookeepe
 func (zd *ZookeeperDiscoverer) watchServicePrefix() {
 	for {
 		_, _, event, err := zd.zkConn.ChildrenW(zd.zkConfig.Prefix)
+		if zkUnreachable(err) {
+			log.Warnf("watch service prefix: %s fail, retry later, err: %s", zd.zkConfig.Prefix, err)
+			select {
+			case <-zd.zkUnWatchContext.Done():
+				return
+			case <-time.After(zkRewatchInterval):
+				continue
+			}
+		}
 		if err != nil {
 			log.Errorf("watch service prefix: %s fail, err: %s", zd.zkConfig.Prefix, err)
 			return
@@ -227,9 +376,8 @@ func (zd *ZookeeperDiscoverer) watchServicePrefix() {
 			}
 
 			for _, serviceName := range serviceNames {
-				a6Entity, ok := zd.zkUnWatchServices.Load(serviceName)
-				if ok {
-					err = zd.fetchService(serviceName, a6Entity.(map[string]*message.Message))
+				if _, ok := zd.zkUnWatchServices.Load(serviceName); ok {
+					err = zd.fetchService(serviceName, nil)
 					if err != nil {
 						log.Errorf("fetch service: %s fail, err: %s", serviceName, err)
 					}
@@ -241,13 +389,32 @@ func (zd *ZookeeperDiscoverer) watchServicePrefix() {
 
 // watchService watch service change
 func (zd *ZookeeperDiscoverer) watchService(service *ZookeeperService) {
+	unreachable := false
 	for {
 		_, _, event, err := zd.zkConn.GetW(service.WatchPath)
+		if zkUnreachable(err) {
+			// zookeeper is unreachable, keep the current nodes and retry later
+			log.Warnf("watch service: %s fail, retry later, err: %s", service.WatchPath, err)
+			unreachable = true
+			select {
+			case <-service.WatchContext.Done():
+				return
+			case <-time.After(zkRewatchInterval):
+				continue
+			}
+		}
 		if err != nil {
 			log.Errorf("watch service: %s fail, err: %s", service.WatchPath, err)
 			zd.removeWatchService(service)
 			return
 		}
+		if unreachable {
+			// the service may have changed while zookeeper was unreachable
+			unreachable = false
+			if err = zd.fetchService(service.Name, nil); err != nil {
+				log.Errorf("fetch service: %s fail, err: %s", service.WatchPath, err)
+			}
+		}
 
 		select {
 		case <-service.WatchContext.Done():
@@ -256,10 +423,12 @@ func (zd *ZookeeperDiscoverer) watchService(service *ZookeeperService) {
 		case e := <-event:
 			switch e.Type {
 			case zk.EventNodeDataChanged:
-				err = zd.fetchService(service.Name, service.BindEntities)
+				start := time.Now()
+				err = zd.fetchService(service.Name, nil)
 				if err != nil {
 					log.Errorf("fetch service: %s fail, err: %s", service.WatchPath, err)
 				}
+				metrics.RegistryCallbackDuration.WithLabelValues("zookeeper").Observe(time.Since(start).Seconds())
 			case zk.EventNodeDeleted:
 				err = zd.removeService(service.Name, true)
 				if err != nil {
@@ -270,11 +439,17 @@ func (zd *ZookeeperDiscoverer) watchService(service *ZookeeperService) {
 	}
 }
 
-// addWatchService remove watch service
+// removeWatchService remove watch service, it is watched again once it is created in zookeeper
 func (zd *ZookeeperDiscoverer) removeWatchService(service *ZookeeperService) {
+	zd.stopWatchService(service)
+	zd.zkUnWatchServices.LoadOrStore(service.Name, struct{}{})
+}
+
+// stopWatchService stops watching the service
+func (zd *ZookeeperDiscoverer) stopWatchService(service *ZookeeperService) {
 	service.WatchCancel()
 	zd.zkWatchServices.Delete(service.Name)
-	zd.zkUnWatchServices.LoadOrStore(service.Name, service.BindEntities)
+	forgetNodes("zookeeper", service.Name)
 	log.Infof("stop watch service: %s", service.Name)
 }
 
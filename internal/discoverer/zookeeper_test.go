@@ -1,9 +1,11 @@
 package discoverer
 
 import (
+	"context"
 	"testing"
 
 	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/core/registry"
 
 	"github.com/api7/apisix-seed/internal/conf"
 	"github.com/go-zookeeper/zk"
@@ -53,7 +55,11 @@ func removeZkService(conn *zk.Conn, svcPath string) error {
 }
 
 func zkMsg2Value(msg *message.Message) string {
-	str, _ := msg.Marshal()
+	rendered, _, _ := registry.Render(msg.ID())
+	if rendered == nil {
+		return ""
+	}
+	str, _ := rendered.Marshal()
 	return string(str)
 }
 
@@ -116,3 +122,39 @@ func TestZookeeperDiscoverer(t *testing.T) {
 	expectValue = `{"uri":"/hh","upstream":{"_discovery_type":"zookeeper","_service_name":"svc","nodes":[]}}`
 	assert.JSONEq(t, expectValue, zkMsg2Value(newMsg))
 }
+
+func TestZookeeperStale(t *testing.T) {
+	nodes := []*message.Node{{Host: "1.1.1.1", Port: 80, Weight: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	service := &ZookeeperService{
+		Name:         "APISIX-ZK",
+		WatchPath:    "/zookeeper/APISIX-ZK",
+		WatchContext: ctx,
+		WatchCancel:  cancel,
+	}
+	zd := &ZookeeperDiscoverer{}
+	zd.zkWatchServices.Store(service.Name, service)
+
+	msg, err := message.NewMessage("/apisix/routes/1",
+		[]byte(`{"uri":"/hh","upstream":{"service_name":"APISIX-ZK","discovery_type":"zookeeper"}}`),
+		1, message.EventAdd, message.A6RoutesConf)
+	assert.Nil(t, err)
+	defer registry.Clear()
+	registry.Publish(zkKey(service.Name), nodes)
+	registry.Bind(zkKey(service.Name), msg)
+	snapshot.Set("zookeeper", service.Name, nodes)
+	defer func() { snapshot = NewSnapshot("") }()
+
+	caseDesc := "served from the snapshot"
+	service.setStale(true)
+	dumps := zd.Dump()
+	assert.Len(t, dumps, 1, caseDesc)
+	assert.Equal(t, ServiceStale, dumps[0].Status, caseDesc)
+	assert.EqualError(t, zd.Check(context.Background()), "1 services are served from the snapshot", caseDesc)
+
+	caseDesc = "forget the released service"
+	assert.Nil(t, zd.DeleteContext(context.Background(), msg), caseDesc)
+	_, ok := snapshot.Get("zookeeper", service.Name)
+	assert.False(t, ok, caseDesc)
+	assert.Len(t, zd.Dump(), 0, caseDesc)
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "apisix_seed"
+
+// results of rewriting an entity
+const (
+	ResultSuccess  = "success"
+	ResultConflict = "conflict"
+	ResultFailure  = "failure"
+	// ResultSkipped is an entity whose nodes are already written
+	ResultSkipped = "skipped"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	// WatchEvents counts the events of APISIX resources
+	WatchEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_events_total",
+		Help:      "The number of watched events of APISIX resources.",
+	}, []string{"target", "resource", "action"})
+
+	// DiscovererOperations counts the queries, updates and deletes sent to discoverers
+	DiscovererOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "discoverer_operations_total",
+		Help:      "The number of operations sent to discoverers.",
+	}, []string{"discoverer", "operation"})
+
+	// DiscovererErrors counts the failed operations of discoverers
+	DiscovererErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "discoverer_errors_total",
+		Help:      "The number of failed operations of discoverers.",
+	}, []string{"discoverer", "operation"})
+
+	// RegistryCallbackDuration observes the time to handle a change pushed by a registry
+	RegistryCallbackDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "registry_callback_duration_seconds",
+		Help:      "The time to handle a change pushed by a registry.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"discoverer"})
+
+	// Rewrites counts the writes of entities to the storage by result
+	Rewrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rewrites_total",
+		Help:      "The number of entities written to the storage by result.",
+	}, []string{"result"})
+
+	// RewriterQueueDepth is the number of entities waiting to be written by the Rewriter of each target
+	RewriterQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rewriter_queue_depth",
+		Help:      "The number of entities waiting to be written.",
+	}, []string{"target"})
+
+	// RewriterQueueWait observes the time an entity waits before it is written
+	RewriterQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rewriter_queue_wait_seconds",
+		Help:      "The time an entity waits before it is written.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"target"})
+
+	// RewriterCoalesced counts the updates merged into the one of the same entity already waiting
+	RewriterCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rewriter_coalesced_total",
+		Help:      "The number of updates merged into the one of the same entity already waiting.",
+	}, []string{"target"})
+
+	// ServiceNodes is the number of nodes of each service
+	ServiceNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_nodes",
+		Help:      "The number of nodes of each service.",
+	}, []string{"discoverer", "service"})
+
+	// ReconcileFixes counts what the reconciliation has fixed by kind
+	ReconcileFixes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_fixes_total",
+		Help:      "The number of entities fixed by the reconciliation.",
+	}, []string{"kind"})
+
+	// DegradedEntities is the number of entities whose services can not be discovered
+	DegradedEntities = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "degraded_entities",
+		Help:      "The number of entities whose services can not be discovered.",
+	})
+
+	// SuppressedUpdates is the number of node updates currently refused by the protection
+	SuppressedUpdates = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "suppressed_updates",
+		Help:      "The number of node updates currently refused by the protection.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		WatchEvents,
+		DiscovererOperations,
+		DiscovererErrors,
+		RegistryCallbackDuration,
+		Rewrites,
+		RewriterQueueDepth,
+		RewriterQueueWait,
+		RewriterCoalesced,
+		ServiceNodes,
+		ReconcileFixes,
+		DegradedEntities,
+		SuppressedUpdates,
+	)
+}
+
+// RegisterQueueDepth exposes the number of messages waiting in the queue of a discoverer
+func RegisterQueueDepth(discoverer string, depth func() int) error {
+	return registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "discoverer_queue_depth",
+		Help:        "The number of messages waiting in the queue of a discoverer.",
+		ConstLabels: prometheus.Labels{"discoverer": discoverer},
+	}, func() float64 {
+		return float64(depth())
+	}))
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
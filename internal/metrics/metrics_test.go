@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	WatchEvents.WithLabelValues("", "routes", "add").Inc()
+	Rewrites.WithLabelValues(ResultConflict).Inc()
+	ServiceNodes.WithLabelValues("nacos", "APISIX-NACOS").Set(3)
+	RegistryCallbackDuration.WithLabelValues("nacos").Observe(0.01)
+
+	depth := 2
+	assert.Nil(t, RegisterQueueDepth("nacos", func() int { return depth }))
+	assert.NotNil(t, RegisterQueueDepth("nacos", func() int { return depth }), "register twice")
+
+	ts := httptest.NewServer(Handler())
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	for _, line := range []string{
+		`apisix_seed_watch_events_total{action="add",resource="routes",target=""} 1`,
+		`apisix_seed_rewrites_total{result="conflict"} 1`,
+		`apisix_seed_service_nodes{discoverer="nacos",service="APISIX-NACOS"} 3`,
+		`apisix_seed_registry_callback_duration_seconds_count{discoverer="nacos"} 1`,
+		`apisix_seed_discoverer_queue_depth{discoverer="nacos"} 2`,
+		`go_goroutines`,
+	} {
+		assert.True(t, strings.Contains(string(body), line), line)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/api7/gopkg/pkg/log"
+)
+
+// checkTimeout limits the time of each readiness check
+var checkTimeout = 3 * time.Second
+
+// CheckFunc reports whether a component is ready, a nil error means ready
+type CheckFunc func(ctx context.Context) error
+
+// ComponentStatus is the readiness of a component
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Status is the body of the health and readiness endpoints
+type Status struct {
+	Status     string                      `json:"status"`
+	Components map[string]*ComponentStatus `json:"components,omitempty"`
+}
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Server is the embedded HTTP server of apisix-seed
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+	srv  *http.Server
+
+	mutex  sync.Mutex
+	checks map[string]CheckFunc
+}
+
+func NewServer(addr string) *Server {
+	s := &Server{
+		addr:   addr,
+		mux:    http.NewServeMux(),
+		checks: make(map[string]CheckFunc),
+	}
+	s.mux.HandleFunc("/healthz", s.healthz)
+	s.mux.HandleFunc("/readyz", s.readyz)
+	return s
+}
+
+// AddReadinessCheck registers the check of a component, which is run on every /readyz request
+func (s *Server) AddReadinessCheck(name string, check CheckFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.checks[name] = check
+}
+
+// RemoveReadinessCheck unregisters the check of a component which is removed
+func (s *Server) RemoveReadinessCheck(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.checks, name)
+}
+
+// Handle registers a handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleDump serves the result of dump as JSON, it is read-only and accepts GET requests only
+func (s *Server) HandleDump(pattern string, dump func() interface{}) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(dump())
+	})
+}
+
+// Start listens on the address and serves in the background
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		log.Errorf("server listen on %s failed: %s", s.addr, err)
+		return err
+	}
+
+	s.srv = &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("server serve failed: %s", err)
+		}
+	}()
+	log.Infof("server listens on %s", ln.Addr().String())
+	return nil
+}
+
+func (s *Server) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	writeStatus(w, &Status{Status: StatusOK})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	checks := make([]CheckFunc, 0, len(s.checks))
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, s.checks[name])
+	}
+	s.mutex.Unlock()
+
+	results := make([]*ComponentStatus, len(checks))
+	wg := sync.WaitGroup{}
+	wg.Add(len(checks))
+	for i := range checks {
+		go func(i int) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+			results[i] = &ComponentStatus{Status: StatusOK}
+			if err := checks[i](ctx); err != nil {
+				results[i] = &ComponentStatus{Status: StatusFail, Error: err.Error()}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	status := &Status{
+		Status:     StatusOK,
+		Components: make(map[string]*ComponentStatus, len(names)),
+	}
+	for i, name := range names {
+		status.Components[name] = results[i]
+		if results[i].Status != StatusOK {
+			status.Status = StatusFail
+		}
+	}
+	writeStatus(w, status)
+}
+
+func writeStatus(w http.ResponseWriter, status *Status) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
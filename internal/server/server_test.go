@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	get := func(path string) (int, *Status) {
+		resp, err := http.Get(ts.URL + path)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		status := &Status{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(status))
+		return resp.StatusCode, status
+	}
+
+	caseDesc := "healthz"
+	code, status := get("/healthz")
+	assert.Equal(t, http.StatusOK, code, caseDesc)
+	assert.Equal(t, StatusOK, status.Status, caseDesc)
+
+	caseDesc = "ready without checks"
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code, caseDesc)
+
+	caseDesc = "ready"
+	s.AddReadinessCheck("etcd", func(context.Context) error { return nil })
+	code, status = get("/readyz")
+	assert.Equal(t, http.StatusOK, code, caseDesc)
+	assert.Equal(t, StatusOK, status.Components["etcd"].Status, caseDesc)
+
+	caseDesc = "not ready"
+	s.AddReadinessCheck("watcher", func(context.Context) error { return errors.New("initial resources are not loaded") })
+	code, status = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, caseDesc)
+	assert.Equal(t, StatusFail, status.Status, caseDesc)
+	assert.Equal(t, StatusOK, status.Components["etcd"].Status, caseDesc)
+	assert.Equal(t, &ComponentStatus{Status: StatusFail, Error: "initial resources are not loaded"},
+		status.Components["watcher"], caseDesc)
+
+	caseDesc = "healthz is not affected"
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code, caseDesc)
+
+	caseDesc = "check removed"
+	s.RemoveReadinessCheck("watcher")
+	code, status = get("/readyz")
+	assert.Equal(t, http.StatusOK, code, caseDesc)
+	assert.Nil(t, status.Components["watcher"], caseDesc)
+}
+
+func TestServerStart(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	assert.Nil(t, s.Start())
+	assert.Nil(t, s.Close())
+
+	assert.NotNil(t, NewServer("invalid address").Start())
+}
+
+func TestHandleDump(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.HandleDump("/debug/stores", func() interface{} {
+		return map[string]int{"routes": 1}
+	})
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	caseDesc := "get"
+	resp, err := http.Get(ts.URL + "/debug/stores")
+	assert.Nil(t, err, caseDesc)
+	defer resp.Body.Close()
+	dump := map[string]int{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&dump), caseDesc)
+	assert.Equal(t, map[string]int{"routes": 1}, dump, caseDesc)
+
+	caseDesc = "read-only"
+	resp, err = http.Post(ts.URL+"/debug/stores", "application/json", nil)
+	assert.Nil(t, err, caseDesc)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, caseDesc)
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"strings"
+)
+
+// DiffLines compares two texts line by line and returns the lines of b prefixed with "+",
+// the lines of a prefixed with "-" and the common lines prefixed with " ", like a unified diff
+// with full context. It returns nil when the texts are the same.
+func DiffLines(a, b string) []string {
+	if a == b {
+		return nil
+	}
+	as, bs := splitLines(a), splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of as[i:] and bs[j:]
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(as)+len(bs))
+	i, j := 0, 0
+	for i < len(as) && j < len(bs) {
+		switch {
+		case as[i] == bs[j]:
+			lines = append(lines, " "+as[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+as[i])
+			i++
+		default:
+			lines = append(lines, "+"+bs[j])
+			j++
+		}
+	}
+	for ; i < len(as); i++ {
+		lines = append(lines, "-"+as[i])
+	}
+	for ; j < len(bs); j++ {
+		lines = append(lines, "+"+bs[j])
+	}
+	return lines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
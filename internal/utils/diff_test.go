@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		caseDesc string
+		a        string
+		b        string
+		want     []string
+	}{
+		{
+			caseDesc: "same",
+			a:        "a\nb\n",
+			b:        "a\nb\n",
+			want:     nil,
+		},
+		{
+			caseDesc: "changed line",
+			a:        "{\n  \"nodes\": 1\n}",
+			b:        "{\n  \"nodes\": 2\n}",
+			want:     []string{" {", "-  \"nodes\": 1", "+  \"nodes\": 2", " }"},
+		},
+		{
+			caseDesc: "added and removed lines",
+			a:        "a\nb\nc",
+			b:        "b\nc\nd",
+			want:     []string{"-a", " b", " c", "+d"},
+		},
+		{
+			caseDesc: "from empty",
+			a:        "",
+			b:        "a\nb",
+			want:     []string{"+a", "+b"},
+		},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, DiffLines(tc.a, tc.b), tc.caseDesc)
+	}
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/api7/gopkg/pkg/log"
 	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
@@ -12,8 +19,11 @@ import (
 
 	"github.com/api7/apisix-seed/internal/conf"
 	"github.com/api7/apisix-seed/internal/core/components"
+	"github.com/api7/apisix-seed/internal/core/message"
 	"github.com/api7/apisix-seed/internal/core/storer"
 	"github.com/api7/apisix-seed/internal/discoverer"
+	"github.com/api7/apisix-seed/internal/metrics"
+	"github.com/api7/apisix-seed/internal/server"
 )
 
 func initLogger(logConf *conf.Log) error {
@@ -46,25 +56,229 @@ func initLogger(logConf *conf.Log) error {
 	return nil
 }
 
+// target is a storage whose resources are served by apisix-seed
+type target struct {
+	name   string
+	prefix string
+	stg    storer.Interface
+}
+
+func initTargets() ([]*target, error) {
+	if len(conf.TargetConfigs) > 0 {
+		targets := make([]*target, 0, len(conf.TargetConfigs))
+		for _, t := range conf.TargetConfigs {
+			stg, err := storer.NewEtcd(&t.Etcd)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, &target{name: t.Name, prefix: t.Prefix, stg: stg})
+		}
+		return targets, nil
+	}
+
+	var stg storer.Interface
+	var err error
+	switch conf.Storage {
+	case conf.StorageAdminAPI:
+		stg, err = storer.NewAdminAPI(conf.AdminAPIConfig, conf.ETCDConfig.Prefix)
+	case conf.StorageStandalone:
+		resources := make([]string, 0, len(conf.ResourceConfigs))
+		for _, res := range conf.ResourceConfigs {
+			resources = append(resources, res.Name)
+		}
+		stg, err = storer.NewStandalone(conf.StandaloneConfig, conf.ETCDConfig.Prefix, resources)
+	default:
+		stg, err = storer.NewEtcd(conf.ETCDConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*target{{prefix: conf.ETCDConfig.Prefix, stg: stg}}, nil
+}
+
+// validate prints all problems of the configuration file and returns the exit code
+func validate(path string) int {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to read configuration: %s\n", err)
+		return 1
+	}
+
+	problems := conf.Validate(content)
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", path, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", path)
+	return 0
+}
+
+// syncOnce resolves the services of all entities and waits until their nodes are written
+func syncOnce(watcher *components.Watcher, rewriters []*components.Rewriter, dryRuns []*storer.DryRun) error {
+	if err := watcher.Init(); err != nil {
+		return err
+	}
+
+	var err error
+	for _, rewriter := range rewriters {
+		if flushErr := rewriter.Flush(context.Background()); flushErr != nil {
+			log.Errorf("write the nodes of target %q failed: %s", rewriter.Target, flushErr)
+			err = flushErr
+		}
+	}
+
+	if len(dryRuns) > 0 {
+		changed := 0
+		for _, dr := range dryRuns {
+			changed += dr.Changed()
+		}
+		fmt.Printf("%d entities would be changed\n", changed)
+	}
+	return err
+}
+
+// shutdown stops the components in order within the grace period: the watch events are no longer accepted,
+// the pending node updates are written, the services are unsubscribed from registries and the storages are closed
+func shutdown(watcher *components.Watcher, rewriters []*components.Rewriter, fanout *components.Fanout, targets []*target) {
+	gracePeriod := time.Duration(conf.ShutdownConfig.GracePeriod) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		watcher.Close()
+		for _, rewriter := range rewriters {
+			if err := rewriter.Flush(ctx); err != nil {
+				log.Errorf("drain the node updates of target %q: %s", rewriter.Target, err)
+			}
+		}
+		for _, rewriter := range rewriters {
+			rewriter.Close()
+		}
+		// the shared discoverers are stopped after all Rewriters are drained
+		if fanout != nil {
+			fanout.Close()
+		}
+		discoverer.FlushSnapshot()
+		for _, t := range targets {
+			if closer, ok := t.stg.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					log.Errorf("close the storage of target %q failed: %s", t.name, err)
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		log.Info("APISIX-Seed is stopped")
+	case <-ctx.Done():
+		log.Warnf("APISIX-Seed exits as the grace period of %s is over", gracePeriod)
+	}
+}
+
 func main() {
+	decommission := flag.Bool("decommission", false,
+		"restore all entities written by apisix-seed to their operator-authored form and exit")
+	flag.StringVar(&conf.ConfigFile, "c", "", "path of the configuration file, defaults to conf/conf.yaml under the work directory")
+	flag.StringVar(&conf.ConfigFile, "config", "", "same as -c")
+	flag.Parse()
+
+	var once, dryRun bool
+	switch flag.Arg(0) {
+	case "":
+	case "sync":
+		syncFlags := flag.NewFlagSet("sync", flag.ExitOnError)
+		// the one given before the command is kept unless it is given again
+		syncFlags.StringVar(&conf.ConfigFile, "c", conf.ConfigFile, "path of the configuration file")
+		syncFlags.StringVar(&conf.ConfigFile, "config", conf.ConfigFile, "same as -c")
+		syncFlags.BoolVar(&once, "once", false,
+			"resolve the services of all entities, write their nodes and exit")
+		syncFlags.BoolVar(&dryRun, "dry-run", false,
+			"print the diff of each entity to stdout instead of writing it")
+		_ = syncFlags.Parse(flag.Args()[1:])
+	case "validate":
+		validateFlags := flag.NewFlagSet("validate", flag.ExitOnError)
+		path := validateFlags.String("c", conf.Path(), "path of the configuration file to validate")
+		_ = validateFlags.Parse(flag.Args()[1:])
+		os.Exit(validate(*path))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		os.Exit(2)
+	}
+
 	conf.InitConf()
 
 	if err := initLogger(conf.LogConfig); err != nil {
 		log.Fatal(err)
 	}
+	if ignored := conf.Current().IgnoredEnv; len(ignored) > 0 {
+		log.Warnf("ignore the environment variables matching no configuration field: %s",
+			strings.Join(ignored, ", "))
+	}
+	message.SetOptions(messageOptions(conf.Current()))
 
-	etcdClient, err := storer.NewEtcd(conf.ETCDConfig)
+	targets, err := initTargets()
 	if err != nil {
 		panic(err)
 	}
+	dryRuns := make([]*storer.DryRun, 0)
+	if dryRun {
+		for _, t := range targets {
+			dr := storer.NewDryRun(t.stg, os.Stdout)
+			t.stg = dr
+			dryRuns = append(dryRuns, dr)
+		}
+	}
+
+	if *decommission {
+		for _, t := range targets {
+			if err = storer.InitTargetStores(t.name, t.prefix, t.stg); err != nil {
+				panic(err)
+			}
+		}
+		watcher := components.Watcher{}
+		if err = watcher.Restore(); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	var srv *server.Server
+	if conf.ServerConfig.Address != "" && !once {
+		srv = server.NewServer(conf.ServerConfig.Address)
+		srv.Handle("/metrics", metrics.Handler())
+		if err = srv.Start(); err != nil {
+			panic(err)
+		}
+		defer srv.Close()
+
+		for _, t := range targets {
+			checker, ok := t.stg.(storer.Checker)
+			if !ok {
+				continue
+			}
+			name := conf.Storage
+			if t.name != "" {
+				name = conf.StorageEtcd + "/" + t.name
+			}
+			srv.AddReadinessCheck(name, checker.Check)
+		}
+	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		err := storer.InitStores(etcdClient)
-		if err != nil {
-			panic(err)
+		for _, t := range targets {
+			if err := storer.InitTargetStores(t.name, t.prefix, t.stg); err != nil {
+				panic(err)
+			}
 		}
 	}()
 	go func() {
@@ -76,14 +290,72 @@ func main() {
 	}()
 	wg.Wait()
 
-	rewriter := components.Rewriter{
-		Prefix: conf.ETCDConfig.Prefix,
+	protector := components.NewProtector(conf.ProtectionConfig)
+	rewriters := make([]*components.Rewriter, 0, len(targets))
+	var fanout *components.Fanout
+	if len(conf.TargetConfigs) == 0 {
+		rewriter := &components.Rewriter{
+			Prefix:    conf.ETCDConfig.Prefix,
+			Protector: protector,
+		}
+		rewriter.Init()
+		rewriters = append(rewriters, rewriter)
+	} else {
+		// all targets share the subscriptions of discoverers
+		names := make([]string, 0, len(targets))
+		for _, t := range targets {
+			names = append(names, t.name)
+		}
+		fanout = components.NewFanout(names)
+		fanout.Init()
+
+		for _, t := range targets {
+			rewriter := &components.Rewriter{
+				Prefix:    t.prefix,
+				Target:    t.name,
+				Source:    fanout.Source(t.name),
+				Protector: protector,
+			}
+			rewriter.Init()
+			rewriters = append(rewriters, rewriter)
+		}
 	}
-	rewriter.Init()
-	defer rewriter.Close()
 
-	watcher := components.Watcher{}
+	watcher := components.Watcher{
+		Protector:         protector,
+		ReconcileInterval: time.Duration(conf.ReconcileConfig.Interval) * time.Second,
+		Rewriters:         rewriters,
+	}
+	if once {
+		err = syncOnce(&watcher, rewriters, dryRuns)
+		shutdown(&watcher, rewriters, fanout, targets)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if srv != nil {
+		srv.AddReadinessCheck("watcher", watcher.Check)
+		// stores and discoverers are ready to be dumped
+		srv.HandleDump("/debug/discoverers", func() interface{} { return discoverer.Dump() })
+		srv.HandleDump("/debug/stores", func() interface{} { return storer.Dump() })
+		srv.HandleDump("/debug/degraded", func() interface{} { return watcher.Degraded() })
+		srv.HandleDump("/debug/suppressed", func() interface{} { return protector.Suppressed() })
+	}
+	r := &reloader{
+		srv:       srv,
+		targets:   targets,
+		rewriters: rewriters,
+		fanout:    fanout,
+		watcher:   &watcher,
+		protector: protector,
+	}
+	for name := range conf.DisConfigs {
+		r.observe(name)
+	}
 	watcher.Watch()
+	defer shutdown(&watcher, rewriters, fanout, targets)
 	err = watcher.Init()
 	if err != nil {
 		log.Error(err.Error())
@@ -91,8 +363,15 @@ func main() {
 	}
 
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	sig := <-quit
-	log.Infof("APISIX-Seed receive %s and start shutting down", sig.String())
+	for sig := range quit {
+		if sig == syscall.SIGHUP {
+			log.Infof("APISIX-Seed receive %s and start reloading the configuration", sig.String())
+			r.reload()
+			continue
+		}
+		log.Infof("APISIX-Seed receive %s and start shutting down", sig.String())
+		break
+	}
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/api7/gopkg/pkg/log"
+
+	"github.com/api7/apisix-seed/internal/conf"
+	"github.com/api7/apisix-seed/internal/core/components"
+	"github.com/api7/apisix-seed/internal/core/message"
+	"github.com/api7/apisix-seed/internal/core/storer"
+	"github.com/api7/apisix-seed/internal/discoverer"
+	"github.com/api7/apisix-seed/internal/metrics"
+	"github.com/api7/apisix-seed/internal/server"
+)
+
+// reloader applies the configuration reloaded on SIGHUP to the running components,
+// only the discoverers and stores whose configurations are changed are created again
+type reloader struct {
+	srv       *server.Server
+	targets   []*target
+	rewriters []*components.Rewriter
+	fanout    *components.Fanout
+	watcher   *components.Watcher
+	protector *components.Protector
+
+	// discoverers whose queue depth is registered
+	observed map[string]struct{}
+}
+
+// observe registers the readiness check and the queue depth of a discoverer,
+// they look the discoverer up by name as it is created again when the configuration is reloaded
+func (r *reloader) observe(name string) {
+	if r.srv == nil {
+		return
+	}
+
+	r.srv.RemoveReadinessCheck("discoverer/" + name)
+	if dis, ok := discoverer.LookupDiscoverer(name); ok {
+		if _, ok := dis.(discoverer.HealthChecker); ok {
+			r.srv.AddReadinessCheck("discoverer/"+name, func(ctx context.Context) error {
+				dis, _ := discoverer.LookupDiscoverer(name)
+				if checker, ok := dis.(discoverer.HealthChecker); ok {
+					return checker.Check(ctx)
+				}
+				return nil
+			})
+		}
+	}
+
+	if r.observed == nil {
+		r.observed = make(map[string]struct{})
+	}
+	if _, ok := r.observed[name]; ok {
+		return
+	}
+	r.observed[name] = struct{}{}
+	err := metrics.RegisterQueueDepth(name, func() int {
+		if dis, ok := discoverer.LookupDiscoverer(name); ok {
+			return len(dis.Watch())
+		}
+		return 0
+	})
+	if err != nil {
+		log.Errorf("register the queue depth of %s failed: %s", name, err)
+	}
+}
+
+func (r *reloader) reload() {
+	old, ignored, err := conf.Reload()
+	if err != nil {
+		log.Errorf("reload configuration failed, the running one is kept: %s", err)
+		return
+	}
+	if len(ignored) > 0 {
+		log.Warnf("changes of %s take effect after a restart", strings.Join(ignored, ", "))
+	}
+
+	if !reflect.DeepEqual(old.Log, conf.LogConfig) {
+		if err = initLogger(conf.LogConfig); err != nil {
+			log.Errorf("reload logger failed: %s", err)
+		}
+	}
+	r.protector.SetPolicy(conf.ProtectionConfig)
+	message.SetOptions(messageOptions(conf.Current()))
+	r.reloadDiscoverers(old.Discovery)
+	r.reloadStores(old.Resources)
+	log.Info("configuration reloaded")
+}
+
+func (r *reloader) reloadDiscoverers(old map[string]interface{}) {
+	for name := range old {
+		if _, ok := conf.DisConfigs[name]; ok {
+			continue
+		}
+		if dis := discoverer.RemoveDiscoverer(name); dis != nil {
+			r.detach(dis)
+			dis.Stop()
+		}
+		if r.srv != nil {
+			r.srv.RemoveReadinessCheck("discoverer/" + name)
+		}
+		log.Infof("discoverer %s is removed", name)
+	}
+
+	for name, disConfig := range conf.DisConfigs {
+		oldConfig, ok := old[name]
+		if ok && reflect.DeepEqual(oldConfig, disConfig) {
+			continue
+		}
+
+		prev, err := discoverer.ReplaceDiscoverer(name, disConfig)
+		if err != nil {
+			log.Errorf("reload discoverer %s failed: %s", name, err)
+			// try again on the next reload
+			if ok {
+				conf.DisConfigs[name] = oldConfig
+			} else {
+				delete(conf.DisConfigs, name)
+			}
+			continue
+		}
+		if prev != nil {
+			r.detach(prev)
+			prev.Stop()
+		}
+		r.attach(discoverer.GetDiscoverer(name))
+		r.observe(name)
+
+		// the new discoverer has no subscriptions yet
+		r.watcher.Requery(name)
+		log.Infof("discoverer %s is reloaded", name)
+	}
+}
+
+func (r *reloader) attach(dis discoverer.Discoverer) {
+	if r.fanout != nil {
+		r.fanout.Attach(dis)
+		return
+	}
+	for _, rewriter := range r.rewriters {
+		rewriter.Attach(dis)
+	}
+}
+
+func (r *reloader) detach(dis discoverer.Discoverer) {
+	if r.fanout != nil {
+		r.fanout.Detach(dis)
+		return
+	}
+	for _, rewriter := range r.rewriters {
+		rewriter.Detach(dis)
+	}
+}
+
+func (r *reloader) reloadStores(old []*conf.Resource) {
+	oldResources := make(map[string]*conf.Resource, len(old))
+	for _, res := range old {
+		oldResources[res.Name] = res
+	}
+	resources := make(map[string]*conf.Resource, len(conf.ResourceConfigs))
+	for _, res := range conf.ResourceConfigs {
+		resources[res.Name] = res
+	}
+
+	for name, res := range oldResources {
+		if reflect.DeepEqual(res, resources[name]) {
+			continue
+		}
+		for _, t := range r.targets {
+			if s := storer.RemoveTargetStore(t.name, name); s != nil {
+				r.watcher.RemoveStore(s)
+			}
+		}
+		log.Infof("resource %s is removed", name)
+	}
+
+	for name, res := range resources {
+		if reflect.DeepEqual(res, oldResources[name]) {
+			continue
+		}
+		for _, t := range r.targets {
+			if err := storer.InitTargetStore(t.name, t.prefix, t.stg, res); err != nil {
+				log.Errorf("create the store of resource %s failed: %s", name, err)
+				continue
+			}
+			if err := r.watcher.AddStore(storer.GetTargetStore(t.name, name)); err != nil {
+				log.Errorf("load resource %s failed: %s", name, err)
+			}
+		}
+		log.Infof("resource %s is watched", name)
+	}
+}
+
+// messageOptions returns how the entities are written in the configuration
+func messageOptions(s *conf.Settings) message.Options {
+	return message.Options{
+		WriteMode:     s.WriteMode,
+		APISIXVersion: s.APISIXVersion,
+		NodesMerge:    s.Nodes.Merge,
+		NodesFormat:   s.Nodes.Format,
+	}
+}